@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"hash/crc32"
 	"io"
 	"log"
+	"strconv"
 	"time"
 
 	pb "github.com/accretional/plan92/gen/plan92/v1"
@@ -11,6 +15,9 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+// crc32cTable matches the CRC-32C (Castagnoli) checksums sent by the server
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 func main() {
 	// Connect to server
 	conn, err := grpc.Dial("localhost:9000",
@@ -68,8 +75,9 @@ func main() {
 		Data: &pb.WriteRequest_Metadata{
 			Metadata: &pb.WriteMetadata{
 				Fd:        writeFD,
-				Offset:    -1, // Append
+				Offset:    -1, // Current position
 				TotalSize: int64(len("Hello, Plan92 Filesystem!")),
+				SessionId: sessionID,
 			},
 		},
 	})
@@ -94,7 +102,7 @@ func main() {
 	log.Printf("✓ Wrote %d bytes", writeResp.BytesWritten)
 
 	// Close write FD
-	_, err = client.Close(ctx, &pb.CloseRequest{Fd: writeFD})
+	_, err = client.Close(ctx, &pb.CloseRequest{Fd: writeFD, SessionId: sessionID})
 	if err != nil {
 		log.Fatalf("Failed to close write FD: %v", err)
 	}
@@ -134,9 +142,11 @@ func main() {
 
 	// Stream read
 	readStream, err := client.Read(ctx, &pb.ReadRequest{
-		Fd:     readFD,
-		Offset: -1, // Current position (start)
-		Count:  -1, // Read all
+		Fd:        readFD,
+		Offset:    -1, // Current position (start)
+		Count:     -1, // Read all
+		SessionId: sessionID,
+		Checksums: true,
 	})
 	if err != nil {
 		log.Fatalf("Failed to create read stream: %v", err)
@@ -160,14 +170,24 @@ func main() {
 			log.Printf("✓ Read metadata received:")
 			log.Printf("  Total size: %d bytes", readMetadata.TotalSize)
 		case *pb.ReadResponse_Chunk:
+			// Verify each chunk as it arrives
+			if crc32.Checksum(data.Chunk, crc32cTable) != resp.ChunkCrc32C {
+				log.Fatalf("Chunk checksum mismatch")
+			}
 			readContent = append(readContent, data.Chunk...)
 		}
 	}
 
 	log.Printf("✓ Read %d bytes: %q", len(readContent), string(readContent))
 
+	// Verify the whole file against the digest in the metadata
+	if sum := sha256.Sum256(readContent); !bytes.Equal(sum[:], readMetadata.FileInfo.GetSha256()) {
+		log.Fatalf("File checksum mismatch")
+	}
+	log.Printf("✓ Verified sha256: %x", readMetadata.FileInfo.GetSha256())
+
 	// Close read FD
-	_, err = client.Close(ctx, &pb.CloseRequest{Fd: readFD})
+	_, err = client.Close(ctx, &pb.CloseRequest{Fd: readFD, SessionId: sessionID})
 	if err != nil {
 		log.Fatalf("Failed to close read FD: %v", err)
 	}
@@ -199,6 +219,7 @@ func main() {
 				Fd:        fd2,
 				Offset:    -1,
 				TotalSize: int64(len(content2)),
+				SessionId: sessionID,
 			},
 		},
 	})
@@ -219,14 +240,33 @@ func main() {
 	}
 	log.Printf("✓ Wrote %d bytes", writeResp2.BytesWritten)
 
-	_, err = client.Close(ctx, &pb.CloseRequest{Fd: fd2})
+	_, err = client.Close(ctx, &pb.CloseRequest{Fd: fd2, SessionId: sessionID})
 	if err != nil {
 		log.Fatalf("Failed to close FD: %v", err)
 	}
 	log.Printf("✓ Closed fd=%d", fd2)
 
-	// Step 6: Close Session
-	log.Println("\n[6] Closing session...")
+	// Step 6: Filesystem Usage
+	log.Println("\n[6] Getting filesystem usage...")
+	statFsResp, err := client.StatFs(ctx, &pb.StatFsRequest{
+		SessionId: sessionID,
+		Path:      "/",
+	})
+	if err != nil {
+		log.Fatalf("Failed to stat filesystem: %v", err)
+	}
+	log.Printf("✓ Filesystem (%s backend):", statFsResp.Backend)
+	log.Printf("  Bytes: %d used, %s available of %s", statFsResp.UsedBytes,
+		formatLimit(statFsResp.AvailableBytes, -1), formatLimit(statFsResp.TotalBytes, 0))
+	log.Printf("  Inodes: %d used, %s available of %s", statFsResp.UsedInodes,
+		formatLimit(statFsResp.AvailableInodes, -1), formatLimit(statFsResp.TotalInodes, 0))
+	for _, quota := range statFsResp.Quotas {
+		log.Printf("  Quota %s %s: %d of %s bytes, %d of %s inodes", quota.Kind, quota.Name,
+			quota.UsedBytes, formatLimit(quota.MaxBytes, 0), quota.UsedInodes, formatLimit(quota.MaxInodes, 0))
+	}
+
+	// Step 7: Close Session
+	log.Println("\n[7] Closing session...")
 	_, err = client.CloseSession(ctx, &pb.CloseSessionRequest{
 		SessionId: sessionID,
 	})
@@ -239,3 +279,11 @@ func main() {
 	log.Println("✓ All operations completed successfully!")
 	log.Println("========================================")
 }
+
+// formatLimit formats a capacity figure, where unlimited means no limit
+func formatLimit(n, unlimited int64) string {
+	if n == unlimited {
+		return "unlimited"
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// ACL entry permission bits, matching the rwx bits of one mode class
+	aclRead    = 4
+	aclWrite   = 2
+	aclExecute = 1
+)
+
+// aclAllows reports whether user holds all of the want permission bits on
+// the file. Entries are evaluated in POSIX order: the owner, named users,
+// the owning and named groups, then everyone else. The mask bounds named
+// users and all group entries. Without an ACL this is the classic
+// owner/group/other check on the mode bits.
+func aclAllows(info *pb.FileInfo, want uint32, user string, groups []string) bool {
+	// The owner and other classes are kept in the mode bits either way
+	if info.Owner == user {
+		return (info.Mode>>6)&want == want
+	}
+
+	if len(info.Acl) == 0 {
+		if slices.Contains(groups, info.Group) {
+			return (info.Mode>>3)&want == want
+		}
+		return info.Mode&want == want
+	}
+
+	mask := uint32(07)
+	for _, entry := range info.Acl {
+		if entry.Tag == pb.AclTag_ACL_TAG_MASK {
+			mask = entry.Perms
+		}
+	}
+
+	for _, entry := range info.Acl {
+		if entry.Tag == pb.AclTag_ACL_TAG_USER && entry.Qualifier == user {
+			return entry.Perms&mask&want == want
+		}
+	}
+
+	// Any one matching group entry must grant everything requested
+	matched := false
+	for _, entry := range info.Acl {
+		if (entry.Tag == pb.AclTag_ACL_TAG_GROUP_OBJ && slices.Contains(groups, info.Group)) ||
+			(entry.Tag == pb.AclTag_ACL_TAG_GROUP && slices.Contains(groups, entry.Qualifier)) {
+			if entry.Perms&mask&want == want {
+				return true
+			}
+			matched = true
+		}
+	}
+	if matched {
+		return false
+	}
+
+	return info.Mode&want == want
+}
+
+// accessAcl returns the access ACL of the file, derived from the mode bits
+// if the file has no extended entries
+func accessAcl(info *pb.FileInfo) []*pb.AclEntry {
+	if len(info.Acl) > 0 {
+		return info.Acl
+	}
+	return []*pb.AclEntry{
+		{Tag: pb.AclTag_ACL_TAG_USER_OBJ, Perms: (info.Mode >> 6) & 07},
+		{Tag: pb.AclTag_ACL_TAG_GROUP_OBJ, Perms: (info.Mode >> 3) & 07},
+		{Tag: pb.AclTag_ACL_TAG_OTHER, Perms: info.Mode & 07},
+	}
+}
+
+// checkAcl validates a complete ACL and returns a copy in canonical order.
+// It needs exactly one USER_OBJ, GROUP_OBJ and OTHER entry, and a MASK as
+// soon as there are named users or groups.
+func checkAcl(entries []*pb.AclEntry) ([]*pb.AclEntry, error) {
+	type key struct {
+		tag       pb.AclTag
+		qualifier string
+	}
+	seen := make(map[key]bool)
+	named := false
+
+	for _, entry := range entries {
+		switch entry.Tag {
+		case pb.AclTag_ACL_TAG_USER, pb.AclTag_ACL_TAG_GROUP:
+			if entry.Qualifier == "" {
+				return nil, fmt.Errorf("%s entry needs a qualifier", aclTagName(entry.Tag))
+			}
+			named = true
+		case pb.AclTag_ACL_TAG_USER_OBJ, pb.AclTag_ACL_TAG_GROUP_OBJ,
+			pb.AclTag_ACL_TAG_MASK, pb.AclTag_ACL_TAG_OTHER:
+			if entry.Qualifier != "" {
+				return nil, fmt.Errorf("%s entry takes no qualifier", aclTagName(entry.Tag))
+			}
+		default:
+			return nil, fmt.Errorf("invalid ACL tag: %v", entry.Tag)
+		}
+
+		if entry.Perms&^07 != 0 {
+			return nil, fmt.Errorf("invalid permissions %o for %s entry", entry.Perms, aclTagName(entry.Tag))
+		}
+
+		k := key{entry.Tag, entry.Qualifier}
+		if seen[k] {
+			return nil, fmt.Errorf("duplicate %s entry %s", aclTagName(entry.Tag), entry.Qualifier)
+		}
+		seen[k] = true
+	}
+
+	for _, tag := range []pb.AclTag{pb.AclTag_ACL_TAG_USER_OBJ, pb.AclTag_ACL_TAG_GROUP_OBJ, pb.AclTag_ACL_TAG_OTHER} {
+		if !seen[key{tag: tag}] {
+			return nil, fmt.Errorf("missing %s entry", aclTagName(tag))
+		}
+	}
+	if named && !seen[key{tag: pb.AclTag_ACL_TAG_MASK}] {
+		return nil, fmt.Errorf("named entries need a mask entry")
+	}
+
+	canonical := make([]*pb.AclEntry, len(entries))
+	for i, entry := range entries {
+		canonical[i] = proto.Clone(entry).(*pb.AclEntry)
+	}
+	slices.SortFunc(canonical, func(a, b *pb.AclEntry) int {
+		if a.Tag != b.Tag {
+			return int(a.Tag) - int(b.Tag)
+		}
+		return strings.Compare(a.Qualifier, b.Qualifier)
+	})
+
+	return canonical, nil
+}
+
+// setAccessAcl applies a canonical access ACL to info, which must not be
+// stored yet. The owner and other entries live in the mode bits, and so
+// does the mask, or the owning group if there is no mask. An empty ACL
+// drops the extended entries and keeps the owning group's permissions.
+func setAccessAcl(info *pb.FileInfo, acl []*pb.AclEntry) {
+	if len(acl) == 0 {
+		current := accessAcl(info)
+		acl = []*pb.AclEntry{
+			aclEntry(current, pb.AclTag_ACL_TAG_USER_OBJ),
+			aclEntry(current, pb.AclTag_ACL_TAG_GROUP_OBJ),
+			aclEntry(current, pb.AclTag_ACL_TAG_OTHER),
+		}
+	}
+
+	user := aclEntry(acl, pb.AclTag_ACL_TAG_USER_OBJ).Perms
+	group := aclEntry(acl, pb.AclTag_ACL_TAG_GROUP_OBJ).Perms
+	other := aclEntry(acl, pb.AclTag_ACL_TAG_OTHER).Perms
+
+	info.Acl = nil
+	if len(acl) > 3 {
+		group = aclEntry(acl, pb.AclTag_ACL_TAG_MASK).Perms
+		info.Acl = acl
+	}
+
+	info.Mode = info.Mode&^0777 | user<<6 | group<<3 | other
+	info.HasAcl = len(info.Acl) > 0 || len(info.DefaultAcl) > 0
+}
+
+// setDefaultAcl sets the default ACL of a directory in info, which must
+// not be stored yet
+func setDefaultAcl(info *pb.FileInfo, acl []*pb.AclEntry) {
+	info.DefaultAcl = acl
+	info.HasAcl = len(info.Acl) > 0 || len(info.DefaultAcl) > 0
+}
+
+// inheritAcl gives a new entry the default ACL of its parent directory.
+// As in POSIX, the creation mode limits the owner, other and mask (or
+// owning group) entries, and new directories also inherit the default ACL
+// itself.
+func inheritAcl(parent, info *pb.FileInfo) {
+	if parent == nil || len(parent.DefaultAcl) == 0 {
+		return
+	}
+
+	hasMask := aclEntry(parent.DefaultAcl, pb.AclTag_ACL_TAG_MASK) != nil
+	acl := make([]*pb.AclEntry, len(parent.DefaultAcl))
+	for i, entry := range parent.DefaultAcl {
+		entry = proto.Clone(entry).(*pb.AclEntry)
+		switch {
+		case entry.Tag == pb.AclTag_ACL_TAG_USER_OBJ:
+			entry.Perms &= (info.Mode >> 6) & 07
+		case entry.Tag == pb.AclTag_ACL_TAG_MASK,
+			entry.Tag == pb.AclTag_ACL_TAG_GROUP_OBJ && !hasMask:
+			entry.Perms &= (info.Mode >> 3) & 07
+		case entry.Tag == pb.AclTag_ACL_TAG_OTHER:
+			entry.Perms &= info.Mode & 07
+		}
+		acl[i] = entry
+	}
+
+	if info.Type == pb.FileType_FILE_TYPE_DIRECTORY {
+		info.DefaultAcl = parent.DefaultAcl
+	}
+	setAccessAcl(info, acl)
+}
+
+// aclEntry returns the entry with the given unqualified tag, or nil
+func aclEntry(acl []*pb.AclEntry, tag pb.AclTag) *pb.AclEntry {
+	for _, entry := range acl {
+		if entry.Tag == tag {
+			return entry
+		}
+	}
+	return nil
+}
+
+// aclTagName returns the short name of a tag for error messages
+func aclTagName(tag pb.AclTag) string {
+	return strings.ToLower(strings.TrimPrefix(tag.String(), "ACL_TAG_"))
+}
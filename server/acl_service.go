@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetAcl returns the access or default ACL of a file. Like Stat, it needs
+// no permission on the file itself.
+func (s *Plan92ServiceImpl) GetAcl(
+	ctx context.Context,
+	req *pb.GetAclRequest,
+) (*pb.GetAclResponse, error) {
+	if _, err := s.sessions.Get(req.SessionId); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	info, err := s.storage.GetInfo(req.Path)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "file not found: %v", err)
+	}
+
+	entries := accessAcl(info)
+	if req.Default {
+		entries = info.DefaultAcl
+	}
+
+	return &pb.GetAclResponse{Entries: entries}, nil
+}
+
+// SetAcl replaces the access or default ACL of a file owned by the
+// session, or of any file for a privileged session
+func (s *Plan92ServiceImpl) SetAcl(
+	ctx context.Context,
+	req *pb.SetAclRequest,
+) (*pb.SetAclResponse, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	// A capability carries no ownership, so it cannot change an ACL
+	if session.Capability != nil {
+		err := fsErrorf(codes.PermissionDenied, pb.FSErrorCode_FS_ERROR_CODE_PERMISSION_DENIED,
+			"capability sessions may not change ACLs")
+		s.audit(session, "setacl", req.Path, pb.OpenMode_OPEN_MODE_UNSPECIFIED, 0, err)
+		return nil, err
+	}
+
+	var acl []*pb.AclEntry
+	if len(req.Entries) > 0 {
+		if acl, err = checkAcl(req.Entries); err != nil {
+			return nil, fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_INVALID_ARGUMENT, "invalid ACL: %v", err)
+		}
+	}
+
+	data, err := s.storage.Get(req.Path)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "file not found: %v", err)
+	}
+
+	// Check ownership against the metadata being replaced
+	info, err := s.storage.UpdateInfo(data, func(info *pb.FileInfo) error {
+		if info.Owner != session.User && !s.privileged(session) {
+			return fsErrorf(codes.PermissionDenied, pb.FSErrorCode_FS_ERROR_CODE_PERMISSION_DENIED,
+				"only the owner may change the ACL of %s", req.Path)
+		}
+
+		if req.Default {
+			if info.Type != pb.FileType_FILE_TYPE_DIRECTORY {
+				return fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_NOT_DIRECTORY,
+					"default ACLs are only supported on directories")
+			}
+			setDefaultAcl(info, acl)
+		} else {
+			setAccessAcl(info, acl)
+		}
+		return nil
+	})
+	s.audit(session, "setacl", req.Path, pb.OpenMode_OPEN_MODE_UNSPECIFIED, 0, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SetAclResponse{Info: info}, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAcl_EvaluationOrder(t *testing.T) {
+	info := &pb.FileInfo{Owner: "alice", Group: "staff", Mode: 0640}
+	acl, err := checkAcl([]*pb.AclEntry{
+		{Tag: pb.AclTag_ACL_TAG_OTHER, Perms: 0},
+		{Tag: pb.AclTag_ACL_TAG_USER, Qualifier: "bob", Perms: 07},
+		{Tag: pb.AclTag_ACL_TAG_USER_OBJ, Perms: 06},
+		{Tag: pb.AclTag_ACL_TAG_GROUP_OBJ, Perms: 04},
+		{Tag: pb.AclTag_ACL_TAG_GROUP, Qualifier: "writers", Perms: 02},
+		{Tag: pb.AclTag_ACL_TAG_MASK, Perms: 06},
+	})
+	if err != nil {
+		t.Fatalf("Failed to check ACL: %v", err)
+	}
+	setAccessAcl(info, acl)
+
+	if info.Mode != 0660 || !info.HasAcl {
+		t.Errorf("Expected mode 0660 with an ACL, got: %o (has_acl %v)", info.Mode, info.HasAcl)
+	}
+
+	tests := []struct {
+		name   string
+		user   string
+		groups []string
+		want   uint32
+		allow  bool
+	}{
+		{"owner", "alice", nil, aclRead | aclWrite, true},
+		{"named user limited by mask", "bob", nil, aclExecute, false},
+		{"named user", "bob", []string{"staff"}, aclRead | aclWrite, true},
+		{"owning group", "carol", []string{"staff"}, aclRead, true},
+		{"named group", "carol", []string{"writers"}, aclWrite, true},
+		{"no single group grants both", "carol", []string{"staff", "writers"}, aclRead | aclWrite, false},
+		{"matched group does not fall back to other", "carol", []string{"writers"}, aclRead, false},
+		{"other", "dave", nil, aclRead, false},
+	}
+	for _, tt := range tests {
+		if got := aclAllows(info, tt.want, tt.user, tt.groups); got != tt.allow {
+			t.Errorf("%s: expected %v, got: %v", tt.name, tt.allow, got)
+		}
+	}
+
+	if _, err := checkAcl(acl[:len(acl)-2]); err == nil {
+		t.Errorf("Expected an ACL without other entry to be rejected")
+	}
+}
+
+func TestAcl_SetAndInherit(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	if err := storage.Create("/shared", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+		Mode:  0755,
+		Owner: "alice",
+		Group: "users",
+	}); err != nil {
+		t.Fatalf("Failed to create /shared: %v", err)
+	}
+
+	alice, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice", Groups: []string{"users"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	bob, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "bob", Groups: []string{"others"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if err := writeTestFile(ctx, client, alice.SessionId, "/shared/notes.txt", "draft"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	openForWrite := func(sessionID, path string) error {
+		_, err := client.Open(ctx, &pb.OpenRequest{Path: path, Mode: pb.OpenMode_OPEN_MODE_WRITE, SessionId: sessionID})
+		return err
+	}
+	if err := openForWrite(bob.SessionId, "/shared/notes.txt"); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied before the ACL, got: %v", err)
+	}
+
+	grantBob := []*pb.AclEntry{
+		{Tag: pb.AclTag_ACL_TAG_USER_OBJ, Perms: 06},
+		{Tag: pb.AclTag_ACL_TAG_USER, Qualifier: "bob", Perms: 06},
+		{Tag: pb.AclTag_ACL_TAG_GROUP_OBJ, Perms: 04},
+		{Tag: pb.AclTag_ACL_TAG_MASK, Perms: 06},
+		{Tag: pb.AclTag_ACL_TAG_OTHER, Perms: 04},
+	}
+
+	// Only the owner may set an ACL, and it must be complete
+	if _, err := client.SetAcl(ctx, &pb.SetAclRequest{Path: "/shared/notes.txt", SessionId: bob.SessionId, Entries: grantBob}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for a non-owner, got: %v", err)
+	}
+	if _, err := client.SetAcl(ctx, &pb.SetAclRequest{Path: "/shared/notes.txt", SessionId: alice.SessionId, Entries: grantBob[:3]}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an ACL without other entry, got: %v", err)
+	}
+
+	setResp, err := client.SetAcl(ctx, &pb.SetAclRequest{Path: "/shared/notes.txt", SessionId: alice.SessionId, Entries: grantBob})
+	if err != nil {
+		t.Fatalf("Failed to set ACL: %v", err)
+	}
+	if !setResp.Info.HasAcl {
+		t.Errorf("Expected has_acl after setting an ACL")
+	}
+	if err := openForWrite(bob.SessionId, "/shared/notes.txt"); err != nil {
+		t.Errorf("Expected bob to open for write through the ACL, got: %v", err)
+	}
+
+	getResp, err := client.GetAcl(ctx, &pb.GetAclRequest{Path: "/shared/notes.txt", SessionId: bob.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to get ACL: %v", err)
+	}
+	if len(getResp.Entries) != 5 || getResp.Entries[1].Qualifier != "bob" {
+		t.Errorf("Expected the ACL in canonical order, got: %v", getResp.Entries)
+	}
+
+	// Removing the extended entries revokes bob's access
+	setResp, err = client.SetAcl(ctx, &pb.SetAclRequest{Path: "/shared/notes.txt", SessionId: alice.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to remove ACL: %v", err)
+	}
+	if setResp.Info.HasAcl || setResp.Info.Mode != 0644 {
+		t.Errorf("Expected mode 0644 without an ACL, got: %o (has_acl %v)", setResp.Info.Mode, setResp.Info.HasAcl)
+	}
+	if err := openForWrite(bob.SessionId, "/shared/notes.txt"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied after removing the ACL, got: %v", err)
+	}
+
+	// New files inherit the directory's default ACL
+	if _, err := client.SetAcl(ctx, &pb.SetAclRequest{Path: "/shared/notes.txt", SessionId: alice.SessionId, Entries: grantBob, Default: true}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a default ACL on a file, got: %v", err)
+	}
+	if _, err := client.SetAcl(ctx, &pb.SetAclRequest{Path: "/shared", SessionId: alice.SessionId, Entries: grantBob, Default: true}); err != nil {
+		t.Fatalf("Failed to set default ACL: %v", err)
+	}
+	if err := writeTestFile(ctx, client, alice.SessionId, "/shared/inherited.txt", "new"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	info, err := storage.GetInfo("/shared/inherited.txt")
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if !info.HasAcl || len(info.DefaultAcl) != 0 {
+		t.Errorf("Expected an inherited access ACL and no default ACL on a file, got: %v", info)
+	}
+	if err := openForWrite(bob.SessionId, "/shared/inherited.txt"); err != nil {
+		t.Errorf("Expected bob to open an inheriting file for write, got: %v", err)
+	}
+}
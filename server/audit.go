@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Audit record results
+const (
+	auditOK     = "ok"
+	auditDenied = "denied"
+	auditError  = "error"
+)
+
+// AuditRecord is one line of the audit log
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session"`
+	User       string    `json:"user,omitempty"`
+	Groups     []string  `json:"groups,omitempty"`
+	Capability string    `json:"capability,omitempty"` // ID of the capability the access was made through
+	Operation  string    `json:"op"`
+	Path       string    `json:"path"`
+	Mode       string    `json:"mode,omitempty"`
+	Result     string    `json:"result"` // "ok", "denied" or "error"
+	Reason     string    `json:"reason,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+}
+
+// newAuditRecord describes an operation by session on filePath that ended
+// with err, classifying permission and authentication failures as denials
+func newAuditRecord(session *Session, op, filePath string, mode pb.OpenMode, bytes int64, err error) *AuditRecord {
+	record := &AuditRecord{
+		Time:      time.Now(),
+		Session:   session.ID,
+		User:      session.User,
+		Groups:    session.Groups,
+		Operation: op,
+		Path:      filePath,
+		Mode:      auditMode(mode),
+		Result:    auditOK,
+		Bytes:     bytes,
+	}
+	if session.Capability != nil {
+		record.Capability = session.Capability.ID
+	}
+
+	if err != nil {
+		record.Result = auditError
+		switch status.Code(err) {
+		case codes.PermissionDenied, codes.Unauthenticated:
+			record.Result = auditDenied
+		}
+		if st, ok := status.FromError(err); ok {
+			record.Reason = st.Message()
+		} else {
+			record.Reason = err.Error()
+		}
+	}
+
+	return record
+}
+
+// auditMode returns the short name of an open mode, or "" if unspecified
+func auditMode(mode pb.OpenMode) string {
+	if mode == pb.OpenMode_OPEN_MODE_UNSPECIFIED {
+		return ""
+	}
+	return strings.ToLower(strings.TrimPrefix(mode.String(), "OPEN_MODE_"))
+}
+
+// AuditLog appends records as JSON lines to a local file. When the file
+// would grow past maxSize it is rotated: the current file becomes
+// path.1, path.1 becomes path.2 and so on, keeping keep old files.
+//
+// A nil AuditLog discards records, so callers need not check whether
+// auditing is enabled.
+type AuditLog struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenAuditLog opens the audit log at filePath for appending
+func OpenAuditLog(filePath string, maxSize int64, keep int) (*AuditLog, error) {
+	l := &AuditLog{path: filePath, maxSize: maxSize, keep: keep}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Record appends a record. Failures are logged rather than returned, so
+// an unwritable audit log does not fail the operation being recorded.
+func (l *AuditLog) Record(record *AuditRecord) {
+	if l == nil {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to encode audit record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("Failed to rotate audit log: %v", err)
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write audit record: %v", err)
+	}
+}
+
+// Contents returns the current audit log file, without rotated files
+func (l *AuditLog) Contents() ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return os.ReadFile(l.path)
+}
+
+// Close closes the audit log file
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
+
+// open opens the log file for appending. The caller must hold l.mu or
+// own l exclusively.
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = stat.Size()
+	return nil
+}
+
+// rotate shifts the old log files up by one, dropping the oldest, and
+// starts a new current file. The caller must hold l.mu.
+func (l *AuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	// Keep logging to a fresh file even if shifting the old ones failed
+	var shiftErr error
+	for i := l.keep; i > 0; i-- {
+		older := fmt.Sprintf("%s.%d", l.path, i)
+		newer := l.path
+		if i > 1 {
+			newer = fmt.Sprintf("%s.%d", l.path, i-1)
+		}
+		if err := os.Rename(newer, older); err != nil && !os.IsNotExist(err) && shiftErr == nil {
+			shiftErr = err
+		}
+	}
+	if l.keep == 0 {
+		os.Remove(l.path)
+	}
+
+	if err := l.open(); err != nil {
+		return err
+	}
+	return shiftErr
+}
+
+// audit records an operation by session on filePath that ended with err
+func (s *Plan92ServiceImpl) audit(session *Session, op, filePath string, mode pb.OpenMode, bytes int64, err error) {
+	if s.inodeService.audit != nil {
+		s.inodeService.audit.Record(newAuditRecord(session, op, filePath, mode, bytes, err))
+	}
+}
+
+// auditFD records an operation by session through one of its open FDs
+func (s *Plan92ServiceImpl) auditFD(session *Session, handle *FileHandle, op string, bytes int64, err error) {
+	s.audit(session, op, handle.Path, handle.Mode, bytes, err)
+}
+
+// openAuditLog opens a snapshot of the audit log as a read-only file. Only
+// privileged sessions may read it.
+func (s *Plan92ServiceImpl) openAuditLog(session *Session, req *pb.OpenRequest) (*pb.FileStatus, error) {
+	auditLog := s.inodeService.audit
+	if auditLog == nil {
+		return nil, status.Errorf(codes.NotFound, "file not found: %s", req.Path)
+	}
+	if !s.privileged(session) {
+		return nil, fsErrorf(codes.PermissionDenied, pb.FSErrorCode_FS_ERROR_CODE_PERMISSION_DENIED,
+			"permission denied: the audit log is only readable by privileged users")
+	}
+	if req.Mode != pb.OpenMode_OPEN_MODE_READ {
+		return nil, fsErrorf(codes.PermissionDenied, pb.FSErrorCode_FS_ERROR_CODE_PERMISSION_DENIED,
+			"permission denied: the audit log is read-only")
+	}
+
+	content, err := auditLog.Contents()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read audit log: %v", err)
+	}
+
+	// The snapshot lives outside the namespace and goes away on Close
+	data := &FileData{
+		Content: NewExtents(content),
+		Info: &pb.FileInfo{
+			Type:   pb.FileType_FILE_TYPE_REGULAR,
+			Mode:   0400,
+			Owner:  s.inodeService.permChecker.superuser,
+			Length: int64(len(content)),
+			Mtime:  timestamppb.Now(),
+		},
+		RefCount: 1,
+		Unlinked: true,
+	}
+	fd, err := session.FDTable.Allocate(req.Path, req.Mode, data)
+	if err != nil {
+		return nil, limitError(err)
+	}
+
+	return &pb.FileStatus{
+		Fd:        fd,
+		Path:      req.Path,
+		Info:      data.Info,
+		Mode:      req.Mode,
+		SessionId: session.ID,
+	}, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// readAuditLog parses the JSON lines of an audit log file
+func readAuditLog(t *testing.T, filePath string) []AuditRecord {
+	t.Helper()
+
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAudit_RecordsOperations(t *testing.T) {
+	storage := NewMemoryStorage()
+	sessions := NewSessionManager()
+	inodeService := NewInodeService(storage, sessions)
+	inodeService.permChecker.superuser = "root"
+	service := NewPlan92Service(storage, sessions, inodeService)
+	service.config.AuditPath = "/.audit"
+
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := OpenAuditLog(logPath, 1024*1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+	inodeService.audit = auditLog
+
+	ctx := context.Background()
+	if err := storage.Create("/private.txt", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_REGULAR,
+		Mode:  0600,
+		Owner: "alice",
+		Group: "users",
+	}); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	alice, _ := sessions.Create("alice", []string{"users"})
+	bob, _ := sessions.Create("bob", []string{"users"})
+	root, _ := sessions.Create("root", nil)
+
+	// A denied open, a successful open, truncate and fallocate, an ACL
+	// change, a failed removal and denied quota and attribute changes
+	if _, err := service.Open(ctx, &pb.OpenRequest{Path: "/private.txt", Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: bob.ID}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied, got: %v", err)
+	}
+	opened, err := service.Open(ctx, &pb.OpenRequest{Path: "/private.txt", Mode: pb.OpenMode_OPEN_MODE_WRITE, SessionId: alice.ID})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	if _, err := service.Truncate(ctx, &pb.TruncateRequest{Target: &pb.TruncateRequest_Fd{Fd: opened.Fd}, SessionId: opened.SessionId, Length: 10}); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if _, err := service.Fallocate(ctx, &pb.FallocateRequest{Fd: opened.Fd, SessionId: opened.SessionId, Length: 20}); err != nil {
+		t.Fatalf("Failed to fallocate: %v", err)
+	}
+	if _, err := service.SetAcl(ctx, &pb.SetAclRequest{Path: "/private.txt", SessionId: alice.ID}); err != nil {
+		t.Fatalf("Failed to set ACL: %v", err)
+	}
+	if _, err := service.Remove(ctx, &pb.RemoveRequest{Path: "/missing.txt", SessionId: alice.ID}); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound, got: %v", err)
+	}
+	if _, err := service.SetQuota(ctx, &pb.SetQuotaRequest{SessionId: bob.ID, Kind: pb.QuotaKind_QUOTA_KIND_USER, Name: "bob", MaxBytes: 1 << 30}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied, got: %v", err)
+	}
+	if _, err := service.SetXattr(ctx, &pb.SetXattrRequest{Path: "/private.txt", Name: "user.tag", Value: []byte("x"), SessionId: bob.ID}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied, got: %v", err)
+	}
+
+	want := []struct {
+		op, user, result string
+	}{
+		{"open", "bob", auditDenied},
+		{"open", "alice", auditOK},
+		{"truncate", "alice", auditOK},
+		{"fallocate", "alice", auditOK},
+		{"setacl", "alice", auditOK},
+		{"remove", "alice", auditError},
+		{"setquota", "bob", auditDenied},
+		{"setxattr", "bob", auditDenied},
+	}
+	records := readAuditLog(t, logPath)
+	if len(records) != len(want) {
+		t.Fatalf("Expected %d records, got %d: %+v", len(want), len(records), records)
+	}
+	for i, w := range want {
+		r := records[i]
+		if r.Operation != w.op || r.User != w.user || r.Result != w.result {
+			t.Errorf("Record %d: expected %s by %s with %s, got: %+v", i, w.op, w.user, w.result, r)
+		}
+	}
+	if r := records[0]; r.Path != "/private.txt" || r.Mode != "read" || r.Reason == "" || r.Session != bob.ID {
+		t.Errorf("Expected the denial with its path, mode and reason, got: %+v", r)
+	}
+	if r := records[2]; r.Bytes != 10 || r.Path != "/private.txt" || r.Session != alice.ID {
+		t.Errorf("Expected the truncate to record its length, path and session, got: %+v", r)
+	}
+	if r := records[6]; r.Path != "bob" || r.Reason == "" {
+		t.Errorf("Expected the quota denial with its target and reason, got: %+v", r)
+	}
+
+	// The synthetic file is read-only and only privileged sessions see it
+	if _, err := service.Open(ctx, &pb.OpenRequest{Path: "/.audit", Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: alice.ID}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for an unprivileged session, got: %v", err)
+	}
+	if _, err := service.Open(ctx, &pb.OpenRequest{Path: "/.audit", Mode: pb.OpenMode_OPEN_MODE_WRITE, SessionId: root.ID}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied writing the audit log, got: %v", err)
+	}
+	logFile, err := service.Open(ctx, &pb.OpenRequest{Path: "/.audit", Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: root.ID})
+	if err != nil {
+		t.Fatalf("Failed to open the audit log: %v", err)
+	}
+	handle, err := root.FDTable.Get(logFile.Fd)
+	if err != nil {
+		t.Fatalf("Failed to get handle: %v", err)
+	}
+	content, _ := storage.Snapshot(handle.Data)
+	if lines := bytes.Count(content.Bytes(), []byte("\n")); lines < len(want)+2 {
+		t.Errorf("Expected the snapshot to hold the log so far, got %d lines", lines)
+	}
+	if storage.Exists("/.audit") {
+		t.Errorf("Expected the audit log to stay out of the namespace")
+	}
+}
+
+func TestAudit_Rotation(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := OpenAuditLog(logPath, 300, 2)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+
+	session := &Session{ID: "s", User: "alice"}
+	for range 20 {
+		auditLog.Record(newAuditRecord(session, "open", "/a.txt", pb.OpenMode_OPEN_MODE_READ, 0, nil))
+	}
+
+	for _, name := range []string{logPath, logPath + ".1", logPath + ".2"} {
+		stat, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Expected %s to exist: %v", name, err)
+		}
+		if stat.Size() > 300 {
+			t.Errorf("Expected %s to stay within the size limit, got %d bytes", name, stat.Size())
+		}
+	}
+	if _, err := os.Stat(logPath + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 rotated files to be kept")
+	}
+
+	// A nil log discards records
+	var disabled *AuditLog
+	disabled.Record(newAuditRecord(session, "open", "/a.txt", pb.OpenMode_OPEN_MODE_READ, 0, nil))
+}
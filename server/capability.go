@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"github.com/google/uuid"
+)
+
+// Capability is the signed content of a capability token
+type Capability struct {
+	ID           string               `json:"id"`
+	Issuer       string               `json:"iss"`            // User who minted the original capability
+	IssuerGroup  string               `json:"grp"`            // Group for files created through it
+	IssuerGroups []string             `json:"grps,omitempty"` // Groups the issuer held when minting
+	Path         string               `json:"path"`
+	Subtree      bool                 `json:"sub,omitempty"`
+	Rights       []pb.CapabilityRight `json:"rights"`
+	ExpiresAt    time.Time            `json:"exp"`
+	MaxUses      int64                `json:"uses,omitempty"`
+	Chain        []string             `json:"chain,omitempty"` // IDs of the capabilities it was attenuated from
+}
+
+// Covers reports whether filePath is within the capability's scope
+func (c *Capability) Covers(filePath string) bool {
+	if filePath == c.Path {
+		return true
+	}
+	return c.Subtree && (c.Path == "/" || strings.HasPrefix(filePath, c.Path+"/"))
+}
+
+// Grants reports whether the capability includes right
+func (c *Capability) Grants(right pb.CapabilityRight) bool {
+	return slices.Contains(c.Rights, right)
+}
+
+// Attenuate returns a capability derived from c that may only narrow it:
+// its scope must lie within c's, its rights must be a subset and it
+// expires no later than c
+func (c *Capability) Attenuate(filePath string, subtree bool, rights []pb.CapabilityRight, expiresAt time.Time, maxUses int64) (*Capability, error) {
+	if !c.Covers(filePath) || (subtree && !c.Subtree) {
+		return nil, fmt.Errorf("%s is outside the capability's scope", filePath)
+	}
+	for _, right := range rights {
+		if !c.Grants(right) {
+			return nil, fmt.Errorf("capability does not grant %v", right)
+		}
+	}
+
+	return &Capability{
+		ID:           uuid.New().String(),
+		Issuer:       c.Issuer,
+		IssuerGroup:  c.IssuerGroup,
+		IssuerGroups: c.IssuerGroups,
+		Path:         filePath,
+		Subtree:      subtree,
+		Rights:       rights,
+		ExpiresAt:    minTime(expiresAt, c.ExpiresAt),
+		MaxUses:      maxUses,
+		Chain:        append(slices.Clip(c.Chain), c.ID),
+	}, nil
+}
+
+// capabilityRecord is the server-side state of a capability: how often it
+// has been used and whether it was revoked
+type capabilityRecord struct {
+	issuer    string
+	uses      int64
+	maxUses   int64
+	revoked   bool
+	expiresAt time.Time
+}
+
+// CapabilityManager signs and verifies capability tokens and tracks their
+// use counts and revocations. Tokens are self-contained, so they stay
+// valid across restarts if the signing key is configured; use counts and
+// revocations are kept in memory only, and a revoked token verifies again
+// after a restart unless the key is changed.
+type CapabilityManager struct {
+	key     []byte
+	mu      sync.Mutex
+	records map[string]*capabilityRecord
+}
+
+// NewCapabilityManager creates a capability manager signing with key, or
+// with a random key if key is empty
+func NewCapabilityManager(key []byte) *CapabilityManager {
+	if len(key) == 0 {
+		key = make([]byte, sha256.Size)
+		rand.Read(key)
+	}
+	return &CapabilityManager{
+		key:     key,
+		records: make(map[string]*capabilityRecord),
+	}
+}
+
+// Sign returns the token for c: its JSON encoding and an HMAC-SHA256 of
+// it, each base64url encoded and joined by a dot
+func (m *CapabilityManager) Sign(c *Capability) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	m.record(c)
+	m.mu.Unlock()
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(m.mac(payload)), nil
+}
+
+// Verify checks a token's signature and expiry and that neither it nor
+// any capability it was attenuated from has been revoked
+func (m *CapabilityManager) Verify(token string) (*Capability, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("malformed capability")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("malformed capability")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, m.mac(payload)) {
+		return nil, fmt.Errorf("invalid capability signature")
+	}
+
+	var c Capability
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, fmt.Errorf("malformed capability: %v", err)
+	}
+	if !time.Now().Before(c.ExpiresAt) {
+		return nil, fmt.Errorf("capability expired: %s", c.ID)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range append(slices.Clip(c.Chain), c.ID) {
+		if record, exists := m.records[id]; exists && record.revoked {
+			return nil, fmt.Errorf("capability revoked: %s", id)
+		}
+	}
+
+	return &c, nil
+}
+
+// Use counts one use of c. Uses of an attenuated capability also count
+// against the capabilities it was derived from, so minting from a
+// capability cannot stretch its use limit.
+func (m *CapabilityManager) Use(c *Capability) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !time.Now().Before(c.ExpiresAt) {
+		return fmt.Errorf("capability expired: %s", c.ID)
+	}
+
+	records := []*capabilityRecord{m.record(c)}
+	for _, id := range c.Chain {
+		if ancestor, exists := m.records[id]; exists {
+			records = append(records, ancestor)
+		}
+	}
+
+	for _, record := range records {
+		if record.revoked {
+			return fmt.Errorf("capability revoked: %s", c.ID)
+		}
+		if record.maxUses > 0 && record.uses >= record.maxUses {
+			return fmt.Errorf("capability used up: %s", c.ID)
+		}
+	}
+	for _, record := range records {
+		record.uses++
+	}
+
+	return nil
+}
+
+// Issuer returns the user who minted the capability with the given ID
+func (m *CapabilityManager) Issuer(id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, exists := m.records[id]
+	if !exists {
+		return "", fmt.Errorf("no such capability: %s", id)
+	}
+	return record.issuer, nil
+}
+
+// Revoke revokes the capability with the given ID and, through their
+// chains, every capability minted from it
+func (m *CapabilityManager) Revoke(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, exists := m.records[id]
+	if !exists {
+		return fmt.Errorf("no such capability: %s", id)
+	}
+
+	record.revoked = true
+	return nil
+}
+
+// Collect drops the records of capabilities that expired before now and
+// returns how many were dropped. Their tokens no longer verify anyway.
+func (m *CapabilityManager) Collect(now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := 0
+	for id, record := range m.records {
+		if !now.Before(record.expiresAt) {
+			delete(m.records, id)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// CollectEvery runs Collect periodically until stop is closed
+func (m *CapabilityManager) CollectEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			m.Collect(now)
+		}
+	}
+}
+
+// record returns the record for c, creating it if needed, for example for
+// a token signed before a restart. The caller must hold m.mu.
+func (m *CapabilityManager) record(c *Capability) *capabilityRecord {
+	record, exists := m.records[c.ID]
+	if !exists {
+		record = &capabilityRecord{issuer: c.Issuer, maxUses: c.MaxUses, expiresAt: c.ExpiresAt}
+		m.records[c.ID] = record
+	}
+	return record
+}
+
+// mac returns the HMAC-SHA256 of payload under the signing key
+func (m *CapabilityManager) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, m.key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// minTime returns the earlier of a and b, ignoring a zero a
+func minTime(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// capabilityRightName returns the short name of a right for messages
+func capabilityRightName(right pb.CapabilityRight) string {
+	return strings.ToLower(strings.TrimPrefix(right.String(), "CAPABILITY_RIGHT_"))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"path"
+	"slices"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// mintModes is the access the session's identity needs on a path to mint
+// each right from it
+var mintModes = map[pb.CapabilityRight]pb.OpenMode{
+	pb.CapabilityRight_CAPABILITY_RIGHT_READ:   pb.OpenMode_OPEN_MODE_READ,
+	pb.CapabilityRight_CAPABILITY_RIGHT_WRITE:  pb.OpenMode_OPEN_MODE_WRITE,
+	pb.CapabilityRight_CAPABILITY_RIGHT_LIST:   pb.OpenMode_OPEN_MODE_READ,
+	pb.CapabilityRight_CAPABILITY_RIGHT_CREATE: pb.OpenMode_OPEN_MODE_WRITE,
+}
+
+// Mint creates a capability, either from the session's identity or by
+// attenuating a capability the caller holds
+func (s *Plan92ServiceImpl) Mint(
+	ctx context.Context,
+	req *pb.MintRequest,
+) (*pb.MintResponse, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	resp, err := s.mint(session, req)
+	s.audit(session, "mint", path.Clean(req.Path), pb.OpenMode_OPEN_MODE_UNSPECIFIED, 0, err)
+	return resp, err
+}
+
+// mint creates the capability of a Mint request for session
+func (s *Plan92ServiceImpl) mint(session *Session, req *pb.MintRequest) (*pb.MintResponse, error) {
+	var err error
+	if len(req.Rights) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "a capability needs at least one right")
+	}
+	rights := slices.Compact(slices.Sorted(slices.Values(req.Rights)))
+	for _, right := range rights {
+		if _, known := mintModes[right]; !known {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid right: %v", right)
+		}
+	}
+	if req.MaxUses < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "max_uses must not be negative")
+	}
+
+	filePath := path.Clean(req.Path)
+	if !path.IsAbs(filePath) {
+		return nil, status.Errorf(codes.InvalidArgument, "path must be absolute: %s", req.Path)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(s.config.CapabilityTTL)
+	if req.ExpiresAt != nil {
+		requested := req.ExpiresAt.AsTime()
+		if !requested.After(now) {
+			return nil, status.Errorf(codes.InvalidArgument, "expires_at must be in the future")
+		}
+		expiresAt = minTime(requested, expiresAt)
+	}
+
+	capabilities := s.inodeService.capabilities
+	parent := session.Capability
+	if req.Capability != "" {
+		if parent, err = capabilities.Verify(req.Capability); err != nil {
+			return nil, status.Errorf(codes.PermissionDenied, "%v", err)
+		}
+	}
+
+	var capability *Capability
+	if parent != nil {
+		capability, err = parent.Attenuate(filePath, req.Subtree, rights, expiresAt, req.MaxUses)
+		if err != nil {
+			return nil, status.Errorf(codes.PermissionDenied, "%v", err)
+		}
+	} else {
+		// The identity must hold every right it delegates. Within a
+		// subtree this is checked again on each use.
+		for _, right := range rights {
+			if err := s.authorize(session, filePath, mintModes[right]); err != nil {
+				return nil, err
+			}
+		}
+
+		owner, group := session.Creator()
+		capability = &Capability{
+			ID:           uuid.New().String(),
+			Issuer:       owner,
+			IssuerGroup:  group,
+			IssuerGroups: slices.Clone(session.Groups),
+			Path:         filePath,
+			Subtree:      req.Subtree,
+			Rights:       rights,
+			ExpiresAt:    expiresAt,
+			MaxUses:      req.MaxUses,
+		}
+	}
+
+	token, err := capabilities.Sign(capability)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to sign capability: %v", err)
+	}
+
+	return &pb.MintResponse{
+		Token:     token,
+		Id:        capability.ID,
+		ExpiresAt: timestamppb.New(capability.ExpiresAt),
+	}, nil
+}
+
+// Revoke revokes a capability and every capability attenuated from it. The
+// audit record names the capability by its ID in place of a path.
+func (s *Plan92ServiceImpl) Revoke(
+	ctx context.Context,
+	req *pb.RevokeRequest,
+) (*emptypb.Empty, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	err = s.revoke(session, req.Id)
+	s.audit(session, "revoke", req.Id, pb.OpenMode_OPEN_MODE_UNSPECIFIED, 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// revoke revokes the capability with the given ID for session, which must
+// be its issuer or privileged
+func (s *Plan92ServiceImpl) revoke(session *Session, id string) error {
+	capabilities := s.inodeService.capabilities
+	issuer, err := capabilities.Issuer(id)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "%v", err)
+	}
+	if session.Capability != nil || (session.User != issuer && !s.privileged(session)) {
+		return status.Errorf(codes.PermissionDenied, "only %s may revoke capability %s", issuer, id)
+	}
+
+	if err := capabilities.Revoke(id); err != nil {
+		return status.Errorf(codes.NotFound, "%v", err)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCapability_SignAttenuateAndUse(t *testing.T) {
+	m := NewCapabilityManager([]byte("test key"))
+	root := &Capability{
+		ID:        "root",
+		Issuer:    "alice",
+		Path:      "/data",
+		Subtree:   true,
+		Rights:    []pb.CapabilityRight{pb.CapabilityRight_CAPABILITY_RIGHT_READ},
+		ExpiresAt: time.Now().Add(time.Hour),
+		MaxUses:   2,
+	}
+	token, err := m.Sign(root)
+	if err != nil {
+		t.Fatalf("Failed to sign capability: %v", err)
+	}
+
+	// Tokens cannot be altered or signed with another key
+	payload, sig, _ := strings.Cut(token, ".")
+	if _, err := m.Verify(payload[:len(payload)-2] + "xx." + sig); err == nil {
+		t.Errorf("Expected a tampered token to be rejected")
+	}
+	if _, err := NewCapabilityManager([]byte("other key")).Verify(token); err == nil {
+		t.Errorf("Expected a token signed with another key to be rejected")
+	}
+	verified, err := m.Verify(token)
+	if err != nil {
+		t.Fatalf("Failed to verify capability: %v", err)
+	}
+
+	// Attenuation may only narrow
+	if _, err := verified.Attenuate("/other", false, verified.Rights, time.Time{}, 0); err == nil {
+		t.Errorf("Expected attenuation outside the scope to fail")
+	}
+	if _, err := verified.Attenuate("/data/a", false, []pb.CapabilityRight{pb.CapabilityRight_CAPABILITY_RIGHT_WRITE}, time.Time{}, 0); err == nil {
+		t.Errorf("Expected attenuation adding a right to fail")
+	}
+	child, err := verified.Attenuate("/data/a", false, verified.Rights, time.Now().Add(48*time.Hour), 0)
+	if err != nil {
+		t.Fatalf("Failed to attenuate: %v", err)
+	}
+	if !child.ExpiresAt.Equal(root.ExpiresAt) {
+		t.Errorf("Expected the child to expire with its parent")
+	}
+	if _, err := m.Sign(child); err != nil {
+		t.Fatalf("Failed to sign child: %v", err)
+	}
+
+	// Uses of the child count against the parent's limit
+	for range 2 {
+		if err := m.Use(child); err != nil {
+			t.Fatalf("Failed to use child: %v", err)
+		}
+	}
+	if err := m.Use(verified); err == nil {
+		t.Errorf("Expected the parent to be used up by its child")
+	}
+
+	// Revoking the parent revokes the child
+	if err := m.Revoke("root"); err != nil {
+		t.Fatalf("Failed to revoke: %v", err)
+	}
+	childToken, _ := m.Sign(child)
+	if _, err := m.Verify(childToken); err == nil {
+		t.Errorf("Expected a child of a revoked capability to be rejected")
+	}
+}
+
+func TestCapability_DelegatedAccess(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	if err := storage.Create("/data", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+		Mode:  0700,
+		Owner: "alice",
+		Group: "users",
+	}); err != nil {
+		t.Fatalf("Failed to create /data: %v", err)
+	}
+
+	alice, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice", Groups: []string{"users"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	bob, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "bob", Groups: []string{"others"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if err := writeTestFile(ctx, client, alice.SessionId, "/data/a.txt", "secret"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// Without access of its own, bob's session can neither mint nor read
+	mintReq := &pb.MintRequest{
+		Path:    "/data",
+		Subtree: true,
+		Rights: []pb.CapabilityRight{
+			pb.CapabilityRight_CAPABILITY_RIGHT_READ,
+			pb.CapabilityRight_CAPABILITY_RIGHT_CREATE,
+		},
+	}
+	mintReq.SessionId = bob.SessionId
+	if _, err := client.Mint(ctx, mintReq); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied minting without access, got: %v", err)
+	}
+	open := func(sessionID, capability, path string, mode pb.OpenMode) error {
+		_, err := client.Open(ctx, &pb.OpenRequest{Path: path, Mode: mode, SessionId: sessionID, Capability: capability})
+		return err
+	}
+	if err := open(bob.SessionId, "", "/data/a.txt", pb.OpenMode_OPEN_MODE_READ); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied without a capability, got: %v", err)
+	}
+
+	mintReq.SessionId = alice.SessionId
+	minted, err := client.Mint(ctx, mintReq)
+	if err != nil {
+		t.Fatalf("Failed to mint capability: %v", err)
+	}
+
+	// Presented with an Open, the capability replaces bob's identity
+	if err := open(bob.SessionId, minted.Token, "/data/a.txt", pb.OpenMode_OPEN_MODE_READ); err != nil {
+		t.Errorf("Expected bob to read through the capability, got: %v", err)
+	}
+	if err := open(bob.SessionId, minted.Token, "/data/a.txt", pb.OpenMode_OPEN_MODE_RDWR); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied writing without the write right, got: %v", err)
+	}
+
+	// A session created from the capability has no identity at all
+	capSession, err := client.CreateSession(ctx, &pb.CreateSessionRequest{Capability: minted.Token})
+	if err != nil {
+		t.Fatalf("Failed to create capability session: %v", err)
+	}
+	if got, err := catFile(ctx, client, capSession.SessionId, "/data/a.txt"); err != nil || got != "secret" {
+		t.Errorf("Expected to read through a capability session, got: %q (%v)", got, err)
+	}
+	if err := writeTestFile(ctx, client, capSession.SessionId, "/data/b.txt", "new"); err != nil {
+		t.Fatalf("Failed to create through a capability session: %v", err)
+	}
+	if info, err := storage.GetInfo("/data/b.txt"); err != nil || info.Owner != "alice" {
+		t.Errorf("Expected files created through a capability to belong to its issuer, got: %v (%v)", info, err)
+	}
+
+	// Removing needs WRITE on the parent, within the capability's scope,
+	// and ACLs are left to owners
+	if err := storage.Create("/pub", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+		Mode:  0777,
+		Owner: "root",
+	}); err != nil {
+		t.Fatalf("Failed to create /pub: %v", err)
+	}
+	if err := writeTestFile(ctx, client, bob.SessionId, "/pub/x.txt", "x"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	remove := func(sessionID, path string) error {
+		_, err := client.Remove(ctx, &pb.RemoveRequest{Path: path, SessionId: sessionID})
+		return err
+	}
+	if err := remove(capSession.SessionId, "/data/b.txt"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied removing without the write right, got: %v", err)
+	}
+	if _, err := client.SetAcl(ctx, &pb.SetAclRequest{SessionId: capSession.SessionId, Path: "/data/a.txt"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied setting an ACL through a capability, got: %v", err)
+	}
+	writer, err := client.Mint(ctx, &pb.MintRequest{
+		SessionId: alice.SessionId,
+		Path:      "/data",
+		Subtree:   true,
+		Rights:    []pb.CapabilityRight{pb.CapabilityRight_CAPABILITY_RIGHT_WRITE},
+	})
+	if err != nil {
+		t.Fatalf("Failed to mint capability: %v", err)
+	}
+	writerSession, err := client.CreateSession(ctx, &pb.CreateSessionRequest{Capability: writer.Token})
+	if err != nil {
+		t.Fatalf("Failed to create capability session: %v", err)
+	}
+	if err := remove(writerSession.SessionId, "/pub/x.txt"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied removing outside the capability, got: %v", err)
+	}
+	if err := remove(writerSession.SessionId, "/data/b.txt"); err != nil {
+		t.Errorf("Expected removal with the write right on the parent, got: %v", err)
+	}
+
+	// The capability session can attenuate, with a single use
+	narrow, err := client.Mint(ctx, &pb.MintRequest{
+		SessionId: capSession.SessionId,
+		Path:      "/data/a.txt",
+		Rights:    []pb.CapabilityRight{pb.CapabilityRight_CAPABILITY_RIGHT_READ},
+		MaxUses:   1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to attenuate capability: %v", err)
+	}
+	if err := open(bob.SessionId, narrow.Token, "/data/a.txt", pb.OpenMode_OPEN_MODE_READ); err != nil {
+		t.Errorf("Expected the narrow capability to work once, got: %v", err)
+	}
+	if err := open(bob.SessionId, narrow.Token, "/data/a.txt", pb.OpenMode_OPEN_MODE_READ); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied after the last use, got: %v", err)
+	}
+	if _, err := client.Mint(ctx, &pb.MintRequest{
+		SessionId: capSession.SessionId,
+		Path:      "/",
+		Rights:    []pb.CapabilityRight{pb.CapabilityRight_CAPABILITY_RIGHT_READ},
+	}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied widening a capability, got: %v", err)
+	}
+
+	// Only the issuer revokes; revocation reaches sessions created from it
+	if _, err := client.Revoke(ctx, &pb.RevokeRequest{SessionId: bob.SessionId, Id: minted.Id}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied revoking another user's capability, got: %v", err)
+	}
+	if _, err := client.Revoke(ctx, &pb.RevokeRequest{SessionId: alice.SessionId, Id: minted.Id}); err != nil {
+		t.Fatalf("Failed to revoke capability: %v", err)
+	}
+	if err := open(capSession.SessionId, "", "/data/a.txt", pb.OpenMode_OPEN_MODE_READ); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied after revocation, got: %v", err)
+	}
+	if _, err := client.CreateSession(ctx, &pb.CreateSessionRequest{Capability: minted.Token}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated creating a session from a revoked capability, got: %v", err)
+	}
+}
+
+func TestCapability_LimitedToIssuer(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	// alice's directory holds a file only carol may read and one alice
+	// reads through a secondary group
+	files := map[string]*pb.FileInfo{
+		"/shared":           {Type: pb.FileType_FILE_TYPE_DIRECTORY, Mode: 0777, Owner: "alice", Group: "users"},
+		"/shared/carol.txt": {Type: pb.FileType_FILE_TYPE_REGULAR, Mode: 0600, Owner: "carol", Group: "users"},
+		"/shared/staff.txt": {Type: pb.FileType_FILE_TYPE_REGULAR, Mode: 0640, Owner: "carol", Group: "staff"},
+	}
+	for _, p := range []string{"/shared", "/shared/carol.txt", "/shared/staff.txt"} {
+		if err := storage.Create(p, files[p]); err != nil {
+			t.Fatalf("Failed to create %s: %v", p, err)
+		}
+	}
+
+	alice, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice", Groups: []string{"users", "staff"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	bob, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "bob", Groups: []string{"others"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	read := []pb.CapabilityRight{pb.CapabilityRight_CAPABILITY_RIGHT_READ}
+	if _, err := client.Mint(ctx, &pb.MintRequest{SessionId: alice.SessionId, Path: "/shared/carol.txt", Rights: read}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied minting over carol's private file, got: %v", err)
+	}
+
+	// A subtree capability does not reach files its issuer cannot read
+	minted, err := client.Mint(ctx, &pb.MintRequest{SessionId: alice.SessionId, Path: "/shared", Subtree: true, Rights: read})
+	if err != nil {
+		t.Fatalf("Failed to mint capability: %v", err)
+	}
+	open := func(path string) error {
+		_, err := client.Open(ctx, &pb.OpenRequest{Path: path, Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: bob.SessionId, Capability: minted.Token})
+		return err
+	}
+	if err := open("/shared/carol.txt"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied reading carol's file through alice's capability, got: %v", err)
+	}
+	if err := open("/shared/staff.txt"); err != nil {
+		t.Errorf("Expected the issuer's groups at minting to apply, got: %v", err)
+	}
+
+	// Access the issuer loses after minting is lost to the capability too
+	data, _ := storage.Get("/shared/staff.txt")
+	if _, err := storage.UpdateInfo(data, func(info *pb.FileInfo) error {
+		info.Mode = 0600
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to change mode: %v", err)
+	}
+	if err := open("/shared/staff.txt"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied once the issuer lost access, got: %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash/crc32"
+	"io"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// writeWithChecksum writes content to path, declaring expected as its sha256
+func writeWithChecksum(ctx context.Context, client pb.Plan92Client, sessionID, path string, content, expected []byte) (*pb.WriteResponse, error) {
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      path,
+		Mode:      pb.OpenMode_OPEN_MODE_WRITE,
+		SessionId: sessionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = client.Close(ctx, &pb.CloseRequest{Fd: openResp.Fd, SessionId: openResp.SessionId})
+	}()
+
+	writeStream, err := client.Write(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeStream.Send(&pb.WriteRequest{
+		Data: &pb.WriteRequest_Metadata{
+			Metadata: &pb.WriteMetadata{Fd: openResp.Fd, SessionId: openResp.SessionId, Offset: -1, ExpectedSha256: expected},
+		},
+	}); err != nil {
+		return nil, err
+	}
+	for pos := 0; pos < len(content); pos += chunkSize {
+		if err := writeStream.Send(&pb.WriteRequest{
+			Data: &pb.WriteRequest_Chunk{Chunk: content[pos:min(pos+chunkSize, len(content))]},
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return writeStream.CloseAndRecv()
+}
+
+func TestChecksum_WriteVerifiesAndReadReports(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	sessionID := sessionResp.SessionId
+
+	content := bytes.Repeat([]byte("integrity "), 10000)
+	sum := sha256.Sum256(content)
+
+	resp, err := writeWithChecksum(ctx, client, sessionID, "/verified.txt", content, sum[:])
+	if err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if resp.ErrorCode != pb.FSErrorCode_FS_ERROR_CODE_UNSPECIFIED || resp.BytesWritten != int64(len(content)) {
+		t.Fatalf("Expected verified write to succeed, got: %d bytes, %v %q", resp.BytesWritten, resp.ErrorCode, resp.Error)
+	}
+
+	// A corrupted upload must fail and leave the file untouched
+	corrupted := bytes.Clone(content)
+	corrupted[len(corrupted)/2] ^= 0xff
+	resp, err = writeWithChecksum(ctx, client, sessionID, "/verified.txt", corrupted, sum[:])
+	if err != nil {
+		t.Fatalf("Expected mismatch in response, got error: %v", err)
+	}
+	if resp.ErrorCode != pb.FSErrorCode_FS_ERROR_CODE_IO_ERROR || resp.BytesWritten != 0 {
+		t.Errorf("Expected IO_ERROR with nothing written, got: %d bytes, %v", resp.BytesWritten, resp.ErrorCode)
+	}
+
+	// Checksums are only computed on request
+	statResp, err := client.Stat(ctx, &pb.StatRequest{Path: "/verified.txt", SessionId: sessionID})
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if len(statResp.Info.Sha256) != 0 {
+		t.Errorf("Expected no checksums unless requested, got sha256 %x", statResp.Info.Sha256)
+	}
+	statResp, err = client.Stat(ctx, &pb.StatRequest{Path: "/verified.txt", SessionId: sessionID, Checksums: true})
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if !bytes.Equal(statResp.Info.Sha256, sum[:]) {
+		t.Errorf("Stat sha256 mismatch. Expected: %x, Got: %x", sum, statResp.Info.Sha256)
+	}
+	if want := crc32.Checksum(content, crc32cTable); statResp.Info.Crc32C != want {
+		t.Errorf("Stat crc32c mismatch. Expected: %08x, Got: %08x", want, statResp.Info.Crc32C)
+	}
+
+	// Every chunk carries its own checksum and the metadata carries the
+	// digest of the version being streamed
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      "/verified.txt",
+		Mode:      pb.OpenMode_OPEN_MODE_READ,
+		SessionId: sessionID,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	readStream, err := client.Read(ctx, &pb.ReadRequest{Fd: openResp.Fd, SessionId: openResp.SessionId, Offset: 0, Count: -1, Checksums: true})
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+
+	h := sha256.New()
+	var metadataSum []byte
+	for {
+		resp, err := readStream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to receive: %v", err)
+		}
+		if metadata := resp.GetMetadata(); metadata != nil {
+			metadataSum = metadata.FileInfo.Sha256
+			continue
+		}
+		if crc32.Checksum(resp.GetChunk(), crc32cTable) != resp.ChunkCrc32C {
+			t.Fatalf("Chunk checksum mismatch")
+		}
+		h.Write(resp.GetChunk())
+	}
+
+	if !bytes.Equal(metadataSum, sum[:]) || !bytes.Equal(h.Sum(nil), sum[:]) {
+		t.Errorf("Read digest mismatch. Expected: %x, Metadata: %x, Streamed: %x", sum, metadataSum, h.Sum(nil))
+	}
+}
+
+func TestChecksum_SkippedForRangedReads(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "testuser"})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if err := writeTestFile(ctx, client, sessionResp.SessionId, "/ranged.txt", "0123456789"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	openResp, err := client.Open(ctx, &pb.OpenRequest{Path: "/ranged.txt", Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: sessionResp.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+
+	for _, req := range []*pb.ReadRequest{
+		{Offset: 2, Count: 3},
+		{Ranges: []*pb.ReadRange{{Offset: 0, Count: 4}, {Offset: -2}}},
+	} {
+		req.Fd, req.SessionId, req.Checksums = openResp.Fd, openResp.SessionId, true
+		stream, err := client.Read(ctx, req)
+		if err != nil {
+			t.Fatalf("Failed to read file: %v", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive metadata: %v", err)
+		}
+		if sum := resp.GetMetadata().GetFileInfo().GetSha256(); len(sum) != 0 {
+			t.Errorf("Expected no checksums for a partial read, got sha256 %x", sum)
+		}
+	}
+}
+
+func TestChecksum_StatNeedsReadPermission(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	if err := storage.Create("/private.txt", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_REGULAR,
+		Mode:  0600,
+		Owner: "alice",
+	}); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "bob"})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	// Plain metadata stays visible; checksums of unreadable content do not
+	if _, err := client.Stat(ctx, &pb.StatRequest{Path: "/private.txt", SessionId: sessionResp.SessionId}); err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	_, err = client.Stat(ctx, &pb.StatRequest{Path: "/private.txt", SessionId: sessionResp.SessionId, Checksums: true})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for checksums without read permission, got: %v", err)
+	}
+}
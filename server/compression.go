@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// maxFrameSize bounds the decoded size of one compressed write chunk.
+	// It matches gRPC's default message limit, so compressed and plain
+	// writes accept chunks of the same size.
+	maxFrameSize = 4 * 1024 * 1024
+)
+
+// defaultNoCompressExtensions lists file types whose content is already
+// compressed, so compressing them again only costs CPU
+var defaultNoCompressExtensions = []string{
+	".gz", ".tgz", ".zst", ".bz2", ".xz", ".zip", ".7z",
+	".jpg", ".jpeg", ".png", ".gif", ".webp",
+	".mp3", ".mp4", ".mkv", ".webm",
+	".parquet",
+}
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil)
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxFrameSize))
+		return dec
+	})
+)
+
+// ParseExtensions parses a comma-separated list of file extensions such
+// as "gz,.zip" into the normalized form used by the compression policy
+func ParseExtensions(list string) []string {
+	var exts []string
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts = append(exts, ext)
+	}
+	return exts
+}
+
+// readCompression picks the compression for a read of filePath: the
+// requested one, unless the file type is configured as incompressible
+func (s *Plan92ServiceImpl) readCompression(requested pb.Compression, filePath string) (pb.Compression, error) {
+	if err := checkCompression(requested); err != nil {
+		return 0, err
+	}
+
+	ext := strings.ToLower(path.Ext(filePath))
+	for _, skip := range s.config.NoCompressExtensions {
+		if ext == skip {
+			return pb.Compression_COMPRESSION_UNSPECIFIED, nil
+		}
+	}
+	return requested, nil
+}
+
+// checkCompression rejects compression values this server does not know
+func checkCompression(c pb.Compression) error {
+	switch c {
+	case pb.Compression_COMPRESSION_UNSPECIFIED, pb.Compression_COMPRESSION_GZIP, pb.Compression_COMPRESSION_ZSTD:
+		return nil
+	default:
+		return fmt.Errorf("unsupported compression: %v", c)
+	}
+}
+
+// compressChunk encodes p as one self-contained frame
+func compressChunk(c pb.Compression, p []byte) []byte {
+	switch c {
+	case pb.Compression_COMPRESSION_GZIP:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(p)
+		zw.Close()
+		return buf.Bytes()
+	case pb.Compression_COMPRESSION_ZSTD:
+		return zstdEncoder().EncodeAll(p, nil)
+	default:
+		return p
+	}
+}
+
+// decompressChunk decodes one frame, refusing frames that decode to more
+// than maxFrameSize bytes
+func decompressChunk(c pb.Compression, p []byte) ([]byte, error) {
+	var out []byte
+	switch c {
+	case pb.Compression_COMPRESSION_GZIP:
+		zr, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		if out, err = io.ReadAll(io.LimitReader(zr, maxFrameSize+1)); err != nil {
+			return nil, err
+		}
+	case pb.Compression_COMPRESSION_ZSTD:
+		var err error
+		if out, err = zstdDecoder().DecodeAll(p, nil); err != nil {
+			return nil, err
+		}
+	default:
+		return p, nil
+	}
+
+	if len(out) > maxFrameSize {
+		return nil, fmt.Errorf("frame decodes to more than %d bytes", maxFrameSize)
+	}
+	return out, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+)
+
+func TestCompression_RoundTrip(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	sessionID := sessionResp.SessionId
+
+	content := []byte(strings.Repeat("ts=2024-01-01 level=info msg=\"request served\"\n", 2000))
+
+	for _, tt := range []struct {
+		compression pb.Compression
+		path        string
+		applied     pb.Compression
+	}{
+		{pb.Compression_COMPRESSION_GZIP, "/app.log", pb.Compression_COMPRESSION_GZIP},
+		{pb.Compression_COMPRESSION_ZSTD, "/app.csv", pb.Compression_COMPRESSION_ZSTD},
+		{pb.Compression_COMPRESSION_ZSTD, "/app.log.gz", pb.Compression_COMPRESSION_UNSPECIFIED},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			// Upload one compressed frame per chunk
+			openResp, err := client.Open(ctx, &pb.OpenRequest{
+				Path:      tt.path,
+				Mode:      pb.OpenMode_OPEN_MODE_WRITE,
+				SessionId: sessionID,
+			})
+			if err != nil {
+				t.Fatalf("Failed to open file: %v", err)
+			}
+			writeStream, err := client.Write(ctx)
+			if err != nil {
+				t.Fatalf("Failed to create write stream: %v", err)
+			}
+			if err := writeStream.Send(&pb.WriteRequest{
+				Data: &pb.WriteRequest_Metadata{Metadata: &pb.WriteMetadata{
+					Fd:          openResp.Fd,
+					Offset:      -1,
+					TotalSize:   int64(len(content)),
+					Compression: tt.compression,
+					SessionId:   openResp.SessionId,
+				}},
+			}); err != nil {
+				t.Fatalf("Failed to send metadata: %v", err)
+			}
+			for pos := 0; pos < len(content); pos += chunkSize {
+				frame := compressChunk(tt.compression, content[pos:min(pos+chunkSize, len(content))])
+				if err := writeStream.Send(&pb.WriteRequest{
+					Data: &pb.WriteRequest_Chunk{Chunk: frame},
+				}); err != nil {
+					t.Fatalf("Failed to send chunk: %v", err)
+				}
+			}
+			writeResp, err := writeStream.CloseAndRecv()
+			if err != nil || writeResp.ErrorCode != pb.FSErrorCode_FS_ERROR_CODE_UNSPECIFIED {
+				t.Fatalf("Write failed: %v %v", err, writeResp)
+			}
+
+			data, err := storage.Get(tt.path)
+			if err != nil {
+				t.Fatalf("Failed to get file: %v", err)
+			}
+			if !bytes.Equal(data.Content.Bytes(), content) {
+				t.Fatalf("Stored content does not match decoded upload")
+			}
+
+			// Read it back compressed, decoding chunk by chunk
+			openResp, err = client.Open(ctx, &pb.OpenRequest{
+				Path:      tt.path,
+				Mode:      pb.OpenMode_OPEN_MODE_READ,
+				SessionId: sessionID,
+			})
+			if err != nil {
+				t.Fatalf("Failed to open file: %v", err)
+			}
+			readStream, err := client.Read(ctx, &pb.ReadRequest{
+				Fd:          openResp.Fd,
+				Offset:      0,
+				Compression: tt.compression,
+				SessionId:   openResp.SessionId,
+			})
+			if err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+
+			var applied pb.Compression
+			var got []byte
+			var wire int
+			for {
+				resp, err := readStream.Recv()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Failed to receive: %v", err)
+				}
+				if m := resp.GetMetadata(); m != nil {
+					applied = m.Compression
+					continue
+				}
+				if resp.ChunkOffset != int64(len(got)) {
+					t.Errorf("Chunk offset mismatch. Expected: %d, Got: %d", len(got), resp.ChunkOffset)
+				}
+				chunk, err := decompressChunk(applied, resp.GetChunk())
+				if err != nil {
+					t.Fatalf("Failed to decompress chunk: %v", err)
+				}
+				got = append(got, chunk...)
+				wire += len(resp.GetChunk())
+			}
+
+			if applied != tt.applied {
+				t.Errorf("Compression mismatch. Expected: %v, Got: %v", tt.applied, applied)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("Decoded read does not match content")
+			}
+			if applied != pb.Compression_COMPRESSION_UNSPECIFIED && wire >= len(content)/4 {
+				t.Errorf("Expected compressible content to shrink, sent %d of %d bytes", wire, len(content))
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	// messageOverhead is the room left in a gRPC message for the fields
+	// that accompany a data chunk
+	messageOverhead = 1024
+)
+
+// Config holds server settings that can be tuned at startup
+type Config struct {
+	ChunkSize            int           // Read chunk size when the client does not request one
+	MinChunkSize         int           // Smallest chunk size a client may request
+	MaxChunkSize         int           // Largest chunk size a client may request
+	MaxMessageSize       int           // gRPC send and receive message limit
+	InitialWindowSize    int32         // Per-stream flow control window; 0 keeps gRPC's dynamic window
+	NoCompressExtensions []string      // File extensions never compressed on reads
+	UploadTTL            time.Duration // Idle time after which an upload is discarded
+	CapabilityKey        []byte        // Key capabilities are signed with; random if empty
+	CapabilityTTL        time.Duration // Default and longest lifetime of a capability
+	Superuser            string        // User that bypasses discretionary checks; "" for none
+	AdminGroup           string        // Group whose members do the same; "" for none
+	PolicyFile           string        // Authorization rules file, reloaded on change; "" for none
+	AuditLog             string        // JSON-lines audit log file; "" disables auditing
+	AuditMaxSize         int           // Size at which the audit log is rotated
+	AuditKeep            int           // Rotated audit log files kept
+	AuditPath            string        // Plan92 path privileged sessions read the audit log at; "" for none
+	MaxFileSize          int           // Largest file length in bytes; 0 is unlimited
+	StorageCapacity      int           // Bytes the whole filesystem may hold; 0 is unlimited
+	StorageInodes        int           // Inodes the whole filesystem may hold; 0 is unlimited
+	MaxSessionsPerUser   int           // Open sessions per user; 0 is unlimited
+	MaxFDsPerSession     int           // Open file descriptors per session; 0 is unlimited
+	MaxStreamsPerSession int           // Concurrent streaming RPCs per session; 0 is unlimited
+	SessionBytesPerSec   int           // Message bytes per second per session; 0 is unlimited
+}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		ChunkSize:            chunkSize,
+		MinChunkSize:         4 * 1024,
+		MaxChunkSize:         1024 * 1024,
+		MaxMessageSize:       4 * 1024 * 1024,
+		NoCompressExtensions: defaultNoCompressExtensions,
+		UploadTTL:            time.Hour,
+		CapabilityTTL:        24 * time.Hour,
+		AuditMaxSize:         64 * 1024 * 1024,
+		AuditKeep:            5,
+	}
+}
+
+// LoadConfig reads settings from the environment on top of the defaults
+func LoadConfig() (Config, error) {
+	cfg := DefaultConfig()
+
+	ints := []struct {
+		env   string
+		value *int
+	}{
+		{"CHUNK_SIZE", &cfg.ChunkSize},
+		{"MIN_CHUNK_SIZE", &cfg.MinChunkSize},
+		{"MAX_CHUNK_SIZE", &cfg.MaxChunkSize},
+		{"MAX_MESSAGE_SIZE", &cfg.MaxMessageSize},
+		{"AUDIT_MAX_SIZE", &cfg.AuditMaxSize},
+		{"AUDIT_KEEP", &cfg.AuditKeep},
+		{"MAX_FILE_SIZE", &cfg.MaxFileSize},
+		{"STORAGE_CAPACITY", &cfg.StorageCapacity},
+		{"STORAGE_INODES", &cfg.StorageInodes},
+		{"MAX_SESSIONS_PER_USER", &cfg.MaxSessionsPerUser},
+		{"MAX_FDS_PER_SESSION", &cfg.MaxFDsPerSession},
+		{"MAX_STREAMS_PER_SESSION", &cfg.MaxStreamsPerSession},
+		{"SESSION_BYTES_PER_SEC", &cfg.SessionBytesPerSec},
+	}
+	for _, setting := range ints {
+		if v, ok := os.LookupEnv(setting.env); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid %s: %v", setting.env, err)
+			}
+			*setting.value = n
+		}
+	}
+
+	if v, ok := os.LookupEnv("INITIAL_WINDOW_SIZE"); ok {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid INITIAL_WINDOW_SIZE: %v", err)
+		}
+		cfg.InitialWindowSize = int32(n)
+	}
+
+	if exts, ok := os.LookupEnv("NO_COMPRESS_EXTENSIONS"); ok {
+		cfg.NoCompressExtensions = ParseExtensions(exts)
+	}
+
+	if v, ok := os.LookupEnv("UPLOAD_TTL"); ok {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid UPLOAD_TTL: %v", err)
+		}
+		cfg.UploadTTL = ttl
+	}
+
+	if key, ok := os.LookupEnv("CAPABILITY_KEY"); ok {
+		cfg.CapabilityKey = []byte(key)
+	}
+
+	if v, ok := os.LookupEnv("CAPABILITY_TTL"); ok {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid CAPABILITY_TTL: %v", err)
+		}
+		cfg.CapabilityTTL = ttl
+	}
+
+	if user, ok := os.LookupEnv("SUPERUSER"); ok {
+		cfg.Superuser = user
+	}
+
+	if group, ok := os.LookupEnv("ADMIN_GROUP"); ok {
+		cfg.AdminGroup = group
+	}
+
+	cfg.PolicyFile = os.Getenv("POLICY_FILE")
+	cfg.AuditLog = os.Getenv("AUDIT_LOG")
+	cfg.AuditPath = os.Getenv("AUDIT_PATH")
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks that the chunk size bounds are consistent, that the
+// largest chunk fits in a gRPC message, that uploads and capabilities can
+// live at all and that the audit, file size, capacity and session limit
+// settings make sense
+func (c Config) Validate() error {
+	if c.MinChunkSize <= 0 || c.MinChunkSize > c.ChunkSize || c.ChunkSize > c.MaxChunkSize {
+		return fmt.Errorf("chunk sizes must satisfy 0 < min (%d) <= default (%d) <= max (%d)",
+			c.MinChunkSize, c.ChunkSize, c.MaxChunkSize)
+	}
+	if c.MaxChunkSize > c.MaxMessageSize-messageOverhead {
+		return fmt.Errorf("max chunk size %d does not fit in a %d byte message",
+			c.MaxChunkSize, c.MaxMessageSize)
+	}
+	if c.UploadTTL <= 0 {
+		return fmt.Errorf("upload TTL must be positive")
+	}
+	if c.CapabilityTTL <= 0 {
+		return fmt.Errorf("capability TTL must be positive")
+	}
+	if c.AuditMaxSize <= 0 || c.AuditKeep < 0 {
+		return fmt.Errorf("audit log size must be positive and the rotated files kept not negative")
+	}
+	if c.AuditPath != "" && (!path.IsAbs(c.AuditPath) || path.Clean(c.AuditPath) != c.AuditPath) {
+		return fmt.Errorf("audit path must be a clean absolute path: %s", c.AuditPath)
+	}
+	if c.MaxFileSize < 0 || c.StorageCapacity < 0 || c.StorageInodes < 0 {
+		return fmt.Errorf("max file size and storage capacity must not be negative")
+	}
+	if c.MaxSessionsPerUser < 0 || c.MaxFDsPerSession < 0 || c.MaxStreamsPerSession < 0 || c.SessionBytesPerSec < 0 {
+		return fmt.Errorf("session limits must not be negative")
+	}
+	return nil
+}
+
+// SessionLimits returns the per-user and per-session limits
+func (c Config) SessionLimits() SessionLimits {
+	return SessionLimits{
+		SessionsPerUser:   c.MaxSessionsPerUser,
+		FDsPerSession:     c.MaxFDsPerSession,
+		StreamsPerSession: c.MaxStreamsPerSession,
+		BytesPerSecond:    int64(c.SessionBytesPerSec),
+	}
+}
+
+// ServerOptions returns the gRPC options that apply the message and flow
+// control settings
+func (c Config) ServerOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(c.MaxMessageSize),
+		grpc.MaxSendMsgSize(c.MaxMessageSize),
+	}
+	if c.InitialWindowSize > 0 {
+		opts = append(opts, grpc.InitialWindowSize(c.InitialWindowSize))
+	}
+	return opts
+}
+
+// readChunkSize returns the chunk size to start a read with. A requested
+// size is clamped to the configured bounds and used throughout; without
+// one the stream adapts, doubling from the default as the read goes on.
+func (c Config) readChunkSize(requested int32) (size int, adaptive bool) {
+	if requested <= 0 {
+		return c.ChunkSize, true
+	}
+	return min(max(int(requested), c.MinChunkSize), c.MaxChunkSize), false
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// copyStep is how much of a ranged copy is done between progress
+	// updates. Whole-file copies share content and finish in one step.
+	copyStep = 64 * 1024 * 1024
+)
+
+// copier is the state of one Copy call
+type copier struct {
+	s        *Plan92ServiceImpl
+	ctx      context.Context
+	session  *Session
+	stream   pb.Plan92_CopyServer
+	progress *pb.CopyProgress
+}
+
+// Copy copies a file, a range of a file or a directory tree on the server.
+// Whole files share their content with the source copy-on-write, so
+// copying them costs no data movement until either side is written.
+func (s *Plan92ServiceImpl) Copy(
+	req *pb.CopyRequest,
+	stream pb.Plan92_CopyServer,
+) error {
+	// Validate session
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	src := path.Clean(req.Src)
+	dst := path.Clean(req.Dst)
+	ranged := req.SrcOffset != 0 || req.Length != 0 || req.DstOffset != 0
+
+	if req.SrcOffset < 0 || req.Length < 0 || req.DstOffset < 0 {
+		return status.Errorf(codes.InvalidArgument, "offsets and length must not be negative")
+	}
+	if src == dst && !ranged {
+		return status.Errorf(codes.InvalidArgument, "source and destination are the same file")
+	}
+
+	srcInfo, err := s.storage.GetInfo(src)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "file not found: %s", src)
+	}
+
+	c := &copier{
+		s:        s,
+		ctx:      stream.Context(),
+		session:  session,
+		stream:   stream,
+		progress: &pb.CopyProgress{},
+	}
+
+	if srcInfo.Type != pb.FileType_FILE_TYPE_DIRECTORY {
+		c.progress.TotalFiles = 1
+		c.progress.TotalBytes = srcInfo.Length
+		if ranged {
+			start, end := resolveRange(req.SrcOffset, req.Length, srcInfo.Length)
+			c.progress.TotalBytes = end - start
+		}
+		return c.copyEntry(src, dst, req.SrcOffset, req.Length, req.DstOffset, ranged)
+	}
+
+	if !req.Recursive {
+		return status.Errorf(codes.InvalidArgument, "is a directory: %s (set recursive)", src)
+	}
+	if ranged {
+		return status.Errorf(codes.InvalidArgument, "a range cannot be copied from a directory")
+	}
+	if strings.HasPrefix(dst+"/", src+"/") {
+		return status.Errorf(codes.InvalidArgument, "cannot copy a directory into itself")
+	}
+
+	// Tree lists children before parents; copy parents first instead
+	entries := s.storage.Tree(src)
+	slices.Reverse(entries)
+
+	c.progress.TotalFiles = int64(len(entries))
+	for _, entry := range entries {
+		if info, err := s.storage.GetInfo(entry); err == nil && info.Type == pb.FileType_FILE_TYPE_REGULAR {
+			c.progress.TotalBytes += info.Length
+		}
+	}
+
+	for _, entry := range entries {
+		target := path.Join(dst, strings.TrimPrefix(entry, src))
+		if err := c.copyEntry(entry, target, 0, 0, 0, false); err != nil {
+			// Entries removed concurrently by someone else are not an error
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyEntry copies one entry after checking read access to src and write
+// access to dst, creating dst like src if it does not exist
+func (c *copier) copyEntry(src, dst string, srcOff, length, dstOff int64, ranged bool) error {
+	if err := c.ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+
+	// The copy record covers the permission checks
+	err := c.s.authorize(c.session, src, pb.OpenMode_OPEN_MODE_READ)
+	if err == nil {
+		err = c.authorizeDestination(dst)
+	}
+	if err != nil {
+		c.s.audit(c.session, "copy", dst, pb.OpenMode_OPEN_MODE_WRITE, 0, err)
+		return err
+	}
+
+	srcData, err := c.s.storage.Get(src)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "file not found: %s", src)
+	}
+	srcInfo := c.s.storage.Stat(srcData)
+
+	dstData, err := c.destination(dst, srcInfo)
+	if err != nil {
+		return err
+	}
+	copied := c.progress.BytesCopied
+
+	// Only regular files have content to copy; directories and pipes are
+	// recreated empty
+	if srcInfo.Type == pb.FileType_FILE_TYPE_REGULAR {
+		content, _ := c.s.storage.Snapshot(srcData)
+
+		if !ranged {
+			if _, err := c.s.storage.Replace(dstData, content); err != nil {
+				return c.failed(dst, copied, err)
+			}
+			c.progress.BytesCopied += content.Size()
+			c.progress.BytesShared += content.StoredBytes()
+		} else {
+			start, end := resolveRange(srcOff, length, content.Size())
+			for pos := start; pos < end; pos += copyStep {
+				n := min(int64(copyStep), end-pos)
+				_, shared, err := c.s.storage.CopyRange(dstData, content, pos, dstOff+pos-start, n)
+				if err != nil {
+					return c.failed(dst, copied, err)
+				}
+				c.progress.BytesCopied += n
+				c.progress.BytesShared += shared
+
+				if end-pos > copyStep {
+					if err := c.send(dst); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	} else if ranged {
+		return status.Errorf(codes.InvalidArgument, "a range can only be copied from a regular file")
+	}
+
+	c.progress.FilesCopied++
+	c.s.audit(c.session, "copy", dst, pb.OpenMode_OPEN_MODE_WRITE, c.progress.BytesCopied-copied, nil)
+	return c.send(dst)
+}
+
+// failed records a copy into dst refused by storage after the bytes
+// counted since copied were written, and returns the status error
+func (c *copier) failed(dst string, copied int64, err error) error {
+	err = storageError(err)
+	c.s.audit(c.session, "copy", dst, pb.OpenMode_OPEN_MODE_WRITE, c.progress.BytesCopied-copied, err)
+	return err
+}
+
+// authorizeDestination checks that the session may write dst or, if it
+// does not exist, create it: that needs write and search permission on
+// the directory it goes in
+func (c *copier) authorizeDestination(dst string) error {
+	if c.s.storage.Exists(dst) {
+		return c.s.authorize(c.session, dst, pb.OpenMode_OPEN_MODE_WRITE)
+	}
+
+	dir := path.Dir(dst)
+	if err := c.s.authorize(c.session, dir, pb.OpenMode_OPEN_MODE_WRITE); err != nil {
+		return err
+	}
+
+	// The root directory has no inode and can always be searched
+	if dir == "/" {
+		return nil
+	}
+	return c.s.authorize(c.session, dir, pb.OpenMode_OPEN_MODE_EXEC)
+}
+
+// destination returns the entry at dst, creating it with the type and
+// mode of src and the session's creator as owner if it does not exist.
+// Like cp, only a privileged session keeps the setuid and setgid bits,
+// which would otherwise apply to a file the session now owns.
+func (c *copier) destination(dst string, srcInfo *pb.FileInfo) (*FileData, error) {
+	if data, err := c.s.storage.Get(dst); err == nil {
+		dstIsDir := c.s.storage.Stat(data).Type == pb.FileType_FILE_TYPE_DIRECTORY
+		srcIsDir := srcInfo.Type == pb.FileType_FILE_TYPE_DIRECTORY
+		if dstIsDir != srcIsDir {
+			return nil, status.Errorf(codes.FailedPrecondition, "cannot overwrite %s with a different file type", dst)
+		}
+		return data, nil
+	}
+
+	mode := srcInfo.Mode
+	if !c.s.privileged(c.session) {
+		mode &^= modeSetuid | modeSetgid
+	}
+	owner, group := c.session.Creator()
+	info := &pb.FileInfo{
+		Type:  srcInfo.Type,
+		Mode:  mode,
+		Owner: owner,
+		Group: group,
+	}
+	if err := c.s.storage.Create(dst, info); err != nil && !c.s.storage.Exists(dst) {
+		return nil, storageError(fmt.Errorf("failed to create file: %w", err))
+	}
+
+	data, err := c.s.storage.Get(dst)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get created file: %v", err)
+	}
+	return data, nil
+}
+
+// send reports progress with dst as the entry being copied
+func (c *copier) send(dst string) error {
+	c.progress.Path = dst
+	if err := c.stream.Send(proto.Clone(c.progress).(*pb.CopyProgress)); err != nil {
+		return status.Errorf(codes.Internal, "failed to send progress: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// copyAll runs a Copy and returns every progress message it streamed
+func copyAll(ctx context.Context, client pb.Plan92Client, req *pb.CopyRequest) ([]*pb.CopyProgress, error) {
+	stream, err := client.Copy(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var progress []*pb.CopyProgress
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return progress, nil
+		}
+		if err != nil {
+			return progress, err
+		}
+		progress = append(progress, resp)
+	}
+}
+
+func TestExtents_CopyFromSharesAlignedExtents(t *testing.T) {
+	src := NewExtents(bytes.Repeat([]byte("a"), 2*extentSize)).Freeze()
+	dst := NewExtents(bytes.Repeat([]byte("b"), 3*extentSize))
+
+	// One aligned extent is shared, the unaligned tail is copied
+	if shared := dst.CopyFrom(src, 0, extentSize, extentSize+10); shared != extentSize {
+		t.Errorf("Expected %d shared bytes, got: %d", extentSize, shared)
+	}
+
+	// Writing to the copy must not change the source
+	dst.WriteAt([]byte("c"), extentSize)
+	if got := src.Bytes()[0]; got != 'a' {
+		t.Errorf("Source changed by write to copy: %q", got)
+	}
+
+	want := bytes.Repeat([]byte("b"), 3*extentSize)
+	copy(want[extentSize:], bytes.Repeat([]byte("a"), extentSize+10))
+	want[extentSize] = 'c'
+	if !bytes.Equal(dst.Bytes(), want) {
+		t.Errorf("Content mismatch after CopyFrom")
+	}
+}
+
+func TestCopy_FilesAndRanges(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	sessionID := sessionResp.SessionId
+
+	content := string(bytes.Repeat([]byte("0123456789abcdef"), extentSize/8))
+	if err := writeTestFile(ctx, client, sessionID, "/src.bin", content); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// A whole-file copy shares all of the source's content
+	progress, err := copyAll(ctx, client, &pb.CopyRequest{SessionId: sessionID, Src: "/src.bin", Dst: "/dst.bin"})
+	if err != nil {
+		t.Fatalf("Failed to copy file: %v", err)
+	}
+	last := progress[len(progress)-1]
+	if last.FilesCopied != 1 || last.BytesCopied != int64(len(content)) || last.BytesShared != int64(len(content)) {
+		t.Errorf("Unexpected progress: %v", last)
+	}
+
+	// Writes to the source are not seen through the copy
+	if err := writeTestFile(ctx, client, sessionID, "/src.bin", "changed"); err != nil {
+		t.Fatalf("Failed to overwrite source: %v", err)
+	}
+	if got, err := catFile(ctx, client, sessionID, "/dst.bin"); err != nil || got != content {
+		t.Errorf("Copy changed after writing the source (%v)", err)
+	}
+
+	// A range copied into the middle of an existing file
+	if _, err := copyAll(ctx, client, &pb.CopyRequest{
+		SessionId: sessionID,
+		Src:       "/src.bin",
+		Dst:       "/dst.bin",
+		SrcOffset: 2,
+		Length:    3,
+		DstOffset: 1,
+	}); err != nil {
+		t.Fatalf("Failed to copy range: %v", err)
+	}
+	got, err := catFile(ctx, client, sessionID, "/dst.bin")
+	if err != nil {
+		t.Fatalf("Failed to read copy: %v", err)
+	}
+	if want := "0ang" + content[4:]; got != want {
+		t.Errorf("Content mismatch after ranged copy. Expected prefix: %q, Got: %q", want[:8], got[:8])
+	}
+
+	// Copying a file onto itself is rejected
+	if _, err := copyAll(ctx, client, &pb.CopyRequest{SessionId: sessionID, Src: "/src.bin", Dst: "/src.bin"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument copying a file onto itself, got: %v", err)
+	}
+}
+
+func TestCopy_RecursiveAndPermissions(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	for _, dir := range []string{"/tree", "/tree/sub"} {
+		if err := storage.Create(dir, &pb.FileInfo{
+			Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+			Mode:  0755,
+			Owner: "alice",
+			Group: "users",
+		}); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+
+	alice, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice", Groups: []string{"users"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	bob, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "bob", Groups: []string{"others"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	files := map[string]string{"/tree/a.txt": "alpha", "/tree/sub/b.txt": "beta"}
+	for name, content := range files {
+		if err := writeTestFile(ctx, client, alice.SessionId, name, content); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	// Directories need recursive
+	if _, err := copyAll(ctx, client, &pb.CopyRequest{SessionId: alice.SessionId, Src: "/tree", Dst: "/copy"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument without recursive, got: %v", err)
+	}
+	if _, err := copyAll(ctx, client, &pb.CopyRequest{SessionId: alice.SessionId, Src: "/tree", Dst: "/tree/sub/copy", Recursive: true}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument copying a directory into itself, got: %v", err)
+	}
+
+	progress, err := copyAll(ctx, client, &pb.CopyRequest{SessionId: alice.SessionId, Src: "/tree", Dst: "/copy", Recursive: true})
+	if err != nil {
+		t.Fatalf("Failed to copy tree: %v", err)
+	}
+	if len(progress) != 4 {
+		t.Errorf("Expected progress for each of 4 entries, got: %d", len(progress))
+	}
+	last := progress[len(progress)-1]
+	if last.FilesCopied != 4 || last.TotalFiles != 4 || last.BytesCopied != last.TotalBytes {
+		t.Errorf("Unexpected final progress: %v", last)
+	}
+	for name, content := range files {
+		copied := "/copy" + name[len("/tree"):]
+		if got, err := catFile(ctx, client, alice.SessionId, copied); err != nil || got != content {
+			t.Errorf("Expected %q in %s, got: %q (%v)", content, copied, got, err)
+		}
+	}
+
+	// Bob can read alice's files but not overwrite them
+	if _, err := copyAll(ctx, client, &pb.CopyRequest{SessionId: bob.SessionId, Src: "/tree/a.txt", Dst: "/tree/sub/b.txt"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied overwriting another user's file, got: %v", err)
+	}
+
+	// Nor can bob copy a file that is unreadable to bob
+	if err := storage.Create("/secret.txt", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_REGULAR,
+		Mode:  0600,
+		Owner: "alice",
+		Group: "users",
+	}); err != nil {
+		t.Fatalf("Failed to create secret: %v", err)
+	}
+	if _, err := copyAll(ctx, client, &pb.CopyRequest{SessionId: bob.SessionId, Src: "/secret.txt", Dst: "/stolen.txt"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied copying an unreadable file, got: %v", err)
+	}
+
+	// Nor create files in alice's directory, which bob can only search
+	if _, err := copyAll(ctx, client, &pb.CopyRequest{SessionId: bob.SessionId, Src: "/tree/a.txt", Dst: "/tree/sub/new.txt"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied copying into a read-only directory, got: %v", err)
+	}
+	if storage.Exists("/tree/sub/new.txt") {
+		t.Errorf("Expected no file created by a refused copy")
+	}
+
+	// A copy bob owns does not keep the setuid and setgid bits
+	if err := storage.Create("/tree/tool", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_REGULAR,
+		Mode:  06755,
+		Owner: "alice",
+		Group: "users",
+	}); err != nil {
+		t.Fatalf("Failed to create tool: %v", err)
+	}
+	if _, err := copyAll(ctx, client, &pb.CopyRequest{SessionId: bob.SessionId, Src: "/tree/tool", Dst: "/tool"}); err != nil {
+		t.Fatalf("Failed to copy tool: %v", err)
+	}
+	if info, err := storage.GetInfo("/tool"); err != nil || info.Owner != "bob" || info.Mode != 0755 {
+		t.Errorf("Expected bob's copy with mode 0755, got: %v (%v)", info, err)
+	}
+}
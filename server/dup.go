@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+)
+
+// retain takes the references a duplicated handle holds, matching what
+// release drops when it is closed
+func (h *FileHandle) retain(storage *MemoryStorage) {
+	storage.Retain(h.Data)
+	if h.Data.Pipe != nil && isWritable(h.Mode) {
+		h.Data.Pipe.OpenWriter()
+	}
+}
+
+// Dup duplicates a file descriptor onto the lowest free one in its session
+func (s *Plan92ServiceImpl) Dup(
+	ctx context.Context,
+	req *pb.DupRequest,
+) (*pb.FileStatus, error) {
+	session, _, err := s.getAndValidateFD(req.SessionId, req.Fd)
+	if err != nil {
+		return nil, err
+	}
+
+	dup, err := session.FDTable.Dup(req.Fd, s.storage)
+	if err != nil {
+		return nil, dupError(err)
+	}
+
+	return s.fdStatus(session, dup), nil
+}
+
+// Dup2 duplicates a file descriptor onto a given number in its session,
+// closing the descriptor that was there
+func (s *Plan92ServiceImpl) Dup2(
+	ctx context.Context,
+	req *pb.Dup2Request,
+) (*pb.FileStatus, error) {
+	session, _, err := s.getAndValidateFD(req.SessionId, req.Fd)
+	if err != nil {
+		return nil, err
+	}
+
+	dup, replaced, err := session.FDTable.Dup2(req.Fd, req.NewFd, s.storage)
+	if err != nil {
+		return nil, dupError(err)
+	}
+	if replaced != nil {
+		replaced.release(s.storage)
+	}
+
+	return s.fdStatus(session, dup), nil
+}
+
+// fdStatus describes an open descriptor of session
+func (s *Plan92ServiceImpl) fdStatus(session *Session, handle *FileHandle) *pb.FileStatus {
+	return &pb.FileStatus{
+		Fd:        handle.FD,
+		Path:      handle.Path,
+		Info:      s.storage.Stat(handle.Data),
+		Mode:      handle.Mode,
+		SessionId: session.ID,
+	}
+}
+
+// dupError converts an FD table error from Dup or Dup2 to a status error
+func dupError(err error) error {
+	if errors.Is(err, errTooManyFiles) {
+		return limitError(err)
+	}
+	return fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_BAD_FD, "%v", err)
+}
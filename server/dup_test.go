@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+)
+
+func TestDup_LowestFreeAndSharedOffset(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	session, _ := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice"})
+	for _, name := range []string{"/a.txt", "/b.txt"} {
+		if err := writeTestFile(ctx, client, session.SessionId, name, "hello world"); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	open := func(filePath string) int32 {
+		t.Helper()
+		resp, err := client.Open(ctx, &pb.OpenRequest{Path: filePath, Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: session.SessionId})
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", filePath, err)
+		}
+		return resp.Fd
+	}
+	seek := func(fd int32, offset int64, whence pb.SeekWhence) int64 {
+		t.Helper()
+		resp, err := client.Seek(ctx, &pb.SeekRequest{Fd: fd, Offset: offset, Whence: whence, SessionId: session.SessionId})
+		if err != nil {
+			t.Fatalf("Failed to seek %d: %v", fd, err)
+		}
+		return resp.Offset
+	}
+	read := func(fd int32, count int64) string {
+		t.Helper()
+		stream, err := client.Read(ctx, &pb.ReadRequest{Fd: fd, Offset: -1, Count: count, SessionId: session.SessionId})
+		if err != nil {
+			t.Fatalf("Failed to read %d: %v", fd, err)
+		}
+		var content []byte
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Failed to read %d: %v", fd, err)
+			}
+			content = append(content, resp.GetChunk()...)
+		}
+		return string(content)
+	}
+
+	// Closed numbers are reused, lowest first
+	first, second := open("/a.txt"), open("/b.txt")
+	if first != firstFD || second != firstFD+1 {
+		t.Fatalf("Expected FDs %d and %d, got %d and %d", firstFD, firstFD+1, first, second)
+	}
+	if _, err := client.Close(ctx, &pb.CloseRequest{Fd: first, SessionId: session.SessionId}); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if fd := open("/b.txt"); fd != first {
+		t.Errorf("Expected the closed FD %d to be reused, got %d", first, fd)
+	}
+
+	// A dup shares the offset of the original
+	dup, err := client.Dup(ctx, &pb.DupRequest{Fd: second, SessionId: session.SessionId})
+	if err != nil {
+		t.Fatalf("Dup failed: %v", err)
+	}
+	if dup.Fd != firstFD+2 || dup.Path != "/b.txt" {
+		t.Errorf("Expected /b.txt at FD %d, got %v", firstFD+2, dup)
+	}
+	seek(second, 6, pb.SeekWhence_SEEK_WHENCE_SET)
+	if got := read(dup.Fd, 2); got != "wo" {
+		t.Errorf("Expected the dup to read from the shared offset, got %q", got)
+	}
+
+	// Reading at the current position through one moves the other
+	if offset := seek(second, 0, pb.SeekWhence_SEEK_WHENCE_CUR); offset != 8 {
+		t.Errorf("Expected the read through the dup to move the offset to 8, got %d", offset)
+	}
+	if got := read(second, -1); got != "rld" {
+		t.Errorf("Expected the original to continue where the dup stopped, got %q", got)
+	}
+
+	// Dup2 closes what was at the target first
+	if _, err := client.Dup2(ctx, &pb.Dup2Request{Fd: first, NewFd: second, SessionId: session.SessionId}); err != nil {
+		t.Fatalf("Dup2 failed: %v", err)
+	}
+	if offset := seek(second, 0, pb.SeekWhence_SEEK_WHENCE_CUR); offset != 0 {
+		t.Errorf("Expected FD %d to take the offset of FD %d, got %d", second, first, offset)
+	}
+	if offset := seek(dup.Fd, 0, pb.SeekWhence_SEEK_WHENCE_CUR); offset != 11 {
+		t.Errorf("Expected the replaced description to keep its offset through the dup, got %d", offset)
+	}
+	if refs, _ := storage.GetRefCount("/b.txt"); refs != 3 {
+		t.Errorf("Expected 3 references to /b.txt, got %d", refs)
+	}
+
+	// Dup2 onto itself does nothing
+	if resp, err := client.Dup2(ctx, &pb.Dup2Request{Fd: dup.Fd, NewFd: dup.Fd, SessionId: session.SessionId}); err != nil || resp.Fd != dup.Fd {
+		t.Errorf("Expected Dup2 onto itself to succeed, got %v, %v", resp, err)
+	}
+	if refs, _ := storage.GetRefCount("/b.txt"); refs != 3 {
+		t.Errorf("Expected Dup2 onto itself to take no reference, got %d", refs)
+	}
+
+	// Closing one of the descriptors leaves the other usable
+	if _, err := client.Close(ctx, &pb.CloseRequest{Fd: first, SessionId: session.SessionId}); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if got := read(second, -1); got != "hello world" {
+		t.Errorf("Expected the remaining dup to read, got %q", got)
+	}
+
+	if _, err := client.Dup(ctx, &pb.DupRequest{Fd: 99, SessionId: session.SessionId}); err == nil {
+		t.Errorf("Expected Dup of an unknown FD to fail")
+	}
+	if _, err := client.Dup2(ctx, &pb.Dup2Request{Fd: second, NewFd: -1, SessionId: session.SessionId}); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_BAD_FD {
+		t.Errorf("Expected BAD_FD for a negative target, got: %v", err)
+	}
+}
+
+func TestDup_ConcurrentWritesAtSharedOffset(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	session, _ := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice"})
+	if err := writeTestFile(ctx, client, session.SessionId, "/log.txt", ""); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	opened, err := client.Open(ctx, &pb.OpenRequest{Path: "/log.txt", Mode: pb.OpenMode_OPEN_MODE_RDWR, SessionId: session.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	dup, err := client.Dup(ctx, &pb.DupRequest{Fd: opened.Fd, SessionId: session.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to dup: %v", err)
+	}
+
+	// Two writers append records through one offset; every record must
+	// land in a range of its own
+	const records = 2000
+	var wg sync.WaitGroup
+	for _, writer := range []struct {
+		fd     int32
+		record string
+	}{{opened.Fd, "aaaa"}, {dup.Fd, "bbbb"}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := client.Io(ctx)
+			if err != nil {
+				t.Errorf("Failed to start Io: %v", err)
+				return
+			}
+			stream.Send(&pb.IoRequest{Tag: 0, Op: &pb.IoRequest_Attach{Attach: &pb.IoAttach{Fd: writer.fd, SessionId: session.SessionId}}})
+			for i := 1; i <= records; i++ {
+				stream.Send(&pb.IoRequest{Tag: uint32(i), Op: &pb.IoRequest_Write{Write: &pb.IoWrite{Offset: -1, Data: []byte(writer.record)}}})
+			}
+			stream.CloseSend()
+			for range records + 1 {
+				if resp, err := stream.Recv(); err != nil || resp.GetError() != nil {
+					t.Errorf("Write failed: %v %v", err, resp.GetError())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	content := fileContent(t, storage, "/log.txt")
+	if len(content) != 2*records*4 {
+		t.Fatalf("Expected %d bytes, got %d", 2*records*4, len(content))
+	}
+	for i := 0; i < len(content); i += 4 {
+		if record := content[i : i+4]; record != "aaaa" && record != "bbbb" {
+			t.Fatalf("Expected whole records, got %q at %d", record, i)
+		}
+	}
+}
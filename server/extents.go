@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/sha256"
+	"hash/crc32"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// extentSize is the alignment and maximum length of a single extent.
+	// Bounding extents keeps the cost of a write proportional to the data
+	// written rather than to the size of the file.
+	extentSize = 64 * 1024
+)
+
+// crc32cTable is the Castagnoli table used for all CRC-32C checksums
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// extent is a run of stored bytes starting at an extentSize-aligned file
+// offset. It may be shorter than extentSize; the remainder reads as zeros.
+type extent struct {
+	offset int64
+	data   []byte
+	shared bool // data also belongs to a frozen version; copy before writing
+}
+
+// end returns the offset one past the last stored byte of the extent
+func (e extent) end() int64 {
+	return e.offset + int64(len(e.data))
+}
+
+// Extents stores file content as sorted, aligned extents. Ranges of the
+// file not covered by an extent are holes: they take no memory and read
+// back as zeros.
+//
+// A frozen Extents is an immutable content version that readers may hold
+// on to; writers call Mutable to get a copy-on-write successor that shares
+// unchanged extent data with it. Frozen versions cache their checksums.
+type Extents struct {
+	size    int64
+	stored  int64 // Total length of the extents' data
+	extents []extent
+	frozen  atomic.Bool
+
+	sumOnce sync.Once
+	sha256  []byte
+	crc32c  uint32
+}
+
+// NewExtents creates file content holding a copy of b
+func NewExtents(b []byte) *Extents {
+	e := &Extents{}
+	e.WriteAt(b, 0)
+	return e
+}
+
+// Freeze marks this version immutable and returns it
+func (e *Extents) Freeze() *Extents {
+	e.frozen.Store(true)
+	return e
+}
+
+// Mutable returns e if it may be modified in place, or a new version that
+// shares e's extent data copy-on-write if e is frozen
+func (e *Extents) Mutable() *Extents {
+	if !e.frozen.Load() {
+		return e
+	}
+
+	clone := &Extents{
+		size:    e.size,
+		stored:  e.stored,
+		extents: make([]extent, len(e.extents)),
+	}
+	for i, ext := range e.extents {
+		clone.extents[i] = extent{
+			offset: ext.offset,
+			data:   slices.Clip(ext.data),
+			shared: true,
+		}
+	}
+	return clone
+}
+
+// Size returns the logical length of the file, holes included
+func (e *Extents) Size() int64 {
+	return e.size
+}
+
+// StoredBytes returns the number of bytes actually held in memory
+func (e *Extents) StoredBytes() int64 {
+	return e.stored
+}
+
+// StoredIn returns the number of bytes held in memory within [off, end)
+func (e *Extents) StoredIn(off, end int64) int64 {
+	var n int64
+	for i := e.find(off); i < len(e.extents) && e.extents[i].offset < end; i++ {
+		n += max(0, min(e.extents[i].end(), end)-max(e.extents[i].offset, off))
+	}
+	return n
+}
+
+// Unstored calls fn with each range that writing [off, end) would newly
+// store: in every extent it touches, from the end of the stored data up
+// to the end of the write
+func (e *Extents) Unstored(off, end int64, fn func(start, end int64)) {
+	for off < end {
+		base := off - off%extentSize
+		stop := min(end, base+extentSize)
+
+		stored := base
+		if i := e.find(base); i < len(e.extents) && e.extents[i].offset == base {
+			stored = e.extents[i].end()
+		}
+		if stop > stored {
+			fn(stored, stop)
+		}
+		off = stop
+	}
+}
+
+// ReadAt fills p with the content starting at off, synthesizing zeros for
+// holes. It returns the number of bytes read, which is short only at EOF.
+func (e *Extents) ReadAt(p []byte, off int64) int {
+	if off >= e.size {
+		return 0
+	}
+	if remaining := e.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	clear(p)
+	end := off + int64(len(p))
+	for i := e.find(off); i < len(e.extents); i++ {
+		ext := e.extents[i]
+		if ext.offset >= end {
+			break
+		}
+		start := max(ext.offset, off)
+		stop := min(ext.end(), end)
+		copy(p[start-off:stop-off], ext.data[start-ext.offset:stop-ext.offset])
+	}
+
+	return len(p)
+}
+
+// WriteAt stores a copy of p at off, extending the file if needed. Writing
+// past the end of file leaves a hole rather than allocating zeros.
+func (e *Extents) WriteAt(p []byte, off int64) {
+	if len(p) == 0 {
+		return
+	}
+
+	end := off + int64(len(p))
+	if end > e.size {
+		e.size = end
+	}
+
+	for len(p) > 0 {
+		base := off - off%extentSize
+		n := min(int64(len(p)), base+extentSize-off)
+
+		ext := e.extentAt(base)
+		if ext.shared {
+			ext.data = slices.Clone(ext.data)
+			ext.shared = false
+		}
+		if need := off + n - base; int64(len(ext.data)) < need {
+			// Grow with explicit zeros so stale bytes beyond a previous
+			// truncation never reappear
+			e.stored += need - int64(len(ext.data))
+			ext.data = append(ext.data, make([]byte, need-int64(len(ext.data)))...)
+		}
+		copy(ext.data[off-base:], p[:n])
+
+		p = p[n:]
+		off += n
+	}
+}
+
+// CopyFrom copies n bytes of src starting at srcOff to dstOff, extending
+// the file if needed. Whole extents at aligned offsets are shared with src
+// copy-on-write instead of duplicated, so src must be frozen. It returns
+// the number of bytes shared.
+func (e *Extents) CopyFrom(src *Extents, srcOff, dstOff, n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	if end := dstOff + n; end > e.size {
+		e.size = end
+	}
+
+	var shared int64
+	for n > 0 {
+		if srcOff%extentSize == 0 && dstOff%extentSize == 0 && n >= extentSize {
+			// Share the whole extent, or punch a hole where src has one
+			var data []byte
+			if i := src.find(srcOff); i < len(src.extents) && src.extents[i].offset == srcOff {
+				data = slices.Clip(src.extents[i].data)
+			}
+			e.setExtent(dstOff, data)
+			shared += int64(len(data))
+
+			srcOff += extentSize
+			dstOff += extentSize
+			n -= extentSize
+			continue
+		}
+
+		// Copy byte-wise up to the next extent boundary of either side
+		m := min(n, extentSize-srcOff%extentSize, extentSize-dstOff%extentSize)
+		buf := make([]byte, m)
+		src.ReadAt(buf, srcOff)
+		e.WriteAt(buf, dstOff)
+
+		srcOff += m
+		dstOff += m
+		n -= m
+	}
+
+	return shared
+}
+
+// setExtent replaces the extent at the aligned offset base with shared
+// data, or removes it if data is empty
+func (e *Extents) setExtent(base int64, data []byte) {
+	i := sort.Search(len(e.extents), func(i int) bool {
+		return e.extents[i].offset >= base
+	})
+	exists := i < len(e.extents) && e.extents[i].offset == base
+	if exists {
+		e.stored -= int64(len(e.extents[i].data))
+	}
+	e.stored += int64(len(data))
+
+	switch {
+	case len(data) == 0 && exists:
+		e.extents = slices.Delete(e.extents, i, i+1)
+	case len(data) == 0:
+	case exists:
+		e.extents[i] = extent{offset: base, data: data, shared: true}
+	default:
+		e.extents = slices.Insert(e.extents, i, extent{offset: base, data: data, shared: true})
+	}
+}
+
+// Truncate sets the file length. Shrinking discards data past the new end;
+// growing adds a hole.
+func (e *Extents) Truncate(size int64) {
+	if size < e.size {
+		i := e.find(size)
+		if i < len(e.extents) && e.extents[i].offset < size {
+			// Clip so growing the extent later never writes into the
+			// backing array of a frozen version
+			ext := &e.extents[i]
+			e.stored -= ext.end() - size
+			ext.data = slices.Clip(ext.data[:size-ext.offset])
+			i++
+		}
+		for _, ext := range e.extents[i:] {
+			e.stored -= int64(len(ext.data))
+		}
+		e.extents = e.extents[:i]
+	}
+	e.size = size
+}
+
+// SeekData returns the first offset at or after off that holds data. The
+// second result is false if only holes remain before end of file.
+func (e *Extents) SeekData(off int64) (int64, bool) {
+	if off >= e.size {
+		return 0, false
+	}
+	i := e.find(off)
+	if i == len(e.extents) {
+		return 0, false
+	}
+	return max(off, e.extents[i].offset), true
+}
+
+// SeekHole returns the first offset at or after off that lies in a hole.
+// End of file counts as a hole, so this only fails for off past EOF.
+func (e *Extents) SeekHole(off int64) (int64, bool) {
+	if off >= e.size {
+		return 0, false
+	}
+	i := e.find(off)
+	if i == len(e.extents) || e.extents[i].offset > off {
+		return off, true
+	}
+
+	// Follow the run of extents that are stored back to back
+	end := e.extents[i].end()
+	for i++; i < len(e.extents) && e.extents[i].offset == end; i++ {
+		end = e.extents[i].end()
+	}
+	return min(end, e.size), true
+}
+
+// Checksums returns the SHA-256 and CRC-32C of the content. They are
+// computed once per version, which is frozen so the result stays valid.
+// Holes are never read: the CRC skips over them arithmetically and the
+// digest is fed from a shared block of zeros.
+func (e *Extents) Checksums() ([]byte, uint32) {
+	e.Freeze()
+	e.sumOnce.Do(func() {
+		h := sha256.New()
+		var crc uint32
+		hole := func(n int64) {
+			crc = crc32cZeros(crc, n)
+			for ; n > 0; n -= extentSize {
+				h.Write(zeroBlock[:min(n, extentSize)])
+			}
+		}
+
+		pos := int64(0)
+		for _, ext := range e.extents {
+			if ext.offset >= e.size {
+				break
+			}
+			hole(ext.offset - pos)
+			data := ext.data[:min(int64(len(ext.data)), e.size-ext.offset)]
+			h.Write(data)
+			crc = crc32.Update(crc, crc32cTable, data)
+			pos = ext.offset + int64(len(data))
+		}
+		hole(e.size - pos)
+
+		e.sha256 = h.Sum(nil)
+		e.crc32c = crc
+	})
+	return e.sha256, e.crc32c
+}
+
+// zeroBlock is the content of an extent-sized hole
+var zeroBlock [extentSize]byte
+
+// crc32cZeroOps[k] is the GF(2) operator that advances a CRC-32C register
+// over 2^k zero bytes
+var crc32cZeroOps = func() (ops [64][32]uint32) {
+	// A single zero bit shifts the register and folds in the polynomial
+	var bit [32]uint32
+	bit[0] = crc32.Castagnoli
+	for i := 1; i < 32; i++ {
+		bit[i] = 1 << (i - 1)
+	}
+	ops[0] = bit
+	for range 3 {
+		ops[0] = gf2Square(&ops[0])
+	}
+	for k := 1; k < len(ops); k++ {
+		ops[k] = gf2Square(&ops[k-1])
+	}
+	return ops
+}()
+
+// crc32cZeros returns crc updated with n zero bytes, in time logarithmic
+// in n. It equals crc32.Update(crc, crc32cTable, make([]byte, n)).
+func crc32cZeros(crc uint32, n int64) uint32 {
+	reg := ^crc
+	for k := 0; n > 0; k, n = k+1, n>>1 {
+		if n&1 != 0 {
+			reg = gf2Times(&crc32cZeroOps[k], reg)
+		}
+	}
+	return ^reg
+}
+
+// gf2Times applies the operator mat to vec
+func gf2Times(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+// gf2Square returns the operator mat applied twice
+func gf2Square(mat *[32]uint32) (square [32]uint32) {
+	for i := range square {
+		square[i] = gf2Times(mat, mat[i])
+	}
+	return square
+}
+
+// Bytes returns the full content with holes materialized as zeros
+func (e *Extents) Bytes() []byte {
+	b := make([]byte, e.size)
+	e.ReadAt(b, 0)
+	return b
+}
+
+// find returns the index of the first extent with stored bytes after off
+func (e *Extents) find(off int64) int {
+	return sort.Search(len(e.extents), func(i int) bool {
+		return e.extents[i].end() > off
+	})
+}
+
+// extentAt returns the extent starting at the aligned offset base,
+// inserting an empty one if the range is currently a hole
+func (e *Extents) extentAt(base int64) *extent {
+	i := sort.Search(len(e.extents), func(i int) bool {
+		return e.extents[i].offset >= base
+	})
+	if i < len(e.extents) && e.extents[i].offset == base {
+		return &e.extents[i]
+	}
+
+	e.extents = append(e.extents, extent{})
+	copy(e.extents[i+1:], e.extents[i:])
+	e.extents[i] = extent{offset: base}
+	return &e.extents[i]
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash/crc32"
+	"slices"
+	"testing"
+)
+
+func TestExtents_HolesReadAsZeros(t *testing.T) {
+	e := &Extents{}
+	e.WriteAt([]byte("tail"), 10<<30) // one byte past 10 GiB
+
+	if e.Size() != 10<<30+4 {
+		t.Fatalf("Size mismatch. Expected: %d, Got: %d", 10<<30+4, e.Size())
+	}
+	if e.StoredBytes() != 4 {
+		t.Errorf("Expected only written bytes to be stored, got: %d", e.StoredBytes())
+	}
+
+	buf := make([]byte, 8)
+	n := e.ReadAt(buf, 10<<30-4)
+	if n != 8 || !bytes.Equal(buf, []byte("\x00\x00\x00\x00tail")) {
+		t.Errorf("Unexpected read across hole boundary: %q (%d bytes)", buf[:n], n)
+	}
+}
+
+func TestExtents_OverlappingWrites(t *testing.T) {
+	e := NewExtents([]byte("aaaa"))
+	e.WriteAt([]byte("cccc"), 8)
+	e.WriteAt([]byte("bbbbbb"), 3)
+
+	if got := string(e.Bytes()); got != "aaabbbbbbccc" {
+		t.Errorf("Content mismatch. Expected: %q, Got: %q", "aaabbbbbbccc", got)
+	}
+}
+
+func TestExtents_WriteAcrossExtentBoundary(t *testing.T) {
+	e := &Extents{}
+	e.WriteAt(bytes.Repeat([]byte("x"), 10), 2*extentSize-5)
+
+	if len(e.extents) != 2 {
+		t.Fatalf("Expected write to be split over 2 extents, got: %d", len(e.extents))
+	}
+	if got := e.StoredBytes(); got != extentSize+5 {
+		t.Errorf("Expected first extent to store up to the write, got: %d bytes", got)
+	}
+}
+
+// Holes are tracked at extentSize granularity, like filesystem blocks
+func TestExtents_SeekDataAndHole(t *testing.T) {
+	const bs = extentSize
+	e := &Extents{}
+	e.WriteAt([]byte("xx"), 2*bs)
+	e.WriteAt(bytes.Repeat([]byte("y"), 2*bs), 3*bs)
+	e.WriteAt([]byte("zz"), 6*bs)
+	e.Truncate(8 * bs)
+
+	tests := []struct {
+		name   string
+		seek   func(int64) (int64, bool)
+		offset int64
+		want   int64
+		ok     bool
+	}{
+		{"data from start", e.SeekData, 0, 2 * bs, true},
+		{"data inside extent", e.SeekData, 2*bs + 1, 2*bs + 1, true},
+		{"data in later extent", e.SeekData, 5 * bs, 6 * bs, true},
+		{"no data in trailing hole", e.SeekData, 7 * bs, 0, false},
+		{"hole at start", e.SeekHole, 0, 0, true},
+		{"hole after short extent", e.SeekHole, 2 * bs, 2*bs + 2, true},
+		{"hole after contiguous run", e.SeekHole, 3 * bs, 5 * bs, true},
+		{"trailing hole", e.SeekHole, 6 * bs, 6*bs + 2, true},
+		{"hole past EOF", e.SeekHole, 8 * bs, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := tt.seek(tt.offset)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: Expected (%d, %v), Got: (%d, %v)", tt.name, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestExtents_Truncate(t *testing.T) {
+	e := NewExtents([]byte("0123456789"))
+	e.Truncate(4)
+	e.WriteAt([]byte("Z"), 6)
+
+	if got := string(e.Bytes()); got != "0123\x00\x00Z" {
+		t.Errorf("Content mismatch. Expected: %q, Got: %q", "0123\x00\x00Z", got)
+	}
+}
+
+func TestExtents_StoredAccounting(t *testing.T) {
+	e := &Extents{}
+	e.WriteAt([]byte("abc"), extentSize+10)
+	if got := e.StoredBytes(); got != 13 {
+		t.Errorf("Expected the extent to store from its start, got: %d", got)
+	}
+	if got := e.StoredIn(extentSize+5, 2*extentSize); got != 8 {
+		t.Errorf("Expected 8 stored bytes in the range, got: %d", got)
+	}
+
+	// A write reports what it would add before it is made
+	var added [][2]int64
+	e.Unstored(extentSize+12, 2*extentSize+4, func(start, end int64) {
+		added = append(added, [2]int64{start, end})
+	})
+	if want := [][2]int64{{extentSize + 13, 2 * extentSize}, {2 * extentSize, 2*extentSize + 4}}; !slices.Equal(added, want) {
+		t.Errorf("Expected new ranges %v, got: %v", want, added)
+	}
+
+	// Sharing and truncating keep the count
+	src := NewExtents(bytes.Repeat([]byte("s"), extentSize)).Freeze()
+	e.CopyFrom(src, 0, 0, extentSize)
+	if got := e.StoredBytes(); got != extentSize+13 {
+		t.Errorf("Expected a shared extent to count, got: %d", got)
+	}
+	e.Truncate(extentSize + 11)
+	if got := e.StoredBytes(); got != extentSize+11 {
+		t.Errorf("Expected truncation to drop stored bytes, got: %d", got)
+	}
+	e.Truncate(10)
+	if got := e.StoredBytes(); got != 10 {
+		t.Errorf("Expected 10 stored bytes, got: %d", got)
+	}
+}
+
+func TestExtents_ChecksumsSkipHoles(t *testing.T) {
+	for _, n := range []int64{0, 1, 7, 64, extentSize - 1, extentSize, 3*extentSize + 5} {
+		if got, want := crc32cZeros(0x1234, n), crc32.Update(0x1234, crc32cTable, make([]byte, n)); got != want {
+			t.Errorf("CRC over %d zeros: expected %08x, got %08x", n, want, got)
+		}
+	}
+
+	// Holes before, between and after extents, and a partial last extent
+	e := &Extents{}
+	e.WriteAt([]byte("head"), 3)
+	e.WriteAt(bytes.Repeat([]byte("x"), extentSize+10), 2*extentSize-5)
+	e.WriteAt([]byte("tail"), 6*extentSize)
+	e.Truncate(8*extentSize + 1)
+	e.Truncate(6*extentSize + 2)
+
+	content := e.Bytes()
+	sum, crc := e.Checksums()
+	if want := sha256.Sum256(content); !bytes.Equal(sum, want[:]) {
+		t.Errorf("SHA-256 mismatch. Expected: %x, Got: %x", want, sum)
+	}
+	if want := crc32.Checksum(content, crc32cTable); crc != want {
+		t.Errorf("CRC-32C mismatch. Expected: %08x, Got: %08x", want, crc)
+	}
+}
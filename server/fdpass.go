@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// maxPendingFDs caps the FDs one session has sent and that are not yet
+// received, so a sender cannot pile up references in other sessions
+const maxPendingFDs = 64
+
+var errInboxClosed = errors.New("session closed")
+
+// pendingFD is an FD waiting in an inbox and the session that sent it
+type pendingFD struct {
+	handle *FileHandle
+	sender *Session
+}
+
+// fdInbox queues the FDs sent to a session until it receives them. Each
+// pending handle holds the references of an open FD.
+type fdInbox struct {
+	mu       sync.Mutex
+	pending  []pendingFD
+	accepted map[string]bool // Sessions allowed to send FDs, by ID
+	closed   bool
+	changed  chan struct{} // Closed and replaced whenever the inbox changes
+}
+
+// accept allows the sessions in senders to send FDs to the inbox
+func (b *fdInbox) accept(senders []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.accepted == nil {
+		b.accepted = make(map[string]bool)
+	}
+	for _, sender := range senders {
+		b.accepted[sender] = true
+	}
+}
+
+// accepts reports whether the inbox takes FDs from the session sender
+func (b *fdInbox) accepts(sender *Session) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.accepted[sender.ID]
+}
+
+// push queues a handle from sender, unless the inbox is closed or the
+// sender already has as many FDs pending as it may
+func (b *fdInbox) push(handle *FileHandle, sender *Session) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errInboxClosed
+	}
+	if pending := sender.sending.Add(1); pending > maxPendingFDs {
+		sender.sending.Add(-1)
+		return fmt.Errorf("%w: %d FDs already pending", errTooManyFiles, pending-1)
+	}
+	b.pending = append(b.pending, pendingFD{handle: handle, sender: sender})
+	b.signal()
+	return nil
+}
+
+// pop takes the oldest pending handle, waiting until one arrives, the
+// inbox is closed or ctx is done
+func (b *fdInbox) pop(ctx context.Context) (*FileHandle, error) {
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return nil, errInboxClosed
+		}
+		if len(b.pending) > 0 {
+			next := b.pending[0]
+			b.pending = b.pending[1:]
+			b.mu.Unlock()
+			next.sender.sending.Add(-1)
+			return next.handle, nil
+		}
+		if b.changed == nil {
+			b.changed = make(chan struct{})
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// close refuses further handles, wakes waiting receivers and returns the
+// handles still pending so the caller can release them
+func (b *fdInbox) close() []*FileHandle {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	handles := make([]*FileHandle, 0, len(b.pending))
+	for _, pending := range b.pending {
+		pending.sender.sending.Add(-1)
+		handles = append(handles, pending.handle)
+	}
+	b.pending = nil
+	b.closed = true
+	b.signal()
+	return handles
+}
+
+// signal wakes every waiting receiver; callers must hold b.mu
+func (b *fdInbox) signal() {
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+}
+
+// SendFd hands a copy of one of the session's FDs to another session,
+// which takes it with ReceiveFd. The recipient must belong to the same
+// user or have accepted FDs from the sender.
+func (s *Plan92ServiceImpl) SendFd(
+	ctx context.Context,
+	req *pb.SendFdRequest,
+) (*emptypb.Empty, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	handle, err := session.FDTable.Get(req.Fd)
+	if err != nil {
+		return nil, fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_BAD_FD, "%v", err)
+	}
+
+	recipient, err := s.sessions.Get(req.ToSessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "invalid recipient: %v", err)
+	}
+	sameUser := session.User != "" && session.User == recipient.User
+	if !sameUser && !recipient.inbox.accepts(session) {
+		err := status.Errorf(codes.PermissionDenied, "permission denied: session %s does not accept FDs from this session", recipient.ID)
+		s.audit(session, "sendfd", handle.Path, handle.Mode, 0, err)
+		return nil, err
+	}
+
+	// The pending copy holds references of its own, so the sender may
+	// close its FD before the recipient receives it
+	handle.retain(s.storage)
+	if err := recipient.inbox.push(handle, session); err != nil {
+		handle.release(s.storage)
+		if errors.Is(err, errInboxClosed) {
+			return nil, status.Errorf(codes.NotFound, "invalid recipient: %v", err)
+		}
+		return nil, limitError(err)
+	}
+	s.audit(session, "sendfd", handle.Path, handle.Mode, 0, nil)
+
+	return &emptypb.Empty{}, nil
+}
+
+// ReceiveFd installs the oldest FD sent to the session at its lowest free
+// descriptor. As with SCM_RIGHTS, an FD that does not fit under the
+// session's limit is closed.
+func (s *Plan92ServiceImpl) ReceiveFd(
+	ctx context.Context,
+	req *pb.ReceiveFdRequest,
+) (*pb.FileStatus, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	handle, err := session.inbox.pop(ctx)
+	if errors.Is(err, errInboxClosed) {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+	if err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+
+	received, err := session.FDTable.Adopt(handle, -1)
+	if err != nil {
+		handle.release(s.storage)
+		s.audit(session, "receivefd", handle.Path, handle.Mode, 0, err)
+		return nil, limitError(err)
+	}
+	s.audit(session, "receivefd", received.Path, received.Mode, 0, nil)
+
+	return s.fdStatus(session, received), nil
+}
+
+// AcceptFds lets the listed sessions send FDs to the session
+func (s *Plan92ServiceImpl) AcceptFds(
+	ctx context.Context,
+	req *pb.AcceptFdsRequest,
+) (*emptypb.Empty, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	session.inbox.accept(req.FromSessionIds)
+
+	return &emptypb.Empty{}, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -8,47 +9,246 @@ import (
 	pb "github.com/accretional/plan92/gen/plan92/v1"
 )
 
+// errSessionClosed is returned by a table whose session has been closed
+var errSessionClosed = errors.New("session closed")
+
+// firstFD is the lowest descriptor Allocate and Dup hand out; 0, 1 and 2
+// are stdin, stdout and stderr
+const firstFD = 3
+
 // FileHandle represents an open file descriptor
 type FileHandle struct {
 	FD     int32
 	Path   string
 	Mode   pb.OpenMode
-	Offset int64
+	Offset *sharedOffset // Shared by descriptors dup'd from one open
 	Data   *FileData
 }
 
+// sharedOffset is the position of one open file, shared by every
+// descriptor duplicated from it. Operations at the current position hold
+// its lock from reading the position until they have moved it, as Linux
+// does with f_pos_lock, so concurrent ones never overlap.
+type sharedOffset struct {
+	mu  sync.Mutex
+	pos int64
+}
+
+// Load returns the current position
+func (o *sharedOffset) Load() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.pos
+}
+
+// Store moves the position to pos
+func (o *sharedOffset) Store(pos int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pos = pos
+}
+
+// Update runs op at the current position and moves the position to what
+// op returns, as one step. On error the position is left alone.
+func (o *sharedOffset) Update(op func(pos int64) (int64, error)) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	pos, err := op(o.pos)
+	if err != nil {
+		return o.pos, err
+	}
+	o.pos = pos
+	return pos, nil
+}
+
+// release drops the references an open handle holds: its pipe writer
+// registration, if any, and its storage reference
+func (h *FileHandle) release(storage *MemoryStorage) {
+	if h.Data.Pipe != nil && isWritable(h.Mode) {
+		h.Data.Pipe.CloseWriter()
+	}
+	storage.Release(h.Data)
+}
+
 // FDTable manages file descriptor allocation and mapping
 type FDTable struct {
 	mu      sync.RWMutex
 	handles map[int32]*FileHandle
-	nextFD  atomic.Int32
+
+	limit    int            // Open descriptors allowed; 0 is unlimited
+	rejected *atomic.Uint64 // Counts allocations refused by the limit, if set
+	closed   bool           // Set by CloseAll; no descriptor may be added after it
 }
 
 // NewFDTable creates a new file descriptor table
 func NewFDTable() *FDTable {
-	table := &FDTable{
+	return &FDTable{
 		handles: make(map[int32]*FileHandle),
 	}
-	// Start FD allocation at 3 (0, 1, 2 are stdin, stdout, stderr)
-	table.nextFD.Store(3)
-	return table
 }
 
-// Allocate allocates a new file descriptor
-func (t *FDTable) Allocate(path string, mode pb.OpenMode, data *FileData) int32 {
+// Allocate allocates the lowest free file descriptor. It fails with
+// errTooManyFiles when the table is at its limit.
+func (t *FDTable) Allocate(path string, mode pb.OpenMode, data *FileData) (int32, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	fd := t.nextFD.Add(1)
+	if err := t.checkLimit(); err != nil {
+		return 0, err
+	}
+
+	fd := t.lowestFree()
 	t.handles[fd] = &FileHandle{
 		FD:     fd,
 		Path:   path,
 		Mode:   mode,
-		Offset: 0,
+		Offset: new(sharedOffset),
 		Data:   data,
 	}
 
-	return fd
+	return fd, nil
+}
+
+// Dup duplicates fd onto the lowest free descriptor, sharing its offset,
+// and returns the new handle. The references the new handle holds are
+// taken before it is installed, so closing it at once cannot drop the
+// original's.
+func (t *FDTable) Dup(fd int32, storage *MemoryStorage) (*FileHandle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	handle, exists := t.handles[fd]
+	if !exists {
+		return nil, fmt.Errorf("invalid file descriptor: %d", fd)
+	}
+	if err := t.checkLimit(); err != nil {
+		return nil, err
+	}
+
+	return t.dupTo(handle, t.lowestFree(), storage), nil
+}
+
+// Dup2 duplicates fd onto newFD, sharing its offset and taking the
+// references of the new handle as Dup does. It returns the new handle and
+// the handle newFD referred to before, if any, whose references the caller
+// must release. If fd and newFD are the same, it returns the handle and
+// nothing to release.
+func (t *FDTable) Dup2(fd, newFD int32, storage *MemoryStorage) (dup, replaced *FileHandle, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	handle, exists := t.handles[fd]
+	if !exists {
+		return nil, nil, fmt.Errorf("invalid file descriptor: %d", fd)
+	}
+	if newFD < 0 {
+		return nil, nil, fmt.Errorf("invalid file descriptor: %d", newFD)
+	}
+	if fd == newFD {
+		return handle, nil, nil
+	}
+
+	replaced, exists = t.handles[newFD]
+	if !exists {
+		if err := t.checkLimit(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return t.dupTo(handle, newFD, storage), replaced, nil
+}
+
+// Install places a new handle at fd, which must be free. Unlike Allocate
+// it picks no number and ignores the limit; it sets up the standard FDs.
+func (t *FDTable) Install(fd int32, path string, mode pb.OpenMode, data *FileData) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, exists := t.handles[fd]; exists {
+		return fmt.Errorf("file descriptor already open: %d", fd)
+	}
+
+	t.handles[fd] = &FileHandle{
+		FD:     fd,
+		Path:   path,
+		Mode:   mode,
+		Offset: new(sharedOffset),
+		Data:   data,
+	}
+	return nil
+}
+
+// Adopt installs a copy of a handle from another table at fd, or at the
+// lowest free descriptor if fd is negative. The copy shares the offset of
+// handle and takes over references the caller already holds for it; if
+// Adopt fails, releasing them is left to the caller. It fails with
+// errSessionClosed once the table has been closed.
+func (t *FDTable) Adopt(handle *FileHandle, fd int32) (*FileHandle, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.checkLimit(); err != nil {
+		return nil, err
+	}
+	if fd < 0 {
+		fd = t.lowestFree()
+	} else if _, exists := t.handles[fd]; exists {
+		return nil, fmt.Errorf("file descriptor already open: %d", fd)
+	}
+
+	return t.dupTo(handle, fd, nil), nil
+}
+
+// dupTo installs a copy of handle at fd, first taking the references the
+// copy holds from storage unless storage is nil. The caller must hold t.mu.
+func (t *FDTable) dupTo(handle *FileHandle, fd int32, storage *MemoryStorage) *FileHandle {
+	dup := *handle
+	dup.FD = fd
+	if storage != nil {
+		dup.retain(storage)
+	}
+	t.handles[fd] = &dup
+	return &dup
+}
+
+// lowestFree returns the lowest unused descriptor from firstFD up. The
+// caller must hold t.mu.
+func (t *FDTable) lowestFree() int32 {
+	fd := int32(firstFD)
+	for {
+		if _, used := t.handles[fd]; !used {
+			return fd
+		}
+		fd++
+	}
+}
+
+// CheckLimit returns errTooManyFiles if the table is at its limit, or
+// errSessionClosed if it is closed, so callers can refuse an open before
+// doing any work for it
+func (t *FDTable) CheckLimit() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.checkLimit()
+}
+
+// checkLimit implements CheckLimit, and also refuses new descriptors once
+// the table is closed. The caller must hold t.mu.
+func (t *FDTable) checkLimit() error {
+	if t.closed {
+		return errSessionClosed
+	}
+	if t.limit > 0 && len(t.handles) >= t.limit {
+		if t.rejected != nil {
+			t.rejected.Add(1)
+		}
+		return fmt.Errorf("%w (limit %d)", errTooManyFiles, t.limit)
+	}
+	return nil
 }
 
 // Get retrieves a file handle by FD
@@ -98,20 +298,22 @@ func (t *FDTable) Count() int {
 	return len(t.handles)
 }
 
-// CloseAll closes all file descriptors in the table
-func (t *FDTable) CloseAll() []int32 {
+// CloseAll closes all file descriptors in the table and returns the
+// handles that were open so the caller can release their storage references
+func (t *FDTable) CloseAll() []*FileHandle {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	fds := make([]int32, 0, len(t.handles))
-	for fd := range t.handles {
-		fds = append(fds, fd)
+	handles := make([]*FileHandle, 0, len(t.handles))
+	for _, handle := range t.handles {
+		handles = append(handles, handle)
 	}
 
 	// Clear all handles
 	t.handles = make(map[int32]*FileHandle)
+	t.closed = true
 
-	return fds
+	return handles
 }
 
 // UpdateOffset updates the offset for a file handle
@@ -124,7 +326,7 @@ func (t *FDTable) UpdateOffset(fd int32, newOffset int64) error {
 		return fmt.Errorf("invalid file descriptor: %d", fd)
 	}
 
-	handle.Offset = newOffset
+	handle.Offset.Store(newOffset)
 	return nil
 }
 
@@ -138,5 +340,5 @@ func (t *FDTable) GetOffset(fd int32) (int64, error) {
 		return 0, fmt.Errorf("invalid file descriptor: %d", fd)
 	}
 
-	return handle.Offset, nil
+	return handle.Offset.Load(), nil
 }
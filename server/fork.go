@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ForkSession creates a child of a session that inherits the listed FDs,
+// optionally under a narrower identity
+func (s *Plan92ServiceImpl) ForkSession(
+	ctx context.Context,
+	req *pb.ForkSessionRequest,
+) (*pb.CreateSessionResponse, error) {
+	parent, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	// Check the FDs before creating anything
+	handles := make([]*FileHandle, 0, len(req.Fds))
+	for i, fd := range req.Fds {
+		if slices.Contains(req.Fds[:i], fd) {
+			return nil, fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_INVALID_ARGUMENT, "fd %d is listed more than once", fd)
+		}
+		handle, err := parent.FDTable.Get(fd)
+		if err != nil {
+			return nil, fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_BAD_FD, "%v", err)
+		}
+		handles = append(handles, handle)
+	}
+
+	var child *Session
+	if parent.Capability != nil {
+		if req.Identity != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "a capability session has no identity to restrict")
+		}
+		child, err = s.sessions.CreateWithCapability(parent.Capability)
+	} else {
+		user, groups, identityErr := s.forkIdentity(parent, req.Identity)
+		if identityErr != nil {
+			return nil, identityErr
+		}
+		child, err = s.sessions.Create(user, groups)
+	}
+	if errors.Is(err, errTooManySessions) {
+		return nil, limitError(err)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create session: %v", err)
+	}
+
+	// Each inherited FD takes its references before it is installed, so a
+	// concurrent close of the child cannot drop the parent's
+	for _, handle := range handles {
+		handle.retain(s.storage)
+		if _, err := child.FDTable.Adopt(handle, handle.FD); err != nil {
+			handle.release(s.storage)
+			s.sessions.Close(child.ID, s.storage)
+			return nil, limitError(err)
+		}
+	}
+
+	return &pb.CreateSessionResponse{
+		SessionId: child.ID,
+		CreatedAt: timestamppb.New(child.CreatedAt),
+	}, nil
+}
+
+// forkIdentity returns the user and groups of a child of parent. Without
+// an identity the child keeps the parent's; otherwise unprivileged parents
+// may only drop groups.
+func (s *Plan92ServiceImpl) forkIdentity(parent *Session, identity *pb.ForkIdentity) (string, []string, error) {
+	if identity == nil {
+		return parent.User, slices.Clone(parent.Groups), nil
+	}
+
+	user := identity.User
+	if user == "" {
+		user = parent.User
+	}
+	if s.privileged(parent) {
+		return user, identity.Groups, nil
+	}
+
+	if user != parent.User {
+		return "", nil, status.Errorf(codes.PermissionDenied, "only privileged sessions may fork as another user")
+	}
+	for _, group := range identity.Groups {
+		if !slices.Contains(parent.Groups, group) {
+			return "", nil, status.Errorf(codes.PermissionDenied, "session is not in group %s", group)
+		}
+	}
+	return user, identity.Groups, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// setupForkTest returns a service with a file only alice may open
+func setupForkTest(t *testing.T) (*Plan92ServiceImpl, *SessionManager, *MemoryStorage) {
+	t.Helper()
+	storage := NewMemoryStorage()
+	sessions := NewSessionManager()
+	service := NewPlan92Service(storage, sessions, NewInodeService(storage, sessions))
+
+	if err := storage.Create("/private.txt", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_REGULAR,
+		Mode:  0600,
+		Owner: "alice",
+		Group: "users",
+	}); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	return service, sessions, storage
+}
+
+func TestFork_InheritsFDsAndRestrictsIdentity(t *testing.T) {
+	service, sessions, storage := setupForkTest(t)
+	ctx := context.Background()
+
+	alice, _ := sessions.Create("alice", []string{"users", "staff"})
+	for range 2 {
+		if _, err := service.Open(ctx, &pb.OpenRequest{Path: "/private.txt", Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: alice.ID}); err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+	}
+
+	resp, err := service.ForkSession(ctx, &pb.ForkSessionRequest{
+		SessionId: alice.ID,
+		Fds:       []int32{firstFD + 1},
+		Identity:  &pb.ForkIdentity{Groups: []string{"users"}},
+	})
+	if err != nil {
+		t.Fatalf("ForkSession failed: %v", err)
+	}
+	child, err := sessions.Get(resp.SessionId)
+	if err != nil {
+		t.Fatalf("Failed to get child session: %v", err)
+	}
+	if child.User != "alice" || !slices.Equal(child.Groups, []string{"users"}) {
+		t.Errorf("Expected alice in users only, got %s in %v", child.User, child.Groups)
+	}
+
+	// Only the listed FD is inherited, at the same number and offset
+	if _, err := child.FDTable.Get(firstFD); err == nil {
+		t.Errorf("Expected FD %d not to be inherited", firstFD)
+	}
+	alice.FDTable.UpdateOffset(firstFD+1, 7)
+	if offset, err := child.FDTable.GetOffset(firstFD + 1); err != nil || offset != 7 {
+		t.Errorf("Expected the inherited FD to share offset 7, got %d, %v", offset, err)
+	}
+	if refs, _ := storage.GetRefCount("/private.txt"); refs != 3 {
+		t.Errorf("Expected 3 references, got %d", refs)
+	}
+
+	// Unprivileged sessions may only drop groups
+	for _, identity := range []*pb.ForkIdentity{{Groups: []string{"wheel"}}, {User: "root"}} {
+		if _, err := service.ForkSession(ctx, &pb.ForkSessionRequest{SessionId: alice.ID, Identity: identity}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("Expected PermissionDenied for %v, got: %v", identity, err)
+		}
+	}
+	if _, err := service.ForkSession(ctx, &pb.ForkSessionRequest{SessionId: alice.ID, Fds: []int32{99}}); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_BAD_FD {
+		t.Errorf("Expected BAD_FD for an unknown FD, got: %v", err)
+	}
+	before := sessions.Count()
+	if _, err := service.ForkSession(ctx, &pb.ForkSessionRequest{SessionId: alice.ID, Fds: []int32{firstFD, firstFD}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a repeated FD, got: %v", err)
+	}
+	if sessions.Count() != before {
+		t.Errorf("Expected no child session after a rejected fork")
+	}
+
+	// The child keeps its FD open after the parent is gone
+	sessions.Close(alice.ID, storage)
+	if refs, _ := storage.GetRefCount("/private.txt"); refs != 1 {
+		t.Errorf("Expected the child's reference to remain, got %d", refs)
+	}
+}
+
+func TestFdPassing_SendAndReceive(t *testing.T) {
+	service, sessions, storage := setupForkTest(t)
+	ctx := context.Background()
+
+	alice, _ := sessions.Create("alice", []string{"users"})
+	bob, _ := sessions.Create("bob", []string{"users"})
+	if _, err := service.Open(ctx, &pb.OpenRequest{Path: "/private.txt", Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: bob.ID}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected bob to be denied, got: %v", err)
+	}
+	opened, err := service.Open(ctx, &pb.OpenRequest{Path: "/private.txt", Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: alice.ID})
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	// Another user's session must accept FDs from the sender first
+	if _, err := service.SendFd(ctx, &pb.SendFdRequest{SessionId: alice.ID, Fd: opened.Fd, ToSessionId: bob.ID}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied before bob accepts, got: %v", err)
+	}
+	if _, err := service.AcceptFds(ctx, &pb.AcceptFdsRequest{SessionId: bob.ID, FromSessionIds: []string{alice.ID}}); err != nil {
+		t.Fatalf("AcceptFds failed: %v", err)
+	}
+
+	// A receiver waits for the FD to be sent
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		service.SendFd(ctx, &pb.SendFdRequest{SessionId: alice.ID, Fd: opened.Fd, ToSessionId: bob.ID})
+	}()
+	received, err := service.ReceiveFd(ctx, &pb.ReceiveFdRequest{SessionId: bob.ID})
+	if err != nil {
+		t.Fatalf("ReceiveFd failed: %v", err)
+	}
+	if received.Path != "/private.txt" || received.SessionId != bob.ID {
+		t.Errorf("Unexpected received FD: %v", received)
+	}
+	alice.FDTable.UpdateOffset(opened.Fd, 5)
+	if offset, _ := bob.FDTable.GetOffset(received.Fd); offset != 5 {
+		t.Errorf("Expected the received FD to share offset 5, got %d", offset)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := service.ReceiveFd(waitCtx, &pb.ReceiveFdRequest{SessionId: bob.ID}); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded with nothing sent, got: %v", err)
+	}
+	if _, err := service.SendFd(ctx, &pb.SendFdRequest{SessionId: alice.ID, Fd: opened.Fd, ToSessionId: "nobody"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for an unknown recipient, got: %v", err)
+	}
+
+	// Closing the receiver releases its FDs and those still pending
+	if _, err := service.SendFd(ctx, &pb.SendFdRequest{SessionId: alice.ID, Fd: opened.Fd, ToSessionId: bob.ID}); err != nil {
+		t.Fatalf("SendFd failed: %v", err)
+	}
+	if refs, _ := storage.GetRefCount("/private.txt"); refs != 3 {
+		t.Errorf("Expected 3 references, got %d", refs)
+	}
+	sessions.Close(bob.ID, storage)
+	if refs, _ := storage.GetRefCount("/private.txt"); refs != 1 {
+		t.Errorf("Expected only alice's reference to remain, got %d", refs)
+	}
+
+	// A closed session's table takes no more FDs, so a receive racing the
+	// close cannot strand a reference in it
+	handle, _ := alice.FDTable.Get(opened.Fd)
+	if _, err := bob.FDTable.Adopt(handle, -1); !errors.Is(err, errSessionClosed) {
+		t.Errorf("Expected a closed table to refuse an FD, got: %v", err)
+	}
+}
+
+func TestFdPassing_PendingLimitIsPerSender(t *testing.T) {
+	service, sessions, storage := setupForkTest(t)
+	ctx := context.Background()
+
+	alice, _ := sessions.Create("alice", []string{"users"})
+	other, _ := sessions.Create("alice", []string{"users"})
+	bob, _ := sessions.Create("bob", []string{"users"})
+	opened, err := service.Open(ctx, &pb.OpenRequest{Path: "/private.txt", Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: alice.ID})
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	// Sessions of the same user need not accept each other
+	for range maxPendingFDs {
+		if _, err := service.SendFd(ctx, &pb.SendFdRequest{SessionId: alice.ID, Fd: opened.Fd, ToSessionId: other.ID}); err != nil {
+			t.Fatalf("SendFd failed: %v", err)
+		}
+	}
+
+	// The sender has used up its quota, even towards another recipient
+	service.AcceptFds(ctx, &pb.AcceptFdsRequest{SessionId: bob.ID, FromSessionIds: []string{alice.ID, other.ID}})
+	if _, err := service.SendFd(ctx, &pb.SendFdRequest{SessionId: alice.ID, Fd: opened.Fd, ToSessionId: bob.ID}); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_TOO_MANY_FILES {
+		t.Errorf("Expected TOO_MANY_FILES past the sender's limit, got: %v", err)
+	}
+
+	// Receiving one frees a slot for the sender
+	received, err := service.ReceiveFd(ctx, &pb.ReceiveFdRequest{SessionId: other.ID})
+	if err != nil {
+		t.Fatalf("ReceiveFd failed: %v", err)
+	}
+	if _, err := service.SendFd(ctx, &pb.SendFdRequest{SessionId: alice.ID, Fd: opened.Fd, ToSessionId: bob.ID}); err != nil {
+		t.Errorf("Expected a send after a receive to succeed, got: %v", err)
+	}
+
+	// Other senders are unaffected, and closing a recipient returns slots
+	if _, err := service.SendFd(ctx, &pb.SendFdRequest{SessionId: other.ID, Fd: received.Fd, ToSessionId: bob.ID}); err != nil {
+		t.Errorf("Expected another sender to reach bob, got: %v", err)
+	}
+	sessions.Close(other.ID, storage)
+	if pending := alice.sending.Load(); pending != 1 {
+		t.Errorf("Expected 1 FD pending from alice, got %d", pending)
+	}
+}
@@ -2,26 +2,35 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"path"
+	"slices"
+	"time"
 
 	pb "github.com/accretional/plan92/gen/plan92/v1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 // InodeServiceImpl implements the InodeService gRPC service
 type InodeServiceImpl struct {
 	pb.UnimplementedInodeServiceServer
-	storage     *MemoryStorage
-	sessions    *SessionManager
-	permChecker *PermissionChecker
+	storage      *MemoryStorage
+	sessions     *SessionManager
+	permChecker  *PermissionChecker
+	capabilities *CapabilityManager
+	authorizer   Authorizer // Consulted after the permission checks; nil for none
+	audit        *AuditLog  // Records security-relevant operations; nil for none
 }
 
 // NewInodeService creates a new InodeService implementation
 func NewInodeService(storage *MemoryStorage, sessions *SessionManager) *InodeServiceImpl {
 	return &InodeServiceImpl{
-		storage:     storage,
-		sessions:    sessions,
-		permChecker: NewPermissionChecker(storage),
+		storage:      storage,
+		sessions:     sessions,
+		permChecker:  NewPermissionChecker(storage),
+		capabilities: NewCapabilityManager(nil),
 	}
 }
 
@@ -36,25 +45,93 @@ func (s *InodeServiceImpl) CheckPermission(
 		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
 	}
 
-	// Use user from session if not specified in context
-	user := req.Context.User
-	groups := req.Context.Groups
-	if user == "" {
-		user = session.User
-		groups = session.Groups
+	resp := s.checkPermission(session, req)
+
+	// Every decision is audited, denials included
+	if s.audit != nil {
+		record := newAuditRecord(session, "check", req.Path, req.RequestedMode, 0, nil)
+		if user := req.Context.GetUser(); user != "" {
+			record.User, record.Groups = user, req.Context.GetGroups()
+		}
+		if !resp.Granted {
+			record.Result = auditDenied
+			record.Reason = resp.Reason
+		}
+		s.audit.Record(record)
 	}
 
-	// Check hierarchical permissions
-	err = s.permChecker.CheckPathPermissions(req.Path, req.RequestedMode, user, groups)
+	return resp, nil
+}
+
+// checkPermission decides a CheckPermission request for session
+func (s *InodeServiceImpl) checkPermission(
+	session *Session,
+	req *pb.CheckPermissionRequest,
+) *pb.CheckPermissionResponse {
+	var err error
+
+	// A capability presented with the request, or the one the session was
+	// created from, stands in for the identity
+	capability := session.Capability
+	if token := req.Context.GetCapability(); token != "" {
+		if capability, err = s.capabilities.Verify(token); err != nil {
+			return &pb.CheckPermissionResponse{
+				Granted: false,
+				Reason:  err.Error(),
+			}
+		}
+	}
+
+	var user string
+	var groups []string
+	if capability != nil {
+		// Policy sees accesses through a capability as its issuer's
+		user, groups = capability.Issuer, capability.IssuerGroups
+		err = s.permChecker.CheckCapabilityPermissions(capability, req.Path, req.RequestedMode)
+	} else {
+		// Use user from session if not specified in context
+		user = req.Context.GetUser()
+		groups = req.Context.GetGroups()
+		if user == "" {
+			user = session.User
+			groups = session.Groups
+		}
+
+		// The session's cache only holds decisions for its own identity
+		var cache *PermissionCache
+		if user == session.User && slices.Equal(groups, session.Groups) {
+			cache = session.Permissions
+		}
+
+		// Check hierarchical permissions
+		err = s.permChecker.CheckCachedPathPermissions(cache, req.Path, req.RequestedMode, user, groups)
+	}
+
+	// Custom rules can only narrow what the permissions allow
+	if err == nil && s.authorizer != nil {
+		err = s.authorizer.Authorize(&AuthzRequest{
+			Session: session,
+			User:    user,
+			Groups:  groups,
+			Path:    path.Clean(req.Path),
+			Mode:    req.RequestedMode,
+			Time:    time.Now(),
+		})
+	}
+
+	// Only a granted access counts as a use of the capability
+	if err == nil && capability != nil {
+		err = s.capabilities.Use(capability)
+	}
 	if err != nil {
 		return &pb.CheckPermissionResponse{
 			Granted: false,
 			Reason:  err.Error(),
-		}, nil
+		}
 	}
 
 	// Get inode info
-	data, err := s.storage.Get(req.Path)
+	info, err := s.storage.GetInfo(req.Path)
 	if err != nil {
 		// File doesn't exist - permission checks passed but file needs to be created
 		if req.RequestedMode == pb.OpenMode_OPEN_MODE_WRITE ||
@@ -62,18 +139,48 @@ func (s *InodeServiceImpl) CheckPermission(
 			return &pb.CheckPermissionResponse{
 				Granted: true,
 				Reason:  "file will be created",
-			}, nil
+			}
 		}
 		return &pb.CheckPermissionResponse{
 			Granted: false,
 			Reason:  "file not found",
-		}, nil
+		}
 	}
 
 	return &pb.CheckPermissionResponse{
 		Granted: true,
-		Inode:   data.Info,
-	}, nil
+		Inode:   info,
+	}
+}
+
+// checkRemove decides whether session may unlink the entry at filePath.
+// Like checkPermission it lets a session's capability stand in for its
+// identity and consults the authorizer, which sees a removal as a write.
+func (s *InodeServiceImpl) checkRemove(session *Session, filePath string) error {
+	user, groups := session.User, session.Groups
+	var err error
+	if capability := session.Capability; capability != nil {
+		user, groups = capability.Issuer, capability.IssuerGroups
+		err = s.permChecker.CheckCapabilityRemovePermission(capability, filePath)
+	} else {
+		err = s.permChecker.CheckRemovePermission(filePath, user, groups)
+	}
+
+	if err == nil && s.authorizer != nil {
+		err = s.authorizer.Authorize(&AuthzRequest{
+			Session: session,
+			User:    user,
+			Groups:  groups,
+			Path:    path.Clean(filePath),
+			Mode:    pb.OpenMode_OPEN_MODE_WRITE,
+			Time:    time.Now(),
+		})
+	}
+
+	if err == nil && session.Capability != nil {
+		err = s.capabilities.Use(session.Capability)
+	}
+	return err
 }
 
 // AllocateFd allocates a file descriptor for an opened file
@@ -87,25 +194,41 @@ func (s *InodeServiceImpl) AllocateFd(
 		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
 	}
 
+	// Refuse before creating anything if the session cannot hold another FD
+	if err := session.FDTable.CheckLimit(); err != nil {
+		return nil, limitError(err)
+	}
+
 	// Get file data
 	data, err := s.storage.Get(req.Path)
 	if err != nil {
 		// File doesn't exist - create it if opening for write
 		if req.Mode == pb.OpenMode_OPEN_MODE_WRITE ||
 			req.Mode == pb.OpenMode_OPEN_MODE_TRUNC {
-			// Use provided inode info or create default
-			info := req.Inode
-			if info == nil {
+			// Use provided inode info or create default. The provided
+			// info is copied since stored FileInfo values are immutable.
+			var info *pb.FileInfo
+			if req.Inode != nil {
+				info = proto.Clone(req.Inode).(*pb.FileInfo)
+			} else {
+				// Default permissions. As with a umask, the group and
+				// other write bits are dropped unless a default ACL
+				// decides instead.
+				mode := uint32(0644)
+				if parent, err := s.storage.GetInfo(parentDir(req.Path)); err == nil && len(parent.DefaultAcl) > 0 {
+					mode = 0666
+				}
+				owner, group := session.Creator()
 				info = &pb.FileInfo{
 					Type:  pb.FileType_FILE_TYPE_REGULAR,
-					Mode:  0644, // Default permissions
-					Owner: session.User,
-					Group: session.Groups[0],
+					Mode:  mode,
+					Owner: owner,
+					Group: group,
 				}
 			}
 
 			if err := s.storage.Create(req.Path, info); err != nil {
-				return nil, status.Errorf(codes.Internal, "failed to create file: %v", err)
+				return nil, storageError(fmt.Errorf("failed to create file: %w", err))
 			}
 
 			data, err = s.storage.Get(req.Path)
@@ -117,19 +240,24 @@ func (s *InodeServiceImpl) AllocateFd(
 		}
 	}
 
-	// Allocate FD in session's FD table
-	fd := session.FDTable.Allocate(req.Path, req.Mode, data)
+	// Take the FD's reference on the file that was looked up, which the
+	// path may no longer name, before the FD can be closed
+	s.storage.Retain(data)
+	fd, err := session.FDTable.Allocate(req.Path, req.Mode, data)
+	if err != nil {
+		s.storage.Release(data)
+		return nil, limitError(err)
+	}
 
-	// Increment reference count
-	if err := s.storage.IncRef(req.Path); err != nil {
-		session.FDTable.Release(fd) // Clean up on error
-		return nil, status.Errorf(codes.Internal, "failed to increment refcount: %v", err)
+	// Readers of a pipe wait for data while any writer holds it open
+	if data.Pipe != nil && isWritable(req.Mode) {
+		data.Pipe.OpenWriter()
 	}
 
 	return &pb.FileStatus{
 		Fd:        fd,
 		Path:      req.Path,
-		Info:      data.Info,
+		Info:      s.storage.Stat(data),
 		Mode:      req.Mode,
 		SessionId: req.SessionId,
 	}, nil
@@ -140,12 +268,12 @@ func (s *InodeServiceImpl) GetInode(
 	ctx context.Context,
 	req *pb.GetInodeRequest,
 ) (*pb.FileInfo, error) {
-	data, err := s.storage.Get(req.Path)
+	info, err := s.storage.GetInfo(req.Path)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "file not found: %s", req.Path)
 	}
 
-	return data.Info, nil
+	return info, nil
 }
 
 // CreateInode creates a new inode (file or directory)
@@ -168,14 +296,14 @@ func (s *InodeServiceImpl) CreateInode(
 
 	// Create the inode
 	if err := s.storage.Create(req.Path, info); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create inode: %v", err)
+		return nil, storageError(fmt.Errorf("failed to create inode: %w", err))
 	}
 
 	// Retrieve and return the created inode
-	data, err := s.storage.Get(req.Path)
+	created, err := s.storage.GetInfo(req.Path)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to get created inode: %v", err)
 	}
 
-	return data.Info, nil
+	return created, nil
 }
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ioConn is the state of one Io stream bound to a single FD
+type ioConn struct {
+	s       *Plan92ServiceImpl
+	stream  pb.Plan92_IoServer
+	session *Session
+	fd      int32
+
+	sendMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint32]*ioPending
+	wg      sync.WaitGroup
+}
+
+// ioPending is an operation running in the background that can be flushed
+type ioPending struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Io serves a bidirectional stream of tagged operations on one FD.
+// Operations are applied in the order received, except for pipe reads,
+// which may block waiting for a writer and so run in the background; that
+// is why replies are matched to requests by tag rather than by order.
+func (s *Plan92ServiceImpl) Io(stream pb.Plan92_IoServer) error {
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to receive request: %v", err)
+	}
+
+	attach := first.GetAttach()
+	if attach == nil {
+		return status.Errorf(codes.InvalidArgument, "first request must be an attach")
+	}
+
+	session, handle, err := s.getAndValidateFD(attach.SessionId, attach.Fd)
+	if err != nil {
+		return err
+	}
+
+	c := &ioConn{
+		s:       s,
+		stream:  stream,
+		session: session,
+		fd:      attach.Fd,
+		pending: make(map[uint32]*ioPending),
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer func() {
+		// Abort background operations before the stream goes away
+		cancel()
+		c.wg.Wait()
+	}()
+
+	if err := c.send(&pb.IoResponse{
+		Tag: first.Tag,
+		Result: &pb.IoResponse_Attach{Attach: &pb.IoAttachResult{
+			Status: &pb.FileStatus{
+				Fd:        handle.FD,
+				Path:      handle.Path,
+				Info:      s.storage.Stat(handle.Data),
+				Mode:      handle.Mode,
+				SessionId: session.ID,
+			},
+			Iounit: int32(s.config.ChunkSize),
+		}},
+	}); err != nil {
+		return err
+	}
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to receive request: %v", err)
+		}
+
+		if err := c.dispatch(ctx, req); err != nil {
+			return err
+		}
+	}
+}
+
+// dispatch runs a single request. It only returns an error if the stream
+// itself failed; operation failures are replied to with an FSError.
+func (c *ioConn) dispatch(ctx context.Context, req *pb.IoRequest) error {
+	c.mu.Lock()
+	_, busy := c.pending[req.Tag]
+	c.mu.Unlock()
+	if busy {
+		return c.fail(req.Tag, status.Errorf(codes.InvalidArgument, "tag %d is already in use", req.Tag))
+	}
+
+	switch op := req.Op.(type) {
+	case *pb.IoRequest_Read:
+		handle, err := c.handle()
+		if err != nil {
+			return c.fail(req.Tag, err)
+		}
+		if !isReadable(handle.Mode) {
+			return c.fail(req.Tag, status.Errorf(codes.PermissionDenied, "file not opened for reading"))
+		}
+		if handle.Data.Pipe != nil {
+			c.readPipe(ctx, req.Tag, handle.Data.Pipe, op.Read.Count)
+			return nil
+		}
+		resp, err := c.read(handle, op.Read)
+		return c.reply(req.Tag, resp, err)
+
+	case *pb.IoRequest_Write:
+		handle, err := c.handle()
+		if err != nil {
+			return c.fail(req.Tag, err)
+		}
+		if !isWritable(handle.Mode) {
+			return c.fail(req.Tag, status.Errorf(codes.PermissionDenied, "file not opened for writing"))
+		}
+		resp, err := c.write(ctx, handle, op.Write)
+		return c.reply(req.Tag, resp, err)
+
+	case *pb.IoRequest_Seek:
+		offset, err := c.s.seekFD(c.session, c.fd, op.Seek.Offset, op.Seek.Whence)
+		if err != nil {
+			return c.fail(req.Tag, err)
+		}
+		return c.send(&pb.IoResponse{
+			Tag:    req.Tag,
+			Result: &pb.IoResponse_Seek{Seek: &pb.SeekResponse{Offset: offset}},
+		})
+
+	case *pb.IoRequest_Flush:
+		c.flush(op.Flush.OldTag)
+		return c.send(&pb.IoResponse{
+			Tag:    req.Tag,
+			Result: &pb.IoResponse_Flush{Flush: &pb.IoFlushResult{}},
+		})
+
+	case *pb.IoRequest_Attach:
+		return c.fail(req.Tag, status.Errorf(codes.InvalidArgument, "stream is already attached"))
+
+	default:
+		return c.fail(req.Tag, status.Errorf(codes.InvalidArgument, "unknown operation"))
+	}
+}
+
+// handle re-fetches the attached FD so a concurrent Close is noticed
+func (c *ioConn) handle() (*FileHandle, error) {
+	handle, err := c.session.FDTable.Get(c.fd)
+	if err != nil {
+		return nil, fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_BAD_FD,
+			"invalid file descriptor: %v", err)
+	}
+	return handle, nil
+}
+
+// read serves a read from a regular file. Reading at the current position
+// moves it past the data in the same step.
+func (c *ioConn) read(handle *FileHandle, op *pb.IoRead) (*pb.IoResponse, error) {
+	buf := make([]byte, c.ioCount(op.Count))
+	var n int
+	var info *pb.FileInfo
+	read := func(pos int64) (int64, error) {
+		var content *Extents
+		content, info = c.s.storage.Snapshot(handle.Data)
+		n = content.ReadAt(buf, pos)
+		return pos + int64(n), nil
+	}
+
+	offset := op.Offset
+	if offset < 0 {
+		handle.Offset.Update(func(pos int64) (int64, error) {
+			offset = pos
+			return read(pos)
+		})
+	} else {
+		read(offset)
+	}
+
+	return &pb.IoResponse{
+		Result: &pb.IoResponse_Read{Read: &pb.IoReadResult{
+			Data:   buf[:n],
+			Eof:    offset+int64(n) >= info.Length,
+			Crc32C: crc32.Checksum(buf[:n], crc32cTable),
+		}},
+	}, nil
+}
+
+// readPipe serves a pipe read in the background, since it may block until
+// a writer produces data. The operation can be aborted with a flush.
+func (c *ioConn) readPipe(ctx context.Context, tag uint32, p *Pipe, count int64) {
+	ctx, cancel := context.WithCancel(ctx)
+	op := &ioPending{cancel: cancel, done: make(chan struct{})}
+
+	c.mu.Lock()
+	c.pending[tag] = op
+	c.mu.Unlock()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(op.done)
+		defer func() {
+			c.mu.Lock()
+			delete(c.pending, tag)
+			c.mu.Unlock()
+			cancel()
+		}()
+
+		buf := make([]byte, c.ioCount(count))
+		n, err := p.Read(ctx, buf)
+		if err != nil && err != io.EOF {
+			// Flushed or the stream ended: no reply is owed
+			return
+		}
+
+		_ = c.send(&pb.IoResponse{
+			Tag: tag,
+			Result: &pb.IoResponse_Read{Read: &pb.IoReadResult{
+				Data:   buf[:n],
+				Eof:    err == io.EOF,
+				Crc32C: crc32.Checksum(buf[:n], crc32cTable),
+			}},
+		})
+	}()
+}
+
+// write serves a write to a regular file or pipe. A write to a full pipe
+// holds up the requests after it until readers make room.
+func (c *ioConn) write(ctx context.Context, handle *FileHandle, op *pb.IoWrite) (*pb.IoResponse, error) {
+	if handle.Data.Pipe != nil {
+		n, err := handle.Data.Pipe.Write(ctx, op.Data)
+		if err != nil {
+			return nil, status.FromContextError(err).Err()
+		}
+		return &pb.IoResponse{
+			Result: &pb.IoResponse_Write{Write: &pb.IoWriteResult{Count: int64(n)}},
+		}, nil
+	}
+
+	// Writing at the current position moves it past the data in the same
+	// step, so concurrent writes through shared offsets never overlap
+	write := func(pos int64) (int64, error) {
+		if err := c.s.storage.WriteAt(handle.Data, op.Data, pos); err != nil {
+			return pos, err
+		}
+		return pos + int64(len(op.Data)), nil
+	}
+
+	var err error
+	if op.Offset < 0 {
+		_, err = handle.Offset.Update(write)
+	} else {
+		_, err = write(op.Offset)
+	}
+	if err != nil {
+		err = storageError(err)
+		c.s.audit(c.session, "write", handle.Path, handle.Mode, 0, err)
+		return nil, err
+	}
+	c.s.audit(c.session, "write", handle.Path, handle.Mode, int64(len(op.Data)), nil)
+
+	return &pb.IoResponse{
+		Result: &pb.IoResponse_Write{Write: &pb.IoWriteResult{Count: int64(len(op.Data))}},
+	}, nil
+}
+
+// flush aborts a background operation and waits until it has finished, so
+// that no reply for oldTag can follow the flush reply
+func (c *ioConn) flush(oldTag uint32) {
+	c.mu.Lock()
+	op, exists := c.pending[oldTag]
+	c.mu.Unlock()
+
+	if exists {
+		op.cancel()
+		<-op.done
+	}
+}
+
+// reply sends the result of an operation, or its error as an FSError
+func (c *ioConn) reply(tag uint32, resp *pb.IoResponse, err error) error {
+	if err != nil {
+		return c.fail(tag, err)
+	}
+	resp.Tag = tag
+	return c.send(resp)
+}
+
+// fail replies to an operation with an FSError derived from a status error
+func (c *ioConn) fail(tag uint32, err error) error {
+	return c.send(&pb.IoResponse{
+		Tag:    tag,
+		Result: &pb.IoResponse_Error{Error: toFSError(err, c.fd)},
+	})
+}
+
+// send serializes replies from the dispatch loop and background operations
+func (c *ioConn) send(resp *pb.IoResponse) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if err := c.stream.Send(resp); err != nil {
+		return status.Errorf(codes.Internal, "failed to send response: %v", err)
+	}
+	return nil
+}
+
+// ioCount clamps a requested read count to the iounit
+func (c *ioConn) ioCount(count int64) int64 {
+	iounit := int64(c.s.config.ChunkSize)
+	if count <= 0 || count > iounit {
+		return iounit
+	}
+	return count
+}
+
+// toFSError converts a gRPC status error into an FSError for in-band replies
+func toFSError(err error, fd int32) *pb.FSError {
+	st := status.Convert(err)
+
+	code := pb.FSErrorCode_FS_ERROR_CODE_IO_ERROR
+	switch st.Code() {
+	case codes.PermissionDenied:
+		code = pb.FSErrorCode_FS_ERROR_CODE_PERMISSION_DENIED
+	case codes.NotFound:
+		code = pb.FSErrorCode_FS_ERROR_CODE_NO_SUCH_FILE
+	case codes.InvalidArgument, codes.OutOfRange:
+		code = pb.FSErrorCode_FS_ERROR_CODE_INVALID_ARGUMENT
+	case codes.AlreadyExists:
+		code = pb.FSErrorCode_FS_ERROR_CODE_FILE_EXISTS
+	case codes.Unauthenticated:
+		code = pb.FSErrorCode_FS_ERROR_CODE_SESSION_EXPIRED
+	}
+
+	// Prefer the detailed error attached by fsErrorf
+	for _, detail := range st.Details() {
+		if fsErr, ok := detail.(*pb.FSError); ok {
+			if fsErr.Fd == 0 {
+				fsErr.Fd = fd
+			}
+			return fsErr
+		}
+	}
+
+	return &pb.FSError{
+		Code:    code,
+		Message: st.Message(),
+		Fd:      fd,
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+)
+
+func TestIo_PipelinedOperations(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if err := writeTestFile(ctx, client, sessionResp.SessionId, "/io.txt", ""); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      "/io.txt",
+		Mode:      pb.OpenMode_OPEN_MODE_RDWR,
+		SessionId: sessionResp.SessionId,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+
+	stream, err := client.Io(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start Io: %v", err)
+	}
+
+	// Send everything up front without waiting for replies
+	requests := []*pb.IoRequest{
+		{Tag: 1, Op: &pb.IoRequest_Attach{Attach: &pb.IoAttach{Fd: openResp.Fd, SessionId: openResp.SessionId}}},
+		{Tag: 2, Op: &pb.IoRequest_Write{Write: &pb.IoWrite{Offset: -1, Data: []byte("hello, ")}}},
+		{Tag: 3, Op: &pb.IoRequest_Write{Write: &pb.IoWrite{Offset: -1, Data: []byte("world")}}},
+		{Tag: 4, Op: &pb.IoRequest_Seek{Seek: &pb.SeekRequest{Offset: 0, Whence: pb.SeekWhence_SEEK_WHENCE_SET}}},
+		{Tag: 5, Op: &pb.IoRequest_Read{Read: &pb.IoRead{Offset: -1, Count: 5}}},
+		{Tag: 6, Op: &pb.IoRequest_Read{Read: &pb.IoRead{Offset: 7, Count: 100}}},
+	}
+	for _, req := range requests {
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("Failed to send tag %d: %v", req.Tag, err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("Failed to close send: %v", err)
+	}
+
+	replies := make(map[uint32]*pb.IoResponse)
+	for range requests {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive reply: %v", err)
+		}
+		if resp.GetError() != nil {
+			t.Fatalf("Tag %d failed: %v", resp.Tag, resp.GetError())
+		}
+		replies[resp.Tag] = resp
+	}
+
+	if got := string(replies[5].GetRead().Data); got != "hello" {
+		t.Errorf("Tag 5: Expected %q, Got: %q", "hello", got)
+	}
+	if read := replies[6].GetRead(); string(read.Data) != "world" || !read.Eof {
+		t.Errorf("Tag 6: Expected %q at EOF, Got: %q (eof=%v)", "world", read.Data, read.Eof)
+	}
+}
+
+func TestIo_PipeReadAndFlush(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if err := storage.Create("/fifo", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_PIPE,
+		Mode:  0666,
+		Owner: "testuser",
+		Group: "testgroup",
+	}); err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      "/fifo",
+		Mode:      pb.OpenMode_OPEN_MODE_RDWR,
+		SessionId: sessionResp.SessionId,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open pipe: %v", err)
+	}
+
+	stream, err := client.Io(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start Io: %v", err)
+	}
+
+	send := func(req *pb.IoRequest) {
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("Failed to send tag %d: %v", req.Tag, err)
+		}
+	}
+	recv := func() *pb.IoResponse {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive reply: %v", err)
+		}
+		return resp
+	}
+
+	send(&pb.IoRequest{Tag: 1, Op: &pb.IoRequest_Attach{Attach: &pb.IoAttach{Fd: openResp.Fd, SessionId: openResp.SessionId}}})
+	recv()
+
+	// A read on an empty pipe blocks without holding up the write behind it
+	send(&pb.IoRequest{Tag: 2, Op: &pb.IoRequest_Read{Read: &pb.IoRead{Count: 64}}})
+	send(&pb.IoRequest{Tag: 3, Op: &pb.IoRequest_Write{Write: &pb.IoWrite{Data: []byte("ping")}}})
+
+	replies := map[uint32]*pb.IoResponse{}
+	for len(replies) < 2 {
+		resp := recv()
+		replies[resp.Tag] = resp
+	}
+	if got := string(replies[2].GetRead().GetData()); got != "ping" {
+		t.Errorf("Expected pipe read to return %q, got: %q", "ping", got)
+	}
+
+	// A flushed read is answered only by the flush
+	send(&pb.IoRequest{Tag: 4, Op: &pb.IoRequest_Read{Read: &pb.IoRead{Count: 64}}})
+	send(&pb.IoRequest{Tag: 5, Op: &pb.IoRequest_Flush{Flush: &pb.IoFlush{OldTag: 4}}})
+	if resp := recv(); resp.Tag != 5 || resp.GetFlush() == nil {
+		t.Errorf("Expected flush reply for tag 5, got: %v", resp)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	errTooManySessions = errors.New("too many sessions")
+	errTooManyFiles    = errors.New("too many open files")
+)
+
+// SessionLimits caps what one user or session may hold; 0 is unlimited
+type SessionLimits struct {
+	SessionsPerUser   int   // Open sessions per user; capability sessions count for their issuer
+	FDsPerSession     int   // Open file descriptors per session
+	StreamsPerSession int   // Concurrent streaming RPCs per session
+	BytesPerSecond    int64 // Message bytes per session, in both directions
+}
+
+// LimitStats counts how often the session limits were hit
+type LimitStats struct {
+	SessionsRejected uint64
+	FDsRejected      uint64
+	StreamsRejected  uint64
+	Throttled        uint64        // Messages delayed by the byte rate
+	ThrottledTime    time.Duration // Total delay
+}
+
+// limitCounters accumulates LimitStats
+type limitCounters struct {
+	sessions  atomic.Uint64
+	fds       atomic.Uint64
+	streams   atomic.Uint64
+	throttled atomic.Uint64
+	delay     atomic.Int64
+}
+
+// LimitStats returns the limit counters
+func (sm *SessionManager) LimitStats() LimitStats {
+	return LimitStats{
+		SessionsRejected: sm.hits.sessions.Load(),
+		FDsRejected:      sm.hits.fds.Load(),
+		StreamsRejected:  sm.hits.streams.Load(),
+		Throttled:        sm.hits.throttled.Load(),
+		ThrottledTime:    time.Duration(sm.hits.delay.Load()),
+	}
+}
+
+// LogLimitStatsEvery logs the limit hits periodically, whenever there were
+// any, until stop is closed
+func (sm *SessionManager) LogLimitStatsEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last LimitStats
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			stats := sm.LimitStats()
+			if stats != last {
+				log.Printf("Session limits: %d sessions, %d FDs and %d streams rejected, %d messages throttled for %v",
+					stats.SessionsRejected-last.SessionsRejected,
+					stats.FDsRejected-last.FDsRejected,
+					stats.StreamsRejected-last.StreamsRejected,
+					stats.Throttled-last.Throttled,
+					stats.ThrottledTime-last.ThrottledTime)
+			}
+			last = stats
+		}
+	}
+}
+
+// rateLimiter is a token bucket holding up to one second of bytes. A
+// message larger than what is available is let through and leaves the
+// bucket in debt, so later messages wait for it.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n bytes and returns how long to wait before using them
+func (r *rateLimiter) reserve(n int) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.tokens = min(r.tokens+now.Sub(r.last).Seconds()*r.rate, r.rate)
+	r.last = now
+	r.tokens -= float64(n)
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// throttle waits until the session may move msg, if it has a byte rate
+func (sm *SessionManager) throttle(ctx context.Context, session *Session, msg any) error {
+	if session.rate == nil {
+		return nil
+	}
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return nil
+	}
+
+	delay := session.rate.reserve(proto.Size(m))
+	if delay == 0 {
+		return nil
+	}
+	sm.hits.throttled.Add(1)
+	sm.hits.delay.Add(int64(delay))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// acquireStream counts a stream against the session's limit
+func (sm *SessionManager) acquireStream(session *Session) error {
+	limit := sm.limits.StreamsPerSession
+	if n := session.streams.Add(1); limit > 0 && int(n) > limit {
+		session.streams.Add(-1)
+		sm.hits.streams.Add(1)
+		return status.Errorf(codes.ResourceExhausted, "too many concurrent streams in session %s (limit %d)", session.ID, limit)
+	}
+	return nil
+}
+
+// requestSession returns the session a request names, or nil if it names
+// none
+func (s *Plan92ServiceImpl) requestSession(msg any) *Session {
+	var session *Session
+	switch m := msg.(type) {
+	case interface{ GetSessionId() string }:
+		session, _ = s.sessions.Get(m.GetSessionId())
+	case *pb.WriteRequest:
+		if metadata := m.GetMetadata(); metadata != nil {
+			session, _ = s.sessions.Get(metadata.SessionId)
+		}
+	case *pb.IoRequest:
+		if attach := m.GetAttach(); attach != nil {
+			session, _ = s.sessions.Get(attach.SessionId)
+		}
+	case *pb.StdioRequest:
+		if attach := m.GetAttach(); attach != nil {
+			session, _ = s.sessions.Get(attach.SessionId)
+		}
+	case *pb.UploadRequest:
+		if metadata := m.GetMetadata(); metadata != nil {
+			session, _ = s.sessions.Get(metadata.SessionId)
+		}
+	}
+	return session
+}
+
+// UnaryLimitInterceptor applies the session byte rate to unary requests
+// and their responses
+func (s *Plan92ServiceImpl) UnaryLimitInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		session := s.requestSession(req)
+		if session == nil {
+			return handler(ctx, req)
+		}
+
+		if err := s.sessions.throttle(ctx, session, req); err != nil {
+			return nil, err
+		}
+		resp, err := handler(ctx, req)
+		if err == nil {
+			if err := s.sessions.throttle(ctx, session, resp); err != nil {
+				return nil, err
+			}
+		}
+		return resp, err
+	}
+}
+
+// StreamLimitInterceptor counts streams against their session's limit and
+// applies the session byte rate to every message. A stream belongs to the
+// session named by its first request.
+func (s *Plan92ServiceImpl) StreamLimitInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		stream := &limitedStream{ServerStream: ss, s: s}
+		err := handler(srv, stream)
+		if stream.session != nil {
+			stream.session.streams.Add(-1)
+		}
+
+		// Handlers wrap receive errors; report the limit itself
+		if stream.rejected != nil {
+			return stream.rejected
+		}
+		return err
+	}
+}
+
+// limitedStream enforces the session limits on a server stream
+type limitedStream struct {
+	grpc.ServerStream
+	s        *Plan92ServiceImpl
+	resolved bool
+	session  *Session // Session the stream counts against, once known
+	rejected error    // Set when the stream was refused
+}
+
+func (l *limitedStream) RecvMsg(m any) error {
+	if err := l.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if !l.resolved {
+		l.resolved = true
+		session := l.s.requestSession(m)
+		if session == nil {
+			return nil
+		}
+		if err := l.s.sessions.acquireStream(session); err != nil {
+			l.rejected = err
+			return err
+		}
+		l.session = session
+	}
+
+	if l.session == nil {
+		return nil
+	}
+	return l.s.sessions.throttle(l.Context(), l.session, m)
+}
+
+func (l *limitedStream) SendMsg(m any) error {
+	if l.session != nil {
+		if err := l.s.sessions.throttle(l.Context(), l.session, m); err != nil {
+			return err
+		}
+	}
+	return l.ServerStream.SendMsg(m)
+}
+
+// limitError converts a session or FD limit error, or the error of a
+// closed session, to a status error
+func limitError(err error) error {
+	if errors.Is(err, errTooManyFiles) {
+		return fsErrorf(codes.ResourceExhausted, pb.FSErrorCode_FS_ERROR_CODE_TOO_MANY_FILES, "%v", err)
+	}
+	if errors.Is(err, errTooManySessions) {
+		return status.Errorf(codes.ResourceExhausted, "%v", err)
+	}
+	if errors.Is(err, errSessionClosed) {
+		return status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+	return status.Errorf(codes.Internal, "%v", err)
+}
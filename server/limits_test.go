@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// setupLimitedServer starts a test server that enforces limits through
+// the interceptors and returns a client for it
+func setupLimitedServer(t *testing.T, limits SessionLimits) (pb.Plan92Client, *SessionManager, *MemoryStorage) {
+	t.Helper()
+	lis := bufconn.Listen(bufSize)
+
+	storage := NewMemoryStorage()
+	sessions := NewSessionManager()
+	sessions.limits = limits
+
+	inodeService := NewInodeService(storage, sessions)
+	plan92Service := NewPlan92Service(storage, sessions, inodeService)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(plan92Service.UnaryLimitInterceptor()),
+		grpc.ChainStreamInterceptor(plan92Service.StreamLimitInterceptor()),
+	)
+	pb.RegisterPlan92Server(server, plan92Service)
+
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return client, sessions, storage
+}
+
+func TestLimits_SessionsAndFDs(t *testing.T) {
+	client, sessions, storage := setupLimitedServer(t, SessionLimits{SessionsPerUser: 2, FDsPerSession: 2})
+	ctx := context.Background()
+
+	var ids []string
+	for range 2 {
+		resp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice"})
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		ids = append(ids, resp.SessionId)
+	}
+	if _, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice"}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted for a third session, got: %v", err)
+	}
+	if _, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "bob"}); err != nil {
+		t.Errorf("Expected another user's session to be allowed, got: %v", err)
+	}
+	if _, err := client.CloseSession(ctx, &pb.CloseSessionRequest{SessionId: ids[1]}); err != nil {
+		t.Fatalf("Failed to close session: %v", err)
+	}
+	if _, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice"}); err != nil {
+		t.Errorf("Expected a closed session to free its slot, got: %v", err)
+	}
+
+	// The third open is refused before its file is created
+	open := func(filePath string) (*pb.FileStatus, error) {
+		return client.Open(ctx, &pb.OpenRequest{Path: filePath, Mode: pb.OpenMode_OPEN_MODE_WRITE, SessionId: ids[0]})
+	}
+	first, err := open("/a.txt")
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if _, err := open("/b.txt"); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if _, err := open("/c.txt"); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_TOO_MANY_FILES {
+		t.Errorf("Expected TOO_MANY_FILES, got: %v", err)
+	}
+	if storage.Exists("/c.txt") {
+		t.Errorf("Expected the refused open not to create its file")
+	}
+	if _, err := client.Close(ctx, &pb.CloseRequest{Fd: first.Fd, SessionId: first.SessionId}); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if _, err := open("/c.txt"); err != nil {
+		t.Errorf("Expected a closed FD to free its slot, got: %v", err)
+	}
+
+	if stats := sessions.LimitStats(); stats.SessionsRejected != 1 || stats.FDsRejected != 1 {
+		t.Errorf("Expected 1 session and 1 FD rejection, got: %+v", stats)
+	}
+}
+
+func TestLimits_StreamsAndRate(t *testing.T) {
+	client, sessions, _ := setupLimitedServer(t, SessionLimits{StreamsPerSession: 1, BytesPerSecond: 20000})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	session, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	// 30000 bytes at 20000 bytes/s is held back for about half a second
+	start := time.Now()
+	if err := writeTestFile(ctx, client, session.SessionId, "/a.txt", strings.Repeat("a", 30000)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Expected the write to be throttled, took %v", elapsed)
+	}
+	if stats := sessions.LimitStats(); stats.Throttled == 0 || stats.ThrottledTime == 0 {
+		t.Errorf("Expected throttling in the stats, got: %+v", stats)
+	}
+
+	// An attached Io stream holds the session's only stream slot
+	opened, err := client.Open(ctx, &pb.OpenRequest{Path: "/a.txt", Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: session.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	io, err := client.Io(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start Io: %v", err)
+	}
+	if err := io.Send(&pb.IoRequest{Tag: 1, Op: &pb.IoRequest_Attach{Attach: &pb.IoAttach{Fd: opened.Fd, SessionId: opened.SessionId}}}); err != nil {
+		t.Fatalf("Failed to attach: %v", err)
+	}
+	if _, err := io.Recv(); err != nil {
+		t.Fatalf("Failed to receive attach reply: %v", err)
+	}
+
+	read, err := client.Read(ctx, &pb.ReadRequest{Fd: opened.Fd, SessionId: opened.SessionId, Count: 1})
+	if err == nil {
+		_, err = read.Recv()
+	}
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted for a second stream, got: %v", err)
+	}
+
+	// Ending the Io stream frees the slot
+	io.CloseSend()
+	for {
+		if _, err := io.Recv(); err != nil {
+			break
+		}
+	}
+	read, err = client.Read(ctx, &pb.ReadRequest{Fd: opened.Fd, SessionId: opened.SessionId, Count: 1})
+	if err == nil {
+		_, err = read.Recv()
+	}
+	if err != nil {
+		t.Errorf("Expected a read once the Io stream ended, got: %v", err)
+	}
+	if stats := sessions.LimitStats(); stats.StreamsRejected != 1 {
+		t.Errorf("Expected 1 stream rejection, got: %+v", stats)
+	}
+}
@@ -34,17 +34,63 @@ func main() {
 
 	log.Printf("Plan92 server starting on port %s...", port)
 
+	// Load tunables from the environment
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
 	// Initialize storage and session manager
 	storage := NewMemoryStorage()
 	sessions := NewSessionManager()
-
-	// Create gRPC server
-	server := grpc.NewServer()
+	sessions.limits = cfg.SessionLimits()
 
 	// Create and register services
 	inodeService := NewInodeService(storage, sessions)
 	plan92Service := NewPlan92Service(storage, sessions, inodeService)
 
+	// Create gRPC server, enforcing the session limits on every call
+	server := grpc.NewServer(append(cfg.ServerOptions(),
+		grpc.ChainUnaryInterceptor(plan92Service.UnaryLimitInterceptor()),
+		grpc.ChainStreamInterceptor(plan92Service.StreamLimitInterceptor()),
+	)...)
+
+	plan92Service.config = cfg
+	inodeService.capabilities = NewCapabilityManager(cfg.CapabilityKey)
+	inodeService.permChecker.superuser = cfg.Superuser
+	inodeService.permChecker.adminGroup = cfg.AdminGroup
+	storage.SetMaxFileSize(int64(cfg.MaxFileSize))
+	storage.SetCapacity(int64(cfg.StorageCapacity), int64(cfg.StorageInodes))
+
+	// Record security-relevant operations
+	if cfg.AuditLog != "" {
+		auditLog, err := OpenAuditLog(cfg.AuditLog, int64(cfg.AuditMaxSize), cfg.AuditKeep)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		inodeService.audit = auditLog
+	}
+
+	// Load custom authorization rules and pick up edits while running
+	if cfg.PolicyFile != "" {
+		policy, err := LoadPolicyFile(cfg.PolicyFile)
+		if err != nil {
+			log.Fatalf("Failed to load policy: %v", err)
+		}
+		inodeService.authorizer = policy
+		go policy.ReloadEvery(policyReloadInterval, nil)
+	}
+
+	// Discard abandoned uploads and expired capabilities in the background
+	go plan92Service.uploads.CollectEvery(cfg.UploadTTL/4, nil)
+	go inodeService.capabilities.CollectEvery(time.Hour, nil)
+
+	// Report how well the permission cache is doing
+	go inodeService.permChecker.LogCacheStatsEvery(time.Minute, nil)
+
+	// Report how often sessions run into their limits
+	go sessions.LogLimitStatsEvery(time.Minute, nil)
+
 	pb.RegisterPlan92Server(server, plan92Service)
 	pb.RegisterInodeServiceServer(server, inodeService)
 
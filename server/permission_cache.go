@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"path"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// permissionCacheMax bounds the directories one session's cache
+	// remembers; a full cache starts over
+	permissionCacheMax = 4096
+)
+
+// traversal is a cached decision that a session may search every
+// directory from the root down to a path prefix
+type traversal struct {
+	versions   []uint64 // Metadata versions of the directories, root first
+	generation uint64   // Storage generation they were last confirmed at
+}
+
+// PermissionCache remembers which directories a session may traverse, so
+// an Open does not have to check every path component again. Entries are
+// keyed by path prefix and hold the metadata versions of the directories
+// they were decided from: when any of them is changed, removed or
+// replaced, the entry no longer matches and the path is walked again.
+type PermissionCache struct {
+	mu      sync.Mutex
+	entries map[string]*traversal
+}
+
+// NewPermissionCache creates an empty permission cache
+func NewPermissionCache() *PermissionCache {
+	return &PermissionCache{
+		entries: make(map[string]*traversal),
+	}
+}
+
+// lookup returns the versions of the directories down to dir if the
+// session was allowed to traverse them and none has changed since. While
+// the storage generation is unchanged the entry is trusted as is;
+// otherwise its versions are compared against storage under one lock.
+func (c *PermissionCache) lookup(storage *MemoryStorage, dir string) ([]uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.entries[dir]
+	if !exists {
+		return nil, false
+	}
+
+	generation := storage.Generation()
+	if entry.generation != generation {
+		if !slices.Equal(storage.Versions(prefixes(dir)), entry.versions) {
+			delete(c.entries, dir)
+			return nil, false
+		}
+		entry.generation = generation
+	}
+
+	return entry.versions, true
+}
+
+// store records that the directories down to dir, with the given versions,
+// may be traversed, as checked at storage generation
+func (c *PermissionCache) store(dir string, versions []uint64, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= permissionCacheMax {
+		clear(c.entries)
+	}
+	c.entries[dir] = &traversal{versions: slices.Clip(versions), generation: generation}
+}
+
+// Len returns the number of cached directories
+func (c *PermissionCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+// CacheStats counts permission cache lookups across all sessions
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// HitRate returns the fraction of lookups served from the cache
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// cacheCounters accumulates CacheStats
+type cacheCounters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// CacheStats returns the permission cache counters
+func (pc *PermissionChecker) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:   pc.cache.hits.Load(),
+		Misses: pc.cache.misses.Load(),
+	}
+}
+
+// LogCacheStatsEvery logs the permission cache hit rate periodically,
+// whenever there were lookups, until stop is closed
+func (pc *PermissionChecker) LogCacheStatsEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last CacheStats
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			stats := pc.CacheStats()
+			recent := CacheStats{Hits: stats.Hits - last.Hits, Misses: stats.Misses - last.Misses}
+			if recent.Hits+recent.Misses > 0 {
+				log.Printf("Permission cache: %d hits, %d misses (%.1f%% hit rate)",
+					recent.Hits, recent.Misses, 100*recent.HitRate())
+			}
+			last = stats
+		}
+	}
+}
+
+// prefixes returns the paths of every directory from the root down to dir,
+// excluding the root itself
+func prefixes(dir string) []string {
+	components := splitPath(dir)
+	paths := make([]string, len(components))
+	current := "/"
+	for i, component := range components {
+		current = path.Join(current, component)
+		paths[i] = current
+	}
+	return paths
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+)
+
+// createDeepTree creates directories /d0/d1/.../d<depth-1> owned by alice
+// and returns the deepest one
+func createDeepTree(tb testing.TB, storage *MemoryStorage, depth int) string {
+	dir := ""
+	for i := range depth {
+		dir += fmt.Sprintf("/d%d", i)
+		if err := storage.Create(dir, &pb.FileInfo{
+			Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+			Mode:  0755,
+			Owner: "alice",
+			Group: "users",
+		}); err != nil {
+			tb.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	return dir
+}
+
+func TestPermissionCache_Invalidation(t *testing.T) {
+	storage := NewMemoryStorage()
+	pc := NewPermissionChecker(storage)
+	cache := NewPermissionCache()
+
+	deep := createDeepTree(t, storage, 6)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := storage.Create(deep+"/"+name, &pb.FileInfo{
+			Type:  pb.FileType_FILE_TYPE_REGULAR,
+			Mode:  0644,
+			Owner: "alice",
+			Group: "users",
+		}); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	check := func(name string) error {
+		return pc.CheckCachedPathPermissions(cache, deep+"/"+name, pb.OpenMode_OPEN_MODE_READ, "bob", []string{"others"})
+	}
+
+	// The first open walks the path, later ones in the tree hit the cache
+	for _, name := range []string{"a.txt", "b.txt", "a.txt"} {
+		if err := check(name); err != nil {
+			t.Fatalf("Expected access to %s, got: %v", name, err)
+		}
+	}
+	if stats := pc.CacheStats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("Expected 2 hits and 1 miss, got: %+v", stats)
+	}
+	if cache.Len() != 6 {
+		t.Errorf("Expected every directory to be cached, got %d entries", cache.Len())
+	}
+
+	// Writing a file leaves the directories alone
+	data, _ := storage.Get(deep + "/a.txt")
+	storage.WriteAt(data, []byte("x"), 0)
+	if err := check("a.txt"); err != nil {
+		t.Fatalf("Expected access after a write, got: %v", err)
+	}
+
+	// Changing an unrelated file moves the generation, but the entry is
+	// revalidated rather than dropped
+	if _, err := storage.UpdateInfo(data, func(info *pb.FileInfo) error {
+		info.Mode = 0600
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to update info: %v", err)
+	}
+	if err := check("b.txt"); err != nil {
+		t.Fatalf("Expected access after an unrelated change, got: %v", err)
+	}
+	if stats := pc.CacheStats(); stats.Misses != 1 {
+		t.Errorf("Expected an unrelated change to keep the entry, got: %+v", stats)
+	}
+
+	// Changing the mode of an ancestor takes effect immediately
+	ancestor, _ := storage.Get("/d0/d1")
+	if _, err := storage.UpdateInfo(ancestor, func(info *pb.FileInfo) error {
+		info.Mode = 0700
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to update info: %v", err)
+	}
+	if err := check("b.txt"); err == nil || !strings.Contains(err.Error(), "/d0/d1") {
+		t.Errorf("Expected traversal of /d0/d1 to be denied, got: %v", err)
+	}
+
+	// As does removing an ancestor
+	if _, err := storage.UpdateInfo(ancestor, func(info *pb.FileInfo) error {
+		info.Mode = 0755
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to update info: %v", err)
+	}
+	if err := check("b.txt"); err != nil {
+		t.Fatalf("Expected access after restoring the mode, got: %v", err)
+	}
+	if _, err := storage.Unlink("/d0/d1/d2/d3"); err != nil {
+		t.Fatalf("Failed to unlink: %v", err)
+	}
+	if err := check("b.txt"); err == nil || !strings.Contains(err.Error(), "no such file or directory") {
+		t.Errorf("Expected a removed ancestor to be missing, got: %v", err)
+	}
+}
+
+func BenchmarkCheckPathPermissions_Deep(b *testing.B) {
+	for _, depth := range []int{4, 16, 64} {
+		storage := NewMemoryStorage()
+		pc := NewPermissionChecker(storage)
+		filePath := createDeepTree(b, storage, depth) + "/file.txt"
+		if err := storage.Create(filePath, &pb.FileInfo{
+			Type:  pb.FileType_FILE_TYPE_REGULAR,
+			Mode:  0644,
+			Owner: "alice",
+			Group: "users",
+		}); err != nil {
+			b.Fatalf("Failed to create file: %v", err)
+		}
+
+		for _, cached := range []bool{false, true} {
+			var cache *PermissionCache
+			if cached {
+				cache = NewPermissionCache()
+			}
+			b.Run(fmt.Sprintf("depth=%d/cached=%v", depth, cached), func(b *testing.B) {
+				for b.Loop() {
+					err := pc.CheckCachedPathPermissions(cache, filePath, pb.OpenMode_OPEN_MODE_READ, "bob", []string{"others"})
+					if err != nil {
+						b.Fatalf("Permission check failed: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
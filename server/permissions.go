@@ -3,23 +3,47 @@ package main
 import (
 	"fmt"
 	"path"
+	"slices"
 	"strings"
 
 	pb "github.com/accretional/plan92/gen/plan92/v1"
 )
 
+const (
+	// modeSetuid on a file runs it as its owner
+	modeSetuid = 04000
+
+	// modeSetgid on a directory gives new entries the directory's group
+	modeSetgid = 02000
+
+	// modeSticky restricts removal of directory entries to their owners
+	modeSticky = 01000
+)
+
 // PermissionChecker handles hierarchical permission validation
 type PermissionChecker struct {
-	storage *MemoryStorage
+	storage    *MemoryStorage
+	superuser  string // User that bypasses discretionary checks; "" for none
+	adminGroup string // Group whose members do the same; "" for none
+	cache      cacheCounters
 }
 
-// NewPermissionChecker creates a new permission checker
+// NewPermissionChecker creates a new permission checker with no
+// privileged users
 func NewPermissionChecker(storage *MemoryStorage) *PermissionChecker {
 	return &PermissionChecker{
 		storage: storage,
 	}
 }
 
+// IsPrivileged reports whether user is the superuser or in the admin
+// group. Privileged users bypass all discretionary checks except that
+// files without any execute bit cannot be executed.
+func (pc *PermissionChecker) IsPrivileged(user string, groups []string) bool {
+	return (pc.superuser != "" && user == pc.superuser) ||
+		(pc.adminGroup != "" && slices.Contains(groups, pc.adminGroup))
+}
+
 // CheckPathPermissions validates permissions for each component in the path
 // Returns error if any component denies access
 func (pc *PermissionChecker) CheckPathPermissions(
@@ -27,54 +51,220 @@ func (pc *PermissionChecker) CheckPathPermissions(
 	mode pb.OpenMode,
 	user string,
 	groups []string,
+) error {
+	return pc.CheckCachedPathPermissions(nil, filePath, mode, user, groups)
+}
+
+// CheckCachedPathPermissions is CheckPathPermissions for a session with a
+// permission cache, which spares the walk over directories it has already
+// traversed. A nil cache checks every component.
+func (pc *PermissionChecker) CheckCachedPathPermissions(
+	cache *PermissionCache,
+	filePath string,
+	mode pb.OpenMode,
+	user string,
+	groups []string,
 ) error {
 	// Clean and normalize path
 	filePath = path.Clean(filePath)
+	if filePath == "/" {
+		return nil
+	}
 
-	// Split path into components
-	components := splitPath(filePath)
+	// Need execute permission to traverse directories
+	if err := pc.traverse(cache, path.Dir(filePath), user, groups); err != nil {
+		return err
+	}
 
-	// Check permissions for each component
-	currentPath := ""
-	for i, component := range components {
-		if currentPath == "" {
-			currentPath = "/" + component
-		} else {
-			currentPath = path.Join(currentPath, component)
+	// Final component - check read/write/exec permissions
+	info, err := pc.storage.GetInfo(filePath)
+	if err != nil {
+		// If file doesn't exist, check parent directory write permission
+		// for create
+		if mode == pb.OpenMode_OPEN_MODE_WRITE {
+			// For now, allow creation
+			return nil
 		}
+		return fmt.Errorf("no such file or directory: %s", filePath)
+	}
+	if err := pc.checkFilePermission(info, mode, user, groups); err != nil {
+		return fmt.Errorf("permission denied for %s: %v", filePath, err)
+	}
+
+	return nil
+}
 
-		// Check if this is the final component
-		isFinal := (i == len(components)-1)
+// traverse checks that every directory from the root down to dir exists
+// and may be searched by the user. With a cache, it starts below the
+// deepest directory already known to be traversable and records the
+// directories it checks.
+func (pc *PermissionChecker) traverse(
+	cache *PermissionCache,
+	dir string,
+	user string,
+	groups []string,
+) error {
+	if dir == "/" {
+		return nil
+	}
 
-		// Get file info from storage
-		data, err := pc.storage.Get(currentPath)
-		if err != nil {
-			// If file doesn't exist and this is the final component,
-			// check parent directory write permission for create
-			if isFinal && mode == pb.OpenMode_OPEN_MODE_WRITE {
-				// For now, allow creation
-				return nil
+	// Read before the lookups, so a change racing with them makes the
+	// stored entries revalidate
+	generation := pc.storage.Generation()
+
+	if cache != nil {
+		if _, ok := cache.lookup(pc.storage, dir); ok {
+			pc.cache.hits.Add(1)
+			return nil
+		}
+		pc.cache.misses.Add(1)
+	}
+
+	paths := prefixes(dir)
+	var versions []uint64
+	if cache != nil {
+		for i := len(paths) - 1; i > 0; i-- {
+			if cached, ok := cache.lookup(pc.storage, paths[i-1]); ok {
+				versions = cached
+				break
 			}
+		}
+	}
+
+	for _, currentPath := range paths[len(versions):] {
+		info, version, err := pc.storage.Lookup(currentPath)
+		if err != nil {
 			return fmt.Errorf("no such file or directory: %s", currentPath)
 		}
+		if info.Type != pb.FileType_FILE_TYPE_DIRECTORY {
+			return fmt.Errorf("not a directory: %s", currentPath)
+		}
+		if !pc.hasExecutePermission(info, user, groups) {
+			return fmt.Errorf("permission denied (no execute) for directory: %s", currentPath)
+		}
 
-		// Check permissions based on mode and position in path
-		if isFinal {
-			// Final component - check read/write/exec permissions
-			if err := pc.checkFilePermission(data.Info, mode, user, groups); err != nil {
-				return fmt.Errorf("permission denied for %s: %v", currentPath, err)
-			}
-		} else {
-			// Intermediate component - must be a directory and have execute permission
-			if data.Info.Type != pb.FileType_FILE_TYPE_DIRECTORY {
-				return fmt.Errorf("not a directory: %s", currentPath)
-			}
+		versions = append(versions, version)
+		if cache != nil {
+			cache.store(currentPath, versions, generation)
+		}
+	}
 
-			// Need execute permission to traverse directories
-			if !pc.hasExecutePermission(data.Info, user, groups) {
-				return fmt.Errorf("permission denied (no execute) for directory: %s", currentPath)
-			}
+	return nil
+}
+
+// CheckCapabilityPermissions validates access to filePath through a
+// capability instead of an identity. The capability must cover the path
+// and grant the right mode needs: CREATE for a file that does not exist
+// yet, LIST to read a directory, READ or WRITE otherwise. The issuer, with
+// the groups it held when minting, must also be allowed the access today,
+// so a capability never reaches further than its issuer: minting checks
+// only the root of a subtree, and permissions may change after minting.
+func (pc *PermissionChecker) CheckCapabilityPermissions(
+	c *Capability,
+	filePath string,
+	mode pb.OpenMode,
+) error {
+	filePath = path.Clean(filePath)
+	if !c.Covers(filePath) {
+		return fmt.Errorf("capability does not cover %s", filePath)
+	}
+
+	var rights []pb.CapabilityRight
+	info, err := pc.storage.GetInfo(filePath)
+	switch {
+	case err != nil && (mode == pb.OpenMode_OPEN_MODE_WRITE || mode == pb.OpenMode_OPEN_MODE_TRUNC):
+		rights = []pb.CapabilityRight{pb.CapabilityRight_CAPABILITY_RIGHT_CREATE}
+	case err != nil:
+		return fmt.Errorf("no such file or directory: %s", filePath)
+	case info.Type == pb.FileType_FILE_TYPE_DIRECTORY && !isWritable(mode):
+		rights = []pb.CapabilityRight{pb.CapabilityRight_CAPABILITY_RIGHT_LIST}
+	default:
+		if isReadable(mode) || mode == pb.OpenMode_OPEN_MODE_EXEC {
+			rights = append(rights, pb.CapabilityRight_CAPABILITY_RIGHT_READ)
 		}
+		if isWritable(mode) {
+			rights = append(rights, pb.CapabilityRight_CAPABILITY_RIGHT_WRITE)
+		}
+	}
+
+	for _, right := range rights {
+		if !c.Grants(right) {
+			return fmt.Errorf("capability does not grant %s on %s", capabilityRightName(right), filePath)
+		}
+	}
+
+	issuerMode := mode
+	if err != nil {
+		issuerMode = pb.OpenMode_OPEN_MODE_WRITE
+	}
+	if err := pc.CheckPathPermissions(filePath, issuerMode, c.Issuer, c.IssuerGroups); err != nil {
+		return fmt.Errorf("issuer %s: %v", c.Issuer, err)
+	}
+
+	return nil
+}
+
+// CheckCapabilityRemovePermission validates removing the entry at filePath
+// through a capability. Removal changes the parent directory, so the
+// capability must cover the parent and grant WRITE, and its issuer must be
+// allowed the removal today.
+func (pc *PermissionChecker) CheckCapabilityRemovePermission(c *Capability, filePath string) error {
+	parentPath := path.Dir(path.Clean(filePath))
+	if !c.Covers(parentPath) {
+		return fmt.Errorf("capability does not cover %s", parentPath)
+	}
+	if !c.Grants(pb.CapabilityRight_CAPABILITY_RIGHT_WRITE) {
+		return fmt.Errorf("capability does not grant %s on %s",
+			capabilityRightName(pb.CapabilityRight_CAPABILITY_RIGHT_WRITE), parentPath)
+	}
+
+	if err := pc.CheckRemovePermission(filePath, c.Issuer, c.IssuerGroups); err != nil {
+		return fmt.Errorf("issuer %s: %v", c.Issuer, err)
+	}
+
+	return nil
+}
+
+// CheckRemovePermission validates that the user may unlink the entry at
+// filePath: every ancestor must be traversable, the parent directory must
+// be writable, and in a sticky directory the user must own the entry or
+// the directory
+func (pc *PermissionChecker) CheckRemovePermission(
+	filePath string,
+	user string,
+	groups []string,
+) error {
+	filePath = path.Clean(filePath)
+	if filePath == "/" {
+		return fmt.Errorf("cannot remove the root directory")
+	}
+
+	target, err := pc.storage.GetInfo(filePath)
+	if err != nil {
+		return fmt.Errorf("no such file or directory: %s", filePath)
+	}
+
+	parentPath := path.Dir(filePath)
+
+	// Walk the ancestors of the parent, requiring execute on each
+	if err := pc.traverse(nil, parentPath, user, groups); err != nil {
+		return err
+	}
+
+	// The root directory has no inode; like creation, removal there is allowed
+	parent, err := pc.storage.GetInfo(parentPath)
+	if err != nil {
+		return nil
+	}
+
+	if !pc.hasWritePermission(parent, user, groups) {
+		return fmt.Errorf("permission denied (no write) for directory: %s", parentPath)
+	}
+
+	if parent.Mode&modeSticky != 0 &&
+		target.Owner != user && parent.Owner != user &&
+		!pc.IsPrivileged(user, groups) {
+		return fmt.Errorf("permission denied (sticky directory) for %s", filePath)
 	}
 
 	return nil
@@ -103,6 +293,10 @@ func (pc *PermissionChecker) checkFilePermission(
 		if !pc.hasWritePermission(info, user, groups) {
 			return fmt.Errorf("no write permission")
 		}
+		// A single ACL group entry must grant both
+		if !pc.IsPrivileged(user, groups) && !aclAllows(info, aclRead|aclWrite, user, groups) {
+			return fmt.Errorf("no read/write permission")
+		}
 	case pb.OpenMode_OPEN_MODE_EXEC:
 		if !pc.hasExecutePermission(info, user, groups) {
 			return fmt.Errorf("no execute permission")
@@ -118,20 +312,7 @@ func (pc *PermissionChecker) hasReadPermission(
 	user string,
 	groups []string,
 ) bool {
-	// Owner permissions (bits 8-6)
-	if info.Owner == user {
-		return (info.Mode & 0400) != 0 // Owner read bit
-	}
-
-	// Group permissions (bits 5-3)
-	for _, group := range groups {
-		if info.Group == group {
-			return (info.Mode & 0040) != 0 // Group read bit
-		}
-	}
-
-	// Other permissions (bits 2-0)
-	return (info.Mode & 0004) != 0 // Other read bit
+	return pc.IsPrivileged(user, groups) || aclAllows(info, aclRead, user, groups)
 }
 
 // hasWritePermission checks if user has write permission
@@ -140,20 +321,7 @@ func (pc *PermissionChecker) hasWritePermission(
 	user string,
 	groups []string,
 ) bool {
-	// Owner permissions
-	if info.Owner == user {
-		return (info.Mode & 0200) != 0 // Owner write bit
-	}
-
-	// Group permissions
-	for _, group := range groups {
-		if info.Group == group {
-			return (info.Mode & 0020) != 0 // Group write bit
-		}
-	}
-
-	// Other permissions
-	return (info.Mode & 0002) != 0 // Other write bit
+	return pc.IsPrivileged(user, groups) || aclAllows(info, aclWrite, user, groups)
 }
 
 // hasExecutePermission checks if user has execute permission
@@ -162,20 +330,26 @@ func (pc *PermissionChecker) hasExecutePermission(
 	user string,
 	groups []string,
 ) bool {
-	// Owner permissions
-	if info.Owner == user {
-		return (info.Mode & 0100) != 0 // Owner execute bit
+	// Privileged users may search any directory but only execute files
+	// that someone may execute
+	if pc.IsPrivileged(user, groups) {
+		return info.Type == pb.FileType_FILE_TYPE_DIRECTORY || info.Mode&0111 != 0
 	}
+	return aclAllows(info, aclExecute, user, groups)
+}
 
-	// Group permissions
-	for _, group := range groups {
-		if info.Group == group {
-			return (info.Mode & 0010) != 0 // Group execute bit
-		}
+// inheritGroup gives a new entry the group of its parent directory if the
+// directory is setgid. New directories also inherit the setgid bit, so the
+// group propagates down the tree.
+func inheritGroup(parent, info *pb.FileInfo) {
+	if parent.Type != pb.FileType_FILE_TYPE_DIRECTORY || parent.Mode&modeSetgid == 0 {
+		return
 	}
 
-	// Other permissions
-	return (info.Mode & 0001) != 0 // Other execute bit
+	info.Group = parent.Group
+	if info.Type == pb.FileType_FILE_TYPE_DIRECTORY {
+		info.Mode |= modeSetgid
+	}
 }
 
 // splitPath splits a path into components, handling both absolute and relative paths
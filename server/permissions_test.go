@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPermissions_Privileged(t *testing.T) {
+	storage := NewMemoryStorage()
+	pc := NewPermissionChecker(storage)
+	if pc.IsPrivileged("root", []string{"root"}) {
+		t.Fatalf("Expected no superuser unless one is configured")
+	}
+	pc.superuser = "root"
+	pc.adminGroup = "wheel"
+
+	private := &pb.FileInfo{Type: pb.FileType_FILE_TYPE_REGULAR, Mode: 0600, Owner: "alice", Group: "users"}
+	if err := storage.Create("/private.txt", private); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := storage.Create("/closed", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+		Mode:  0700,
+		Owner: "alice",
+		Group: "users",
+	}); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := storage.Create("/closed/tool", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_REGULAR,
+		Mode:  0700,
+		Owner: "alice",
+		Group: "users",
+	}); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		mode    pb.OpenMode
+		user    string
+		groups  []string
+		allowed bool
+	}{
+		{"other user reads", "/private.txt", pb.OpenMode_OPEN_MODE_READ, "bob", []string{"users"}, false},
+		{"superuser reads and writes", "/private.txt", pb.OpenMode_OPEN_MODE_RDWR, "root", nil, true},
+		{"admin group reads and writes", "/private.txt", pb.OpenMode_OPEN_MODE_RDWR, "bob", []string{"users", "wheel"}, true},
+		{"superuser executes without x bits", "/private.txt", pb.OpenMode_OPEN_MODE_EXEC, "root", nil, false},
+		{"superuser searches and executes", "/closed/tool", pb.OpenMode_OPEN_MODE_EXEC, "root", nil, true},
+		{"other user searches", "/closed/tool", pb.OpenMode_OPEN_MODE_READ, "bob", []string{"users"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := pc.CheckPathPermissions(tt.path, tt.mode, tt.user, tt.groups)
+			if tt.allowed && err != nil {
+				t.Errorf("Expected access, got: %v", err)
+			}
+			if !tt.allowed && err == nil {
+				t.Errorf("Expected access to be denied")
+			}
+		})
+	}
+
+	// An empty superuser disables it rather than matching an empty user
+	pc.superuser = ""
+	if pc.IsPrivileged("", nil) || pc.IsPrivileged("root", nil) {
+		t.Errorf("Expected no superuser when it is not configured")
+	}
+}
+
+func TestPermissions_SetgidAndSticky(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	newSession := func(user string, groups ...string) string {
+		resp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: user, Groups: groups})
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		return resp.SessionId
+	}
+	alice := newSession("alice", "users")
+	bob := newSession("bob", "users")
+	root := newSession("root")
+
+	// A setgid directory hands its group down, and setgid to subdirectories
+	if err := storage.Create("/shared", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+		Mode:  modeSetgid | modeSticky | 0777,
+		Owner: "root",
+		Group: "staff",
+	}); err != nil {
+		t.Fatalf("Failed to create /shared: %v", err)
+	}
+	if err := writeTestFile(ctx, client, alice, "/shared/a.txt", "alice's"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if info, err := storage.GetInfo("/shared/a.txt"); err != nil || info.Group != "staff" || info.Owner != "alice" {
+		t.Errorf("Expected alice:staff, got: %v (%v)", info, err)
+	}
+	if err := storage.Create("/shared/sub", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+		Mode:  0755,
+		Owner: "alice",
+		Group: "users",
+	}); err != nil {
+		t.Fatalf("Failed to create /shared/sub: %v", err)
+	}
+	if info, _ := storage.GetInfo("/shared/sub"); info.Group != "staff" || info.Mode&modeSetgid == 0 {
+		t.Errorf("Expected a setgid staff subdirectory, got group %s mode %o", info.Group, info.Mode)
+	}
+
+	// In the sticky directory only the owner or a privileged user removes
+	if _, err := client.Remove(ctx, &pb.RemoveRequest{Path: "/shared/a.txt", SessionId: bob}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied removing another user's file, got: %v", err)
+	}
+	if _, err := client.Remove(ctx, &pb.RemoveRequest{Path: "/shared/a.txt", SessionId: root}); err != nil {
+		t.Errorf("Expected the superuser to remove the file, got: %v", err)
+	}
+
+	// A session without groups creates files in its own name
+	nobody := newSession("nobody")
+	if err := writeTestFile(ctx, client, nobody, "/nobody.txt", "x"); err != nil {
+		t.Fatalf("Failed to write without groups: %v", err)
+	}
+	if info, err := storage.GetInfo("/nobody.txt"); err != nil || info.Owner != "nobody" {
+		t.Errorf("Expected a file owned by nobody, got: %v (%v)", info, err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// pipeCapacity is how many bytes a pipe buffers before writes block, as
+// on Linux
+const pipeCapacity = 64 * 1024
+
+// Pipe is the buffer behind a FILE_TYPE_PIPE inode. Data is consumed in
+// FIFO order; reads block until data arrives or every writer has closed,
+// and writes block while the buffer holds pipeCapacity bytes.
+type Pipe struct {
+	mu      sync.Mutex
+	buf     []byte
+	writers int
+	opened  bool          // A writer has attached at least once
+	changed chan struct{} // Closed and replaced whenever the pipe changes
+}
+
+// NewPipe creates an empty pipe with no writers
+func NewPipe() *Pipe {
+	return &Pipe{
+		changed: make(chan struct{}),
+	}
+}
+
+// Read copies buffered data into p. It blocks while the pipe is empty and
+// a writer may still produce data, and returns io.EOF once the pipe is
+// empty and all writers have closed.
+func (p *Pipe) Read(ctx context.Context, b []byte) (int, error) {
+	for {
+		p.mu.Lock()
+		if len(p.buf) > 0 {
+			n := copy(b, p.buf)
+			p.buf = p.buf[n:]
+			p.signal()
+			p.mu.Unlock()
+			return n, nil
+		}
+		if p.opened && p.writers == 0 {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Write appends b to the pipe and wakes any blocked readers. While the
+// pipe is full it waits for readers to make room, so it returns early,
+// with the number of bytes written, only if ctx is done.
+func (p *Pipe) Write(ctx context.Context, b []byte) (int, error) {
+	written := 0
+	for {
+		p.mu.Lock()
+		if room := pipeCapacity - len(p.buf); room > 0 {
+			n := min(room, len(b)-written)
+			p.buf = append(p.buf, b[written:written+n]...)
+			written += n
+			p.signal()
+		}
+		if written == len(b) {
+			p.mu.Unlock()
+			return written, nil
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return written, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Buffered returns the number of bytes waiting to be read
+func (p *Pipe) Buffered() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.buf)
+}
+
+// OpenWriter registers a writer so readers wait for its data
+func (p *Pipe) OpenWriter() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.writers++
+	p.opened = true
+	p.signal()
+}
+
+// CloseWriter unregisters a writer; readers see EOF after the last one
+func (p *Pipe) CloseWriter() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.writers > 0 {
+		p.writers--
+	}
+	p.signal()
+}
+
+// signal wakes every blocked reader and writer; callers must hold p.mu
+func (p *Pipe) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPipe_WriteBlocksWhenFull(t *testing.T) {
+	p := NewPipe()
+	p.OpenWriter()
+	ctx := context.Background()
+
+	// A write past capacity fills the pipe and waits for room
+	data := bytes.Repeat([]byte("x"), pipeCapacity+10)
+	done := make(chan int, 1)
+	go func() {
+		n, _ := p.Write(ctx, data)
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		t.Fatalf("Expected the write to block on a full pipe, it wrote %d bytes", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := p.Buffered(); got != pipeCapacity {
+		t.Errorf("Expected %d bytes buffered, got %d", pipeCapacity, got)
+	}
+
+	// Reading makes room for the rest
+	buf := make([]byte, 100)
+	if n, err := p.Read(ctx, buf); err != nil || n != 100 {
+		t.Fatalf("Expected to read 100 bytes, got %d (%v)", n, err)
+	}
+	if n := <-done; n != len(data) {
+		t.Errorf("Expected the whole write to complete, got %d bytes", n)
+	}
+	if got := p.Buffered(); got != pipeCapacity-90 {
+		t.Errorf("Expected %d bytes buffered, got %d", pipeCapacity-90, got)
+	}
+
+	// A blocked write gives up with ctx and reports what it wrote
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	n, err := p.Write(waitCtx, bytes.Repeat([]byte("y"), 200))
+	if !errors.Is(err, context.DeadlineExceeded) || n != 90 {
+		t.Errorf("Expected 90 bytes and DeadlineExceeded, got %d (%v)", n, err)
+	}
+}
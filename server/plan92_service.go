@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"math"
+	"path"
 
 	pb "github.com/accretional/plan92/gen/plan92/v1"
 	"google.golang.org/grpc/codes"
@@ -12,7 +20,7 @@ import (
 )
 
 const (
-	chunkSize = 32 * 1024 // 32KB chunks for streaming
+	chunkSize = 32 * 1024 // Default 32KB chunks for streaming
 )
 
 // Plan92ServiceImpl implements the Plan92 gRPC service
@@ -21,6 +29,8 @@ type Plan92ServiceImpl struct {
 	storage      *MemoryStorage
 	sessions     *SessionManager
 	inodeService *InodeServiceImpl
+	uploads      *UploadManager
+	config       Config
 }
 
 // NewPlan92Service creates a new Plan92 service implementation
@@ -29,6 +39,8 @@ func NewPlan92Service(storage *MemoryStorage, sessions *SessionManager, inodeSer
 		storage:      storage,
 		sessions:     sessions,
 		inodeService: inodeService,
+		uploads:      NewUploadManager(storage),
+		config:       DefaultConfig(),
 	}
 }
 
@@ -41,11 +53,35 @@ func (s *Plan92ServiceImpl) CreateSession(
 	ctx context.Context,
 	req *pb.CreateSessionRequest,
 ) (*pb.CreateSessionResponse, error) {
-	session, err := s.sessions.Create(req.User, req.Groups)
+	var session *Session
+	var err error
+	if req.Capability != "" {
+		// A capability session has no identity of its own
+		if req.User != "" || len(req.Groups) > 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "a session has either a capability or a user")
+		}
+		var capability *Capability
+		if capability, err = s.inodeService.capabilities.Verify(req.Capability); err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "invalid capability: %v", err)
+		}
+		session, err = s.sessions.CreateWithCapability(capability)
+	} else {
+		session, err = s.sessions.Create(req.User, req.Groups)
+	}
+	if errors.Is(err, errTooManySessions) {
+		return nil, limitError(err)
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create session: %v", err)
 	}
 
+	if req.Stdio {
+		if err := session.openStdio(); err != nil {
+			s.sessions.Close(session.ID, s.storage)
+			return nil, status.Errorf(codes.Internal, "failed to open stdio: %v", err)
+		}
+	}
+
 	return &pb.CreateSessionResponse{
 		SessionId: session.ID,
 		CreatedAt: timestamppb.New(session.CreatedAt),
@@ -79,22 +115,36 @@ func (s *Plan92ServiceImpl) Open(
 		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
 	}
 
+	fileStatus, err := s.open(ctx, session, req)
+	s.audit(session, "open", req.Path, req.Mode, 0, err)
+	return fileStatus, err
+}
+
+// open checks permissions and allocates an FD for an Open request
+func (s *Plan92ServiceImpl) open(
+	ctx context.Context,
+	session *Session,
+	req *pb.OpenRequest,
+) (*pb.FileStatus, error) {
+	if s.config.AuditPath != "" && path.Clean(req.Path) == s.config.AuditPath {
+		return s.openAuditLog(session, req)
+	}
+
 	// Check permissions using InodeService
 	permReq := &pb.CheckPermissionRequest{
 		Path:          req.Path,
 		SessionId:     req.SessionId,
 		RequestedMode: req.Mode,
 		Context: &pb.PermissionContext{
-			User:   session.User,
-			Groups: session.Groups,
+			User:       session.User,
+			Groups:     session.Groups,
+			Capability: req.Capability,
 		},
 	}
 
-	permResp, err := s.inodeService.CheckPermission(ctx, permReq)
-	if err != nil {
-		return nil, err
-	}
-
+	// The open record covers the decision, so the check is not audited
+	// on its own
+	permResp := s.inodeService.checkPermission(session, permReq)
 	if !permResp.Granted {
 		return nil, status.Errorf(codes.PermissionDenied, "permission denied: %s", permResp.Reason)
 	}
@@ -107,12 +157,7 @@ func (s *Plan92ServiceImpl) Open(
 		Inode:     permResp.Inode,
 	}
 
-	fileStatus, err := s.inodeService.AllocateFd(ctx, allocReq)
-	if err != nil {
-		return nil, err
-	}
-
-	return fileStatus, nil
+	return s.inodeService.AllocateFd(ctx, allocReq)
 }
 
 // Read reads data from an open file descriptor (server streaming)
@@ -121,28 +166,100 @@ func (s *Plan92ServiceImpl) Read(
 	stream pb.Plan92_ReadServer,
 ) error {
 	// Get session and validate FD
-	handle, err := s.getAndValidateFD(req.Fd)
+	_, handle, err := s.getAndValidateFD(req.SessionId, req.Fd)
 	if err != nil {
 		return err
 	}
 
 	// Check if FD is opened for reading
-	if handle.Mode != pb.OpenMode_OPEN_MODE_READ &&
-		handle.Mode != pb.OpenMode_OPEN_MODE_RDWR {
+	if !isReadable(handle.Mode) {
 		return status.Errorf(codes.PermissionDenied, "file not opened for reading")
 	}
 
-	// Get file data
-	data, err := s.storage.Get(handle.Path)
+	// Read through the handle so unlinked-but-open files stay readable
+	data := handle.Data
+
+	compression, err := s.readCompression(req.Compression, handle.Path)
 	if err != nil {
-		return status.Errorf(codes.NotFound, "file not found: %v", err)
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	// Adaptive reads grow their chunks from size up to the maximum; the
+	// metadata reports the largest chunk the stream may carry
+	size, adaptive := s.config.readChunkSize(req.ChunkSize)
+	largest := size
+	if adaptive {
+		largest = s.config.MaxChunkSize
+	}
+
+	// Pipes have no offsets: stream data as it is written, in chunks of
+	// one size
+	if data.Pipe != nil {
+		if len(req.Ranges) > 0 {
+			return status.Errorf(codes.InvalidArgument, "ranged reads are not supported on pipes")
+		}
+		if err := stream.Send(&pb.ReadResponse{
+			Data: &pb.ReadResponse_Metadata{Metadata: &pb.ReadMetadata{
+				Fd:          req.Fd,
+				TotalSize:   -1,
+				FileInfo:    s.storage.Stat(data),
+				Compression: compression,
+				ChunkSize:   int32(size),
+			}},
+		}); err != nil {
+			return status.Errorf(codes.Internal, "failed to send metadata: %v", err)
+		}
+		return s.readPipe(stream, data.Pipe, req.Count, size, compression)
+	}
+
+	// Stream from a snapshot: concurrent writers publish new content
+	// versions instead of modifying the one being read, so the stream is
+	// consistent with the metadata sent first
+	content, info := s.storage.Snapshot(data)
+
+	// Determine read parameters: a plain read is a single range starting
+	// at the given offset or the current position
+	ranges := req.Ranges
+	if len(ranges) == 0 {
+		offset := req.Offset
+		if offset < 0 {
+			// Reading at the current position moves it past what will be
+			// streamed, as read(2) does, in one step so that concurrent
+			// reads through a shared offset never overlap
+			handle.Offset.Update(func(pos int64) (int64, error) {
+				offset = pos
+				_, end := resolveRange(pos, req.Count, info.Length)
+				return max(pos, end), nil
+			})
+		}
+		ranges = []*pb.ReadRange{{Offset: offset, Count: req.Count}}
+	}
+
+	// Resolve every range against EOF up front so total_size is exactly
+	// what will be streamed
+	resolved := make([]*pb.ReadRange, len(ranges))
+	var totalSize int64
+	for i, r := range ranges {
+		start, end := resolveRange(r.Offset, r.Count, info.Length)
+		resolved[i] = &pb.ReadRange{Offset: start, Count: end - start}
+		totalSize += end - start
+	}
+
+	// Checksums cover the whole file, so they are only worth computing
+	// when the whole file is streamed
+	if req.Checksums && len(resolved) == 1 &&
+		resolved[0].Offset == 0 && resolved[0].Count == info.Length {
+		info = withChecksums(content, info)
 	}
 
 	// Send metadata first
 	metadata := &pb.ReadMetadata{
-		Fd:        req.Fd,
-		TotalSize: data.Info.Length,
-		FileInfo:  data.Info,
+		Fd:          req.Fd,
+		TotalSize:   totalSize,
+		FileInfo:    info,
+		Ranges:      resolved,
+		Compression: compression,
+		ChunkSize:   int32(largest),
 	}
 
 	if err := stream.Send(&pb.ReadResponse{
@@ -151,95 +268,298 @@ func (s *Plan92ServiceImpl) Read(
 		return status.Errorf(codes.Internal, "failed to send metadata: %v", err)
 	}
 
-	// Determine read parameters
-	offset := req.Offset
+	// Stream each range in chunks; holes are read back as zeros. Send
+	// blocks once the client's flow control window is full, so the server
+	// never runs more than a window ahead of the consumer.
+	for i, r := range resolved {
+		end := r.Offset + r.Count
+		for pos := r.Offset; pos < end; {
+			chunk := make([]byte, min(int64(size), end-pos))
+			n := content.ReadAt(chunk, pos)
+
+			resp := chunkResponse(chunk[:n], compression)
+			resp.ChunkOffset = pos
+			resp.RangeIndex = int32(i)
+			if err := stream.Send(resp); err != nil {
+				return status.Errorf(codes.Internal, "failed to send chunk: %v", err)
+			}
+			pos += int64(n)
+
+			// Fewer, larger messages for long reads
+			if adaptive {
+				size = min(size*2, largest)
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveRange clamps a requested range to a file of the given length and
+// returns its [start, end) offsets. A negative offset counts back from
+// EOF, a count of zero or less reads to EOF, and a range starting at or
+// past EOF is empty.
+func resolveRange(offset, count, length int64) (int64, int64) {
 	if offset < 0 {
-		offset = handle.Offset
+		offset = max(length+offset, 0)
+	}
+	if offset >= length {
+		return length, length
 	}
 
-	count := req.Count
-	if count <= 0 {
-		count = int32(len(data.Content)) - int32(offset)
+	// Compare against the remaining length so huge counts cannot overflow
+	if count <= 0 || count > length-offset {
+		return offset, length
 	}
+	return offset, offset + count
+}
 
-	// Stream file content in chunks
-	content := data.Content[offset:]
-	if int32(len(content)) > count {
-		content = content[:count]
+// chunkResponse builds the read response carrying chunk, checksummed
+// before it is compressed
+func chunkResponse(chunk []byte, compression pb.Compression) *pb.ReadResponse {
+	resp := &pb.ReadResponse{
+		Data:        &pb.ReadResponse_Chunk{Chunk: chunk},
+		ChunkCrc32C: crc32.Checksum(chunk, crc32cTable),
 	}
+	if compression != pb.Compression_COMPRESSION_UNSPECIFIED {
+		resp.Data = &pb.ReadResponse_Chunk{Chunk: compressChunk(compression, chunk)}
+		resp.UncompressedSize = int64(len(chunk))
+	}
+	return resp
+}
 
-	for len(content) > 0 {
-		end := chunkSize
-		if end > len(content) {
-			end = len(content)
+// writeHandle writes p at off through the handle, so unlinked-but-open
+// files stay writable, and returns the number of bytes written. A gap past
+// end of file becomes a hole. Nothing is written if the file would exceed
+// a quota or the maximum file size. Pipes ignore the offset and append,
+// waiting for room until ctx is done.
+func (s *Plan92ServiceImpl) writeHandle(ctx context.Context, handle *FileHandle, p []byte, off int64) (int, error) {
+	if handle.Data.Pipe != nil {
+		n, err := handle.Data.Pipe.Write(ctx, p)
+		if err != nil {
+			return n, status.FromContextError(err).Err()
 		}
+		return n, nil
+	}
+	if err := s.storage.WriteAt(handle.Data, p, off); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
 
-		chunk := content[:end]
-		content = content[end:]
+// commitStaged writes the staged content to the handle at off. A file
+// takes over the staged extents in one step; a pipe is fed a chunk at a
+// time. It returns the number of bytes committed.
+func (s *Plan92ServiceImpl) commitStaged(ctx context.Context, handle *FileHandle, staged *Extents, off int64) (int64, error) {
+	if handle.Data.Pipe == nil {
+		if _, _, err := s.storage.CopyRange(handle.Data, staged, 0, off, staged.Size()); err != nil {
+			return 0, err
+		}
+		return staged.Size(), nil
+	}
 
-		if err := stream.Send(&pb.ReadResponse{
-			Data: &pb.ReadResponse_Chunk{Chunk: chunk},
-		}); err != nil {
-			return status.Errorf(codes.Internal, "failed to send chunk: %v", err)
+	var written int64
+	buf := make([]byte, s.config.ChunkSize)
+	for written < staged.Size() {
+		n := staged.ReadAt(buf, written)
+		m, err := s.writeHandle(ctx, handle, buf[:n], off+written)
+		written += int64(m)
+		if err != nil {
+			return written, err
 		}
 	}
+	return written, nil
+}
 
-	// Update FD offset if using current position
-	if req.Offset < 0 {
-		newOffset := handle.Offset + int64(count)
-		// Note: We're not updating the offset in the FDTable here for simplicity
-		// In a production implementation, you'd want to track this
-		_ = newOffset
+// writeAtOffset runs write, which returns the number of bytes it wrote, at
+// off. A write at the current position goes to the FD offset instead and
+// moves it past the data in the same step, as write(2) does; other writes
+// leave the offset alone, as pwrite(2) does.
+func writeAtOffset(handle *FileHandle, off int64, current bool, write func(off int64) (int64, error)) (int64, error) {
+	if !current {
+		return write(off)
 	}
 
+	var n int64
+	_, err := handle.Offset.Update(func(pos int64) (int64, error) {
+		var err error
+		n, err = write(pos)
+		return pos + n, err
+	})
+	return n, err
+}
+
+// truncateFD empties the file of a handle before its content is replaced
+// and rewinds the FD offset to the start
+func (s *Plan92ServiceImpl) truncateFD(handle *FileHandle) error {
+	if _, err := s.storage.Truncate(handle.Data, 0); err != nil {
+		return err
+	}
+	handle.Offset.Store(0)
 	return nil
 }
 
-// Write writes data to an open file descriptor (client streaming)
+// writeFailed reports a write refused by storage, after written bytes were
+// committed
+func (s *Plan92ServiceImpl) writeFailed(stream pb.Plan92_WriteServer, session *Session, handle *FileHandle, written int64, err error) error {
+	return s.finishWrite(stream, session, handle, &pb.WriteResponse{
+		Fd:           handle.FD,
+		BytesWritten: written,
+		Error:        err.Error(),
+		ErrorCode:    toFSError(storageError(err), handle.FD).Code,
+	})
+}
+
+// readPipe streams data from a pipe until count bytes have been read or
+// every writer has closed. A count of zero or less reads until EOF. Each
+// chunk carries at most maxChunk bytes.
+func (s *Plan92ServiceImpl) readPipe(stream pb.Plan92_ReadServer, p *Pipe, count int64, maxChunk int, compression pb.Compression) error {
+	var read int64
+	for count <= 0 || read < count {
+		size := int64(maxChunk)
+		if count > 0 {
+			size = min(size, count-read)
+		}
+
+		chunk := make([]byte, size)
+		n, err := p.Read(stream.Context(), chunk)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.FromContextError(err).Err()
+		}
+		read += int64(n)
+
+		if err := stream.Send(chunkResponse(chunk[:n], compression)); err != nil {
+			return status.Errorf(codes.Internal, "failed to send chunk: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Write writes data to an open file descriptor (client streaming).
+// Chunks are committed to storage as they arrive, so memory per stream is
+// bounded by the chunk size rather than the size of the upload.
 func (s *Plan92ServiceImpl) Write(
 	stream pb.Plan92_WriteServer,
 ) error {
 	var fd int32
+	var session *Session
 	var handle *FileHandle
-	var buffer []byte
-	var offset int64 = -1
+	var offset int64
+	var totalSize int64
+	var written int64
+	var compression pb.Compression
+
+	// A write with an expected checksum is hashed as it arrives into a
+	// staging version, which is committed only once the digest has been
+	// verified
+	var expected []byte
+	var hasher hash.Hash
+	var staged Extents
+	var truncate bool
+	var current bool // Writing at, and moving, the FD offset
 
-	// Receive all chunks
+	// Apply chunks as they are received
 	for {
 		req, err := stream.Recv()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return status.Errorf(codes.Internal, "failed to receive chunk: %v", err)
+			return status.Errorf(codes.Internal, "failed to receive chunk (%d bytes committed): %v", written, err)
 		}
 
 		switch data := req.Data.(type) {
 		case *pb.WriteRequest_Metadata:
 			// First message should be metadata
+			if handle != nil {
+				return status.Errorf(codes.InvalidArgument, "duplicate metadata")
+			}
 			fd = data.Metadata.Fd
 			offset = data.Metadata.Offset
+			totalSize = data.Metadata.TotalSize
+			expected = data.Metadata.ExpectedSha256
+			compression = data.Metadata.Compression
+
+			if err := checkCompression(compression); err != nil {
+				return status.Errorf(codes.InvalidArgument, "%v", err)
+			}
+
+			if len(expected) > 0 {
+				if len(expected) != sha256.Size {
+					return status.Errorf(codes.InvalidArgument, "expected_sha256 must be %d bytes", sha256.Size)
+				}
+				hasher = sha256.New()
+			}
 
 			// Validate FD
-			h, err := s.getAndValidateFD(fd)
+			sess, h, err := s.getAndValidateFD(data.Metadata.SessionId, fd)
 			if err != nil {
 				return err
 			}
-			handle = h
+			session, handle = sess, h
 
 			// Check if FD is opened for writing
-			if handle.Mode != pb.OpenMode_OPEN_MODE_WRITE &&
-				handle.Mode != pb.OpenMode_OPEN_MODE_RDWR &&
-				handle.Mode != pb.OpenMode_OPEN_MODE_TRUNC {
-				return status.Errorf(codes.PermissionDenied, "file not opened for writing")
+			if !isWritable(handle.Mode) {
+				err := status.Errorf(codes.PermissionDenied, "file not opened for writing")
+				s.auditFD(session, handle, "write", 0, err)
+				return err
 			}
 
-			// Initialize buffer
-			buffer = make([]byte, 0, data.Metadata.TotalSize)
+			// An FD opened with OPEN_MODE_TRUNC replaces the entire file:
+			// truncate and write from the start at the FD offset. Otherwise
+			// a negative offset writes at the current position.
+			if handle.Data.Pipe == nil {
+				truncate = handle.Mode == pb.OpenMode_OPEN_MODE_TRUNC
+				current = truncate || offset < 0
+			}
+			if truncate && hasher == nil {
+				if err := s.truncateFD(handle); err != nil {
+					return s.writeFailed(stream, session, handle, 0, err)
+				}
+			}
 
 		case *pb.WriteRequest_Chunk:
-			// Append chunk to buffer
-			buffer = append(buffer, data.Chunk...)
+			if handle == nil {
+				return status.Errorf(codes.InvalidArgument, "metadata must be sent before data")
+			}
+
+			// Sizes and checksums refer to the decoded data
+			chunk, err := decompressChunk(compression, data.Chunk)
+			if err != nil {
+				return s.finishWrite(stream, session, handle, &pb.WriteResponse{
+					Fd:           fd,
+					BytesWritten: written,
+					Error:        fmt.Sprintf("failed to decompress chunk: %v", err),
+					ErrorCode:    pb.FSErrorCode_FS_ERROR_CODE_INVALID_ARGUMENT,
+				})
+			}
+
+			if totalSize > 0 && written+staged.Size()+int64(len(chunk)) > totalSize {
+				return s.finishWrite(stream, session, handle, &pb.WriteResponse{
+					Fd:           fd,
+					BytesWritten: written,
+					Error:        fmt.Sprintf("received more than total_size (%d bytes)", totalSize),
+					ErrorCode:    pb.FSErrorCode_FS_ERROR_CODE_INVALID_ARGUMENT,
+				})
+			}
+
+			if hasher != nil {
+				hasher.Write(chunk)
+				staged.WriteAt(chunk, staged.Size())
+			} else {
+				n, err := writeAtOffset(handle, offset+written, current, func(off int64) (int64, error) {
+					n, err := s.writeHandle(stream.Context(), handle, chunk, off)
+					return int64(n), err
+				})
+				if err != nil {
+					return s.writeFailed(stream, session, handle, written+n, err)
+				}
+				written += n
+			}
 		}
 	}
 
@@ -247,47 +567,68 @@ func (s *Plan92ServiceImpl) Write(
 		return status.Errorf(codes.InvalidArgument, "no metadata received")
 	}
 
-	// Get existing file data
-	data, err := s.storage.Get(handle.Path)
-	if err != nil {
-		return status.Errorf(codes.NotFound, "file not found: %v", err)
-	}
-
-	// Write data to storage
-	var newContent []byte
-	if offset < 0 || handle.Mode == pb.OpenMode_OPEN_MODE_TRUNC {
-		// Replace entire file
-		newContent = buffer
-	} else {
-		// Write at specific offset
-		existingContent := data.Content
-		if int64(len(existingContent)) < offset {
-			// Extend file with zeros if needed
-			padding := make([]byte, offset-int64(len(existingContent)))
-			existingContent = append(existingContent, padding...)
+	// A staged write commits all of its data or none of it
+	if hasher != nil {
+		if totalSize > 0 && staged.Size() != totalSize {
+			return s.finishWrite(stream, session, handle, &pb.WriteResponse{
+				Fd:        fd,
+				Error:     fmt.Sprintf("short write: received %d of %d bytes", staged.Size(), totalSize),
+				ErrorCode: pb.FSErrorCode_FS_ERROR_CODE_IO_ERROR,
+			})
+		}
+		if sum := hasher.Sum(nil); !bytes.Equal(sum, expected) {
+			return s.finishWrite(stream, session, handle, &pb.WriteResponse{
+				Fd:        fd,
+				Error:     fmt.Sprintf("checksum mismatch: expected sha256 %x, got %x", expected, sum),
+				ErrorCode: pb.FSErrorCode_FS_ERROR_CODE_IO_ERROR,
+			})
 		}
 
-		// Combine: existing up to offset + new buffer + existing after
-		newContent = make([]byte, 0, offset+int64(len(buffer)))
-		newContent = append(newContent, existingContent[:offset]...)
-		newContent = append(newContent, buffer...)
-
-		// Add remaining content if offset + buffer doesn't cover it all
-		if int64(len(existingContent)) > offset+int64(len(buffer)) {
-			newContent = append(newContent, existingContent[offset+int64(len(buffer)):]...)
+		if truncate {
+			if err := s.truncateFD(handle); err != nil {
+				return s.writeFailed(stream, session, handle, 0, err)
+			}
+		}
+		frozen := staged.Freeze()
+		n, err := writeAtOffset(handle, offset, current, func(off int64) (int64, error) {
+			return s.commitStaged(stream.Context(), handle, frozen, off)
+		})
+		if err != nil {
+			return s.writeFailed(stream, session, handle, n, err)
 		}
+		written = n
 	}
 
-	// Update storage
-	if err := s.storage.Set(handle.Path, newContent, data.Info); err != nil {
-		return status.Errorf(codes.Internal, "failed to write file: %v", err)
+	resp := &pb.WriteResponse{
+		Fd:           fd,
+		BytesWritten: written,
+	}
+
+	// Report a short upload as a partial failure; what was received is
+	// already committed
+	if totalSize > 0 && written != totalSize {
+		resp.Error = fmt.Sprintf("short write: received %d of %d bytes", written, totalSize)
+		resp.ErrorCode = pb.FSErrorCode_FS_ERROR_CODE_IO_ERROR
 	}
 
 	// Send response
-	return stream.SendAndClose(&pb.WriteResponse{
-		Fd:           fd,
-		BytesWritten: int64(len(buffer)),
-	})
+	return s.finishWrite(stream, session, handle, resp)
+}
+
+// finishWrite audits a Write stream and sends its response
+func (s *Plan92ServiceImpl) finishWrite(
+	stream pb.Plan92_WriteServer,
+	session *Session,
+	handle *FileHandle,
+	resp *pb.WriteResponse,
+) error {
+	var err error
+	if resp.Error != "" {
+		err = fmt.Errorf("%s", resp.Error)
+	}
+	s.auditFD(session, handle, "write", resp.BytesWritten, err)
+
+	return stream.SendAndClose(resp)
 }
 
 // Close closes an open file descriptor
@@ -296,88 +637,466 @@ func (s *Plan92ServiceImpl) Close(
 	req *pb.CloseRequest,
 ) (*pb.CloseResponse, error) {
 	// Get FD handle
-	handle, err := s.getAndValidateFD(req.Fd)
+	session, handle, err := s.getAndValidateFD(req.SessionId, req.Fd)
 	if err != nil {
 		return nil, err
 	}
 
-	// Decrement reference count in storage
-	if err := s.storage.DecRef(handle.Path); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to decrement refcount: %v", err)
+	// Release FD from session's FD table
+	if err := session.FDTable.Release(req.Fd); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to release FD: %v", err)
 	}
 
-	// Release FD from session's FD table
-	session, err := s.getSessionForFD(req.Fd)
+	// Drop the storage reference; this frees unlinked files on last close
+	handle.release(s.storage)
+
+	return &pb.CloseResponse{
+		Success: true,
+	}, nil
+}
+
+// Seek moves the offset of an open file descriptor. SEEK_WHENCE_DATA and
+// SEEK_WHENCE_HOLE let clients such as backup tools skip over holes.
+func (s *Plan92ServiceImpl) Seek(
+	ctx context.Context,
+	req *pb.SeekRequest,
+) (*pb.SeekResponse, error) {
+	session, _, err := s.getAndValidateFD(req.SessionId, req.Fd)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := session.FDTable.Release(req.Fd); err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "failed to release FD: %v", err)
+	offset, err := s.seekFD(session, req.Fd, req.Offset, req.Whence)
+	if err != nil {
+		return nil, err
 	}
 
-	return &pb.CloseResponse{
-		Success: true,
+	return &pb.SeekResponse{
+		Offset: offset,
 	}, nil
 }
 
+// seekFD moves the offset of fd in the session's FD table and returns the
+// new offset. It is shared by Seek and the seek operation of Io.
+func (s *Plan92ServiceImpl) seekFD(
+	session *Session,
+	fd int32,
+	offset int64,
+	whence pb.SeekWhence,
+) (int64, error) {
+	handle, err := session.FDTable.Get(fd)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid file descriptor: %v", err)
+	}
+
+	if handle.Data.Pipe != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "illegal seek on a pipe")
+	}
+
+	// A relative seek moves the offset in one step, so it cannot lose a
+	// concurrent read or write through a shared offset
+	return handle.Offset.Update(func(current int64) (int64, error) {
+		return s.seekTarget(handle, current, offset, whence)
+	})
+}
+
+// seekTarget resolves a seek of an open regular file from current
+func (s *Plan92ServiceImpl) seekTarget(
+	handle *FileHandle,
+	current int64,
+	offset int64,
+	whence pb.SeekWhence,
+) (int64, error) {
+	switch whence {
+	case pb.SeekWhence_SEEK_WHENCE_SET:
+	case pb.SeekWhence_SEEK_WHENCE_CUR:
+		offset += current
+	case pb.SeekWhence_SEEK_WHENCE_END:
+		offset += s.storage.Stat(handle.Data).Length
+	case pb.SeekWhence_SEEK_WHENCE_DATA:
+		next, ok := s.storage.SeekData(handle.Data, offset)
+		if !ok {
+			return 0, status.Errorf(codes.OutOfRange, "no data at or after offset %d", offset)
+		}
+		offset = next
+	case pb.SeekWhence_SEEK_WHENCE_HOLE:
+		next, ok := s.storage.SeekHole(handle.Data, offset)
+		if !ok {
+			return 0, status.Errorf(codes.OutOfRange, "offset %d is past end of file", offset)
+		}
+		offset = next
+	default:
+		return 0, status.Errorf(codes.InvalidArgument, "invalid whence: %v", whence)
+	}
+
+	if offset < 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid offset: %d", offset)
+	}
+
+	return offset, nil
+}
+
 // Stat gets file information without opening
 func (s *Plan92ServiceImpl) Stat(
 	ctx context.Context,
 	req *pb.StatRequest,
 ) (*pb.StatResponse, error) {
 	// Validate session
-	_, err := s.sessions.Get(req.SessionId)
+	session, err := s.sessions.Get(req.SessionId)
 	if err != nil {
 		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
 	}
 
-	// Get file info
+	// Get file info, along with its content checksums if requested
 	data, err := s.storage.Get(req.Path)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "file not found: %v", err)
 	}
 
+	// Checksums reveal the content, so they need read permission
+	info := s.storage.Stat(data)
+	if req.Checksums {
+		if err := s.authorize(session, req.Path, pb.OpenMode_OPEN_MODE_READ); err != nil {
+			return nil, err
+		}
+		info = s.storage.StatChecksummed(data)
+	}
+	if req.IncludeXattrs {
+		info = s.withXattrs(ctx, session, req.Path, data, info)
+	}
+
 	return &pb.StatResponse{
-		Info: data.Info,
+		Info: info,
 	}, nil
 }
 
 // ============================================================================
-// Helper Methods
+// Resize Operations
 // ============================================================================
 
-// getAndValidateFD retrieves and validates a file descriptor
-func (s *Plan92ServiceImpl) getAndValidateFD(fd int32) (*FileHandle, error) {
-	// Find which session owns this FD
-	session, err := s.getSessionForFD(fd)
+// Truncate shrinks or zero-extends a file addressed by path or open FD
+func (s *Plan92ServiceImpl) Truncate(
+	ctx context.Context,
+	req *pb.TruncateRequest,
+) (*pb.TruncateResponse, error) {
+	if req.Length < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid length: %d", req.Length)
+	}
+
+	var session *Session
+	var data *FileData
+	var filePath string
+	var mode pb.OpenMode
+	switch target := req.Target.(type) {
+	case *pb.TruncateRequest_Fd:
+		sess, handle, err := s.getAndValidateFD(req.SessionId, target.Fd)
+		if err != nil {
+			return nil, err
+		}
+		session, data, filePath, mode = sess, handle.Data, handle.Path, handle.Mode
+		if !isWritable(handle.Mode) {
+			err := status.Errorf(codes.PermissionDenied, "file not opened for writing")
+			s.audit(session, "truncate", filePath, mode, req.Length, err)
+			return nil, err
+		}
+
+	case *pb.TruncateRequest_Path:
+		sess, err := s.sessions.Get(req.SessionId)
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+		}
+		session, filePath = sess, target.Path
+		if data, err = s.checkWritablePath(ctx, session, target.Path); err != nil {
+			s.audit(session, "truncate", filePath, mode, req.Length, err)
+			return nil, err
+		}
+
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "path or fd required")
+	}
+
+	info, err := s.truncate(data, req.Length)
+	s.audit(session, "truncate", filePath, mode, req.Length, err)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get handle from session's FD table
-	handle, err := session.FDTable.Get(fd)
+	return &pb.TruncateResponse{
+		Info: info,
+	}, nil
+}
+
+// truncate resizes data for Truncate
+func (s *Plan92ServiceImpl) truncate(data *FileData, length int64) (*pb.FileInfo, error) {
+	if s.storage.Stat(data).Type == pb.FileType_FILE_TYPE_DIRECTORY {
+		return nil, status.Errorf(codes.InvalidArgument, "is a directory")
+	}
+
+	info, err := s.storage.Truncate(data, length)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "invalid file descriptor: %v", err)
+		return nil, storageError(err)
 	}
+	return info, nil
+}
 
-	return handle, nil
+// Fallocate reserves space for a range of an open FD without writing data
+func (s *Plan92ServiceImpl) Fallocate(
+	ctx context.Context,
+	req *pb.FallocateRequest,
+) (*pb.FallocateResponse, error) {
+	if req.Offset < 0 || req.Length <= 0 || req.Length > math.MaxInt64-req.Offset {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid range: offset %d, length %d", req.Offset, req.Length)
+	}
+
+	session, handle, err := s.getAndValidateFD(req.SessionId, req.Fd)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.fallocate(handle, req)
+	s.auditFD(session, handle, "fallocate", req.Length, err)
+	return resp, err
 }
 
-// getSessionForFD finds the session that owns a given FD
-func (s *Plan92ServiceImpl) getSessionForFD(fd int32) (*Session, error) {
-	// Iterate through all sessions to find the owner
-	// In a production system, you'd maintain a reverse mapping for efficiency
-	for _, sessionID := range s.sessions.List() {
-		session, err := s.sessions.Get(sessionID)
-		if err != nil {
-			continue
+// fallocate reserves the range of a Fallocate request through handle
+func (s *Plan92ServiceImpl) fallocate(handle *FileHandle, req *pb.FallocateRequest) (*pb.FallocateResponse, error) {
+	if !isWritable(handle.Mode) {
+		return nil, status.Errorf(codes.PermissionDenied, "file not opened for writing")
+	}
+
+	if s.storage.Stat(handle.Data).Type == pb.FileType_FILE_TYPE_DIRECTORY {
+		return nil, status.Errorf(codes.InvalidArgument, "is a directory")
+	}
+
+	info, reserved, err := s.storage.Allocate(handle.Data, req.Offset, req.Length, req.KeepSize)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	return &pb.FallocateResponse{
+		Info:     info,
+		Reserved: reserved,
+	}, nil
+}
+
+// ============================================================================
+// Remove Operations
+// ============================================================================
+
+// Remove unlinks a file or an empty directory. A file that is still open
+// remains readable and writable through its FDs until the last one closes.
+func (s *Plan92ServiceImpl) Remove(
+	ctx context.Context,
+	req *pb.RemoveRequest,
+) (*pb.RemoveResponse, error) {
+	// Validate session
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	data, err := s.removeEntry(session, path.Clean(req.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RemoveResponse{
+		Success:   true,
+		StillOpen: s.storage.IsOpen(data),
+	}, nil
+}
+
+// RemoveAll removes a file or a whole directory tree, deepest entries
+// first, streaming progress after each entry is unlinked
+func (s *Plan92ServiceImpl) RemoveAll(
+	req *pb.RemoveRequest,
+	stream pb.Plan92_RemoveAllServer,
+) error {
+	// Validate session
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	root := path.Clean(req.Path)
+	if !s.storage.Exists(root) {
+		return status.Errorf(codes.NotFound, "file not found: %s", root)
+	}
+
+	entries := s.storage.Tree(root)
+	total := int64(len(entries))
+	var removed int64
+
+	for _, entry := range entries {
+		if err := stream.Context().Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+
+		if _, err := s.removeEntry(session, entry); err != nil {
+			// Entries removed concurrently by someone else are not an error
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+			return err
 		}
+		removed++
 
-		if _, err := session.FDTable.Get(fd); err == nil {
-			return session, nil
+		if err := stream.Send(&pb.RemoveProgress{
+			Path:    entry,
+			Removed: removed,
+			Total:   total,
+		}); err != nil {
+			return status.Errorf(codes.Internal, "failed to send progress: %v", err)
 		}
 	}
 
-	return nil, status.Errorf(codes.InvalidArgument, "file descriptor not found in any session")
+	return nil
+}
+
+// removeEntry checks permissions and unlinks a single entry, auditing
+// the attempt
+func (s *Plan92ServiceImpl) removeEntry(session *Session, filePath string) (*FileData, error) {
+	data, err := s.unlinkEntry(session, filePath)
+	s.audit(session, "remove", filePath, pb.OpenMode_OPEN_MODE_UNSPECIFIED, 0, err)
+	return data, err
+}
+
+// unlinkEntry checks permissions and unlinks a single entry. Whether a
+// directory is empty is only revealed to callers allowed to remove it.
+func (s *Plan92ServiceImpl) unlinkEntry(session *Session, filePath string) (*FileData, error) {
+	if !s.storage.Exists(filePath) {
+		return nil, status.Errorf(codes.NotFound, "file not found: %s", filePath)
+	}
+
+	if err := s.inodeService.checkRemove(session, filePath); err != nil {
+		return nil, status.Errorf(codes.PermissionDenied, "permission denied: %v", err)
+	}
+
+	data, err := s.storage.UnlinkIfEmpty(filePath)
+	if errors.Is(err, errNotEmpty) {
+		return nil, status.Errorf(codes.FailedPrecondition, "directory not empty: %s", filePath)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "file not found: %v", err)
+	}
+
+	return data, nil
+}
+
+// ============================================================================
+// Helper Methods
+// ============================================================================
+
+// checkWritablePath runs the same permission check Open performs for
+// OPEN_MODE_WRITE and returns the existing file at the path
+func (s *Plan92ServiceImpl) checkWritablePath(
+	ctx context.Context,
+	session *Session,
+	filePath string,
+) (*FileData, error) {
+	if err := s.authorize(session, filePath, pb.OpenMode_OPEN_MODE_WRITE); err != nil {
+		return nil, err
+	}
+
+	data, err := s.storage.Get(filePath)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "file not found: %v", err)
+	}
+
+	return data, nil
+}
+
+// checkAccess asks the InodeService whether the session may open filePath
+// with mode, recording the decision in the audit log. Opening a missing
+// file for writing is granted, as it would be created.
+func (s *Plan92ServiceImpl) checkAccess(
+	ctx context.Context,
+	session *Session,
+	filePath string,
+	mode pb.OpenMode,
+) error {
+	permResp, err := s.inodeService.CheckPermission(ctx, accessRequest(session, filePath, mode))
+	if err != nil {
+		return err
+	}
+	return accessError(permResp)
+}
+
+// authorize is checkAccess without the audit record, for operations that
+// record their own outcome
+func (s *Plan92ServiceImpl) authorize(session *Session, filePath string, mode pb.OpenMode) error {
+	return accessError(s.inodeService.checkPermission(session, accessRequest(session, filePath, mode)))
+}
+
+// accessRequest asks whether session may open filePath with mode
+func accessRequest(session *Session, filePath string, mode pb.OpenMode) *pb.CheckPermissionRequest {
+	return &pb.CheckPermissionRequest{
+		Path:          filePath,
+		SessionId:     session.ID,
+		RequestedMode: mode,
+		Context: &pb.PermissionContext{
+			User:   session.User,
+			Groups: session.Groups,
+		},
+	}
+}
+
+// accessError converts a denied permission check to a status error
+func accessError(permResp *pb.CheckPermissionResponse) error {
+	if !permResp.Granted {
+		return status.Errorf(codes.PermissionDenied, "permission denied: %s", permResp.Reason)
+	}
+	return nil
+}
+
+// privileged reports whether the session's user bypasses discretionary
+// access checks. Capability sessions never do.
+func (s *Plan92ServiceImpl) privileged(session *Session) bool {
+	return session.Capability == nil &&
+		s.inodeService.permChecker.IsPrivileged(session.User, session.Groups)
+}
+
+// fsErrorf returns a status error carrying an FSError detail so clients
+// can distinguish filesystem errors sharing a gRPC code
+func fsErrorf(code codes.Code, fsCode pb.FSErrorCode, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	st, err := status.New(code, msg).WithDetails(&pb.FSError{
+		Code:    fsCode,
+		Message: msg,
+	})
+	if err != nil {
+		return status.Error(code, msg)
+	}
+	return st.Err()
+}
+
+// isReadable reports whether an FD opened with mode may be read
+func isReadable(mode pb.OpenMode) bool {
+	return mode == pb.OpenMode_OPEN_MODE_READ ||
+		mode == pb.OpenMode_OPEN_MODE_RDWR
+}
+
+// isWritable reports whether an FD opened with mode may be written
+func isWritable(mode pb.OpenMode) bool {
+	return mode == pb.OpenMode_OPEN_MODE_WRITE ||
+		mode == pb.OpenMode_OPEN_MODE_RDWR ||
+		mode == pb.OpenMode_OPEN_MODE_TRUNC
+}
+
+// getAndValidateFD retrieves and validates a file descriptor of a session.
+// FD numbers are per session, so every request naming an FD also names
+// the session holding it.
+func (s *Plan92ServiceImpl) getAndValidateFD(sessionID string, fd int32) (*Session, *FileHandle, error) {
+	session, err := s.sessions.Get(sessionID)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	// Get handle from session's FD table
+	handle, err := session.FDTable.Get(fd)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "invalid file descriptor: %v", err)
+	}
+
+	return session, handle, nil
 }
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+)
+
+// AuthzRequest describes an access that already passed the permission
+// checks, for an Authorizer to decide on
+type AuthzRequest struct {
+	Session *Session
+	User    string   // Identity the access is made as; a capability's issuer
+	Groups  []string // Groups of that identity
+	Path    string
+	Mode    pb.OpenMode
+	Time    time.Time
+}
+
+// Authorizer makes authorization decisions that mode bits and ACLs cannot
+// express. InodeServiceImpl.CheckPermission consults it after the
+// permission checks pass; a non-nil error denies the access and becomes
+// the reason reported to the client.
+type Authorizer interface {
+	Authorize(req *AuthzRequest) error
+}
+
+// policyReloadInterval is how often a policy file is checked for changes
+const policyReloadInterval = 5 * time.Second
+
+// Policy rule effects
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// Policy rule operations
+const (
+	policyRead  = "read"
+	policyWrite = "write"
+	policyExec  = "exec"
+)
+
+// PolicyRule is one declarative rule. A rule matches an access when every
+// condition it sets holds; unset conditions match anything.
+type PolicyRule struct {
+	Name       string   `json:"name"`
+	Effect     string   `json:"effect"`               // "allow" or "deny"
+	Paths      []string `json:"paths,omitempty"`      // Globs; "*" matches within a component, "**" across them
+	Users      []string `json:"users,omitempty"`      // Any of these users
+	Groups     []string `json:"groups,omitempty"`     // Any of these groups
+	Operations []string `json:"operations,omitempty"` // Any of "read", "write" and "exec"
+	Hours      string   `json:"hours,omitempty"`      // Server local time window such as "22:00-06:00"
+	MaxOpen    int      `json:"max_open,omitempty"`   // Session already holds this many files open under paths
+	Reason     string   `json:"reason,omitempty"`     // Reported when the rule denies
+
+	from, until time.Duration // Parsed Hours
+}
+
+// Policy is an ordered list of rules. The first matching rule decides;
+// an access no rule matches is allowed.
+type Policy struct {
+	Rules []*PolicyRule `json:"rules"`
+}
+
+// ParsePolicy parses and validates a JSON policy
+func ParsePolicy(content []byte) (*Policy, error) {
+	var policy Policy
+	if err := json.Unmarshal(content, &policy); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range policy.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if rule.Effect != policyAllow && rule.Effect != policyDeny {
+			return nil, fmt.Errorf("rule %s: effect must be %q or %q", rule.Name, policyAllow, policyDeny)
+		}
+		for _, pattern := range rule.Paths {
+			if !path.IsAbs(pattern) {
+				return nil, fmt.Errorf("rule %s: path %q must be absolute", rule.Name, pattern)
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %s: path %q: %v", rule.Name, pattern, err)
+			}
+		}
+		for _, op := range rule.Operations {
+			if op != policyRead && op != policyWrite && op != policyExec {
+				return nil, fmt.Errorf("rule %s: unknown operation %q", rule.Name, op)
+			}
+		}
+		if rule.Hours != "" {
+			var err error
+			if rule.from, rule.until, err = parseHours(rule.Hours); err != nil {
+				return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+		}
+		if rule.MaxOpen < 0 {
+			return nil, fmt.Errorf("rule %s: max_open must not be negative", rule.Name)
+		}
+		if rule.MaxOpen > 0 && len(rule.Paths) == 0 {
+			return nil, fmt.Errorf("rule %s: max_open needs paths", rule.Name)
+		}
+	}
+
+	return &policy, nil
+}
+
+// Authorize applies the first rule matching req
+func (p *Policy) Authorize(req *AuthzRequest) error {
+	for _, rule := range p.Rules {
+		if !rule.matches(req) {
+			continue
+		}
+		if rule.Effect == policyAllow {
+			return nil
+		}
+		if rule.Reason != "" {
+			return fmt.Errorf("%s", rule.Reason)
+		}
+		return fmt.Errorf("denied by policy rule %s", rule.Name)
+	}
+	return nil
+}
+
+// matches reports whether every condition of the rule holds for req
+func (r *PolicyRule) matches(req *AuthzRequest) bool {
+	if len(r.Paths) > 0 && !r.matchesPath(req.Path) {
+		return false
+	}
+	if len(r.Users) > 0 && !slices.Contains(r.Users, req.User) {
+		return false
+	}
+	if len(r.Groups) > 0 && !slices.ContainsFunc(req.Groups, func(group string) bool {
+		return slices.Contains(r.Groups, group)
+	}) {
+		return false
+	}
+	if len(r.Operations) > 0 && !slices.ContainsFunc(policyOperations(req.Mode), func(op string) bool {
+		return slices.Contains(r.Operations, op)
+	}) {
+		return false
+	}
+	if r.Hours != "" && !r.withinHours(req.Time) {
+		return false
+	}
+	if r.MaxOpen > 0 {
+		open := 0
+		for _, handle := range req.Session.FDTable.List() {
+			if r.matchesPath(handle.Path) {
+				open++
+			}
+		}
+		if open < r.MaxOpen {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesPath reports whether filePath matches any of the rule's globs
+func (r *PolicyRule) matchesPath(filePath string) bool {
+	filePath = path.Clean(filePath)
+	return slices.ContainsFunc(r.Paths, func(pattern string) bool {
+		return matchGlob(splitPath(pattern), splitPath(filePath))
+	})
+}
+
+// withinHours reports whether t falls in the rule's daily window. A
+// window whose end is before its start wraps around midnight.
+func (r *PolicyRule) withinHours(t time.Time) bool {
+	h, m, sec := t.Clock()
+	now := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+	if r.from <= r.until {
+		return now >= r.from && now < r.until
+	}
+	return now >= r.from || now < r.until
+}
+
+// matchGlob matches path components against glob components, where "**"
+// matches any number of components, including none
+func matchGlob(pattern, components []string) bool {
+	if len(pattern) == 0 {
+		return len(components) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(components); i++ {
+			if matchGlob(pattern[1:], components[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(components) == 0 {
+		return false
+	}
+	matched, _ := path.Match(pattern[0], components[0])
+	return matched && matchGlob(pattern[1:], components[1:])
+}
+
+// parseHours parses a "HH:MM-HH:MM" window into offsets from midnight
+func parseHours(hours string) (from, until time.Duration, err error) {
+	start, end, ok := strings.Cut(hours, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("hours %q must look like 00:00-06:00", hours)
+	}
+	if from, err = parseClock(start); err != nil {
+		return 0, 0, err
+	}
+	if until, err = parseClock(end); err != nil {
+		return 0, 0, err
+	}
+	return from, until, nil
+}
+
+// parseClock parses "HH:MM", allowing "24:00" for the end of the day
+func parseClock(clock string) (time.Duration, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q", clock)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// policyOperations returns the rule operations an open mode performs
+func policyOperations(mode pb.OpenMode) []string {
+	switch mode {
+	case pb.OpenMode_OPEN_MODE_READ:
+		return []string{policyRead}
+	case pb.OpenMode_OPEN_MODE_WRITE, pb.OpenMode_OPEN_MODE_TRUNC:
+		return []string{policyWrite}
+	case pb.OpenMode_OPEN_MODE_RDWR:
+		return []string{policyRead, policyWrite}
+	case pb.OpenMode_OPEN_MODE_EXEC:
+		return []string{policyExec}
+	}
+	return nil
+}
+
+// PolicyFile is an Authorizer backed by a policy file that is reloaded
+// when it changes. A file that fails to load leaves the previous policy in
+// force.
+type PolicyFile struct {
+	path    string
+	mu      sync.RWMutex
+	policy  *Policy
+	modTime time.Time
+	size    int64
+}
+
+// LoadPolicyFile loads the policy at filePath
+func LoadPolicyFile(filePath string) (*PolicyFile, error) {
+	f := &PolicyFile{path: filePath}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Authorize applies the current policy
+func (f *PolicyFile) Authorize(req *AuthzRequest) error {
+	f.mu.RLock()
+	policy := f.policy
+	f.mu.RUnlock()
+
+	return policy.Authorize(req)
+}
+
+// Reload reads the policy file again if it changed since it was last
+// loaded, and reports whether it did
+func (f *PolicyFile) Reload() (bool, error) {
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.RLock()
+	unchanged := f.policy != nil && stat.ModTime().Equal(f.modTime) && stat.Size() == f.size
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	policy, err := ParsePolicy(content)
+
+	// Remember a broken version too, so it is reported only once
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.modTime = stat.ModTime()
+	f.size = stat.Size()
+	if err != nil {
+		return false, fmt.Errorf("invalid policy %s: %v", f.path, err)
+	}
+	f.policy = policy
+
+	return true, nil
+}
+
+// ReloadEvery checks the policy file for changes periodically until stop
+// is closed
+func (f *PolicyFile) ReloadEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := f.Reload()
+			if err != nil {
+				log.Printf("Keeping the previous policy: %v", err)
+			} else if reloaded {
+				log.Printf("Reloaded policy from %s", f.path)
+			}
+		}
+	}
+}
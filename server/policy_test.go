@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+)
+
+const testPolicy = `{
+  "rules": [
+    {"name": "tenant-x-window", "effect": "allow", "paths": ["/tenants/x/**"], "users": ["x"],
+     "operations": ["write"], "hours": "00:00-06:00"},
+    {"name": "tenant-x-writes", "effect": "deny", "users": ["x"], "operations": ["write"],
+     "reason": "tenant x may only write under /tenants/x at night"},
+    {"name": "secrets", "effect": "deny", "paths": ["/secrets/**"], "max_open": 2}
+  ]
+}`
+
+func TestPolicy_Rules(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+
+	session := &Session{User: "x", FDTable: NewFDTable()}
+	night := time.Date(2026, 1, 1, 3, 0, 0, 0, time.Local)
+	day := time.Date(2026, 1, 1, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name    string
+		user    string
+		path    string
+		mode    pb.OpenMode
+		at      time.Time
+		allowed bool
+	}{
+		{"write in window", "x", "/tenants/x/a/b.txt", pb.OpenMode_OPEN_MODE_WRITE, night, true},
+		{"write outside window", "x", "/tenants/x/b.txt", pb.OpenMode_OPEN_MODE_RDWR, day, false},
+		{"write elsewhere", "x", "/tenants/y/b.txt", pb.OpenMode_OPEN_MODE_WRITE, night, false},
+		{"read outside window", "x", "/tenants/x/b.txt", pb.OpenMode_OPEN_MODE_READ, day, true},
+		{"other user", "y", "/tenants/x/b.txt", pb.OpenMode_OPEN_MODE_WRITE, day, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Authorize(&AuthzRequest{Session: session, User: tt.user, Path: tt.path, Mode: tt.mode, Time: tt.at})
+			if tt.allowed && err != nil {
+				t.Errorf("Expected access, got: %v", err)
+			}
+			if !tt.allowed && err == nil {
+				t.Errorf("Expected access to be denied")
+			}
+		})
+	}
+
+	// The open limit counts the session's descriptors under the rule's paths
+	open := &AuthzRequest{Session: session, User: "y", Path: "/secrets/c", Mode: pb.OpenMode_OPEN_MODE_READ, Time: day}
+	session.FDTable.Allocate("/secrets/a", pb.OpenMode_OPEN_MODE_READ, nil)
+	session.FDTable.Allocate("/public/a", pb.OpenMode_OPEN_MODE_READ, nil)
+	if err := policy.Authorize(open); err != nil {
+		t.Errorf("Expected a second secret to open, got: %v", err)
+	}
+	session.FDTable.Allocate("/secrets/b", pb.OpenMode_OPEN_MODE_READ, nil)
+	if err := policy.Authorize(open); err == nil || !strings.Contains(err.Error(), "secrets") {
+		t.Errorf("Expected a third secret to be denied by the secrets rule, got: %v", err)
+	}
+
+	for _, invalid := range []string{
+		`{"rules": [{"effect": "maybe"}]}`,
+		`{"rules": [{"effect": "deny", "paths": ["relative"]}]}`,
+		`{"rules": [{"effect": "deny", "operations": ["delete"]}]}`,
+		`{"rules": [{"effect": "deny", "hours": "25:00-06:00"}]}`,
+		`{"rules": [{"effect": "deny", "max_open": 3}]}`,
+	} {
+		if _, err := ParsePolicy([]byte(invalid)); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestPolicy_FileReloadAndReason(t *testing.T) {
+	storage := NewMemoryStorage()
+	sessions := NewSessionManager()
+	inodeService := NewInodeService(storage, sessions)
+
+	policyPath := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(policyPath, []byte(`{"rules": []}`), 0644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	policy, err := LoadPolicyFile(policyPath)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	inodeService.authorizer = policy
+
+	if err := storage.Create("/report.txt", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_REGULAR,
+		Mode:  0666,
+		Owner: "alice",
+		Group: "users",
+	}); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	session, _ := sessions.Create("bob", []string{"users"})
+	check := func() *pb.CheckPermissionResponse {
+		resp, err := inodeService.CheckPermission(context.Background(), &pb.CheckPermissionRequest{
+			Path:          "/report.txt",
+			SessionId:     session.ID,
+			RequestedMode: pb.OpenMode_OPEN_MODE_WRITE,
+		})
+		if err != nil {
+			t.Fatalf("CheckPermission failed: %v", err)
+		}
+		return resp
+	}
+
+	if resp := check(); !resp.Granted {
+		t.Fatalf("Expected access under an empty policy, got: %s", resp.Reason)
+	}
+
+	// A changed file takes effect on reload and its reason reaches the client
+	rules := `{"rules": [{"effect": "deny", "groups": ["users"], "operations": ["write"], "reason": "reports are frozen"}]}`
+	if err := os.WriteFile(policyPath, []byte(rules), 0644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	if reloaded, err := policy.Reload(); err != nil || !reloaded {
+		t.Fatalf("Expected the policy to reload, got: %v, %v", reloaded, err)
+	}
+	if resp := check(); resp.Granted || resp.Reason != "reports are frozen" {
+		t.Errorf("Expected the rule's reason, got: %v", resp)
+	}
+
+	// Removal counts as a write
+	if err := inodeService.checkRemove(session, "/report.txt"); err == nil || err.Error() != "reports are frozen" {
+		t.Errorf("Expected the rule to deny removal, got: %v", err)
+	}
+
+	// A broken file keeps the previous policy
+	if err := os.WriteFile(policyPath, []byte(`{"rules": [`), 0644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	if _, err := policy.Reload(); err == nil {
+		t.Errorf("Expected a broken policy to fail to load")
+	}
+	if resp := check(); resp.Granted {
+		t.Errorf("Expected the previous policy to stay in force")
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+)
+
+var (
+	errNoSpace      = errors.New("no space left")
+	errFileTooLarge = errors.New("file too large")
+	errNameTooLong  = errors.New("file name too long")
+)
+
+// filesystemKey charges every file to the filesystem as a whole, whose
+// limits are the storage capacity
+var filesystemKey = quotaKey{}
+
+// quotaKey identifies a user, group or directory that usage is charged to
+type quotaKey struct {
+	kind pb.QuotaKind
+	name string // User, group or clean directory path
+}
+
+// String describes the key for error messages
+func (k quotaKey) String() string {
+	switch k.kind {
+	case pb.QuotaKind_QUOTA_KIND_USER:
+		return "user " + k.name
+	case pb.QuotaKind_QUOTA_KIND_GROUP:
+		return "group " + k.name
+	case pb.QuotaKind_QUOTA_KIND_UNSPECIFIED:
+		return "the filesystem"
+	}
+	return "directory " + k.name
+}
+
+// quotaUsage is a pair of byte and inode counts, used for both limits
+// (where 0 is unlimited) and usage
+type quotaUsage struct {
+	bytes  int64
+	inodes int64
+}
+
+// quotaTable holds the limits and usage that the storage enforces. Usage
+// is tracked for the filesystem and every user and group, and for
+// directories only while they have a quota. It is guarded by the storage
+// lock.
+type quotaTable struct {
+	limits      map[quotaKey]quotaUsage
+	usage       map[quotaKey]quotaUsage
+	maxFileSize int64 // Largest file length; 0 is unlimited
+}
+
+func newQuotaTable() quotaTable {
+	return quotaTable{
+		limits: make(map[quotaKey]quotaUsage),
+		usage:  make(map[quotaKey]quotaUsage),
+	}
+}
+
+// fileUsage returns the bytes a file is charged for: its stored data and
+// its reservations. Holes are free, as sparse files are on Unix.
+func fileUsage(data *FileData) int64 {
+	return contentUsage(data.Content, data.Reserved)
+}
+
+// contentUsage returns the bytes content with the reservations reserved
+// is charged for, counting bytes that are both stored and reserved once
+func contentUsage(content *Extents, reserved byteRanges) int64 {
+	usage := content.StoredBytes()
+	for _, r := range reserved {
+		usage += r.end - r.start - content.StoredIn(r.start, r.end)
+	}
+	return usage
+}
+
+// writeUsage returns what the file would be charged for after writing
+// [off, end): the bytes the write newly stores that are not reserved
+// already. The caller must hold the storage lock.
+func writeUsage(data *FileData, off, end int64) int64 {
+	usage := fileUsage(data)
+	data.Content.Unstored(off, end, func(start, end int64) {
+		usage += end - start - data.Reserved.overlap(start, end)
+	})
+	return usage
+}
+
+// byteRange is the half-open range of file offsets [start, end)
+type byteRange struct {
+	start, end int64
+}
+
+// byteRanges is a sorted list of disjoint, non-adjacent byte ranges
+type byteRanges []byteRange
+
+// add returns the ranges with [start, end) added, merging any it touches
+func (r byteRanges) add(start, end int64) byteRanges {
+	merged := make(byteRanges, 0, len(r)+1)
+	for _, existing := range r {
+		if existing.end < start || existing.start > end {
+			merged = append(merged, existing)
+			continue
+		}
+		start, end = min(start, existing.start), max(end, existing.end)
+	}
+	merged = append(merged, byteRange{start, end})
+	sort.Slice(merged, func(i, j int) bool { return merged[i].start < merged[j].start })
+	return merged
+}
+
+// clip returns the ranges cut off at end
+func (r byteRanges) clip(end int64) byteRanges {
+	var clipped byteRanges
+	for _, existing := range r {
+		if existing.start >= end {
+			break
+		}
+		clipped = append(clipped, byteRange{existing.start, min(existing.end, end)})
+	}
+	return clipped
+}
+
+// overlap returns how many bytes of [start, end) lie within the ranges
+func (r byteRanges) overlap(start, end int64) int64 {
+	var n int64
+	for _, existing := range r {
+		n += max(0, min(existing.end, end)-max(existing.start, start))
+	}
+	return n
+}
+
+// underDir reports whether filePath lies strictly below dir
+func underDir(filePath, dir string) bool {
+	if dir == "/" {
+		return filePath != "/"
+	}
+	return strings.HasPrefix(filePath, dir+"/")
+}
+
+// quotaKeys returns everything an entry at filePath with info is charged
+// to. The caller must hold the storage lock.
+func (s *MemoryStorage) quotaKeys(filePath string, info *pb.FileInfo) []quotaKey {
+	keys := ownerKeys(info)
+	for key := range s.quotas.limits {
+		if key.kind == pb.QuotaKind_QUOTA_KIND_DIRECTORY && underDir(filePath, key.name) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ownerKeys returns the filesystem and the owner and group in info, which
+// a file stays charged to while it is held open after leaving the namespace
+func ownerKeys(info *pb.FileInfo) []quotaKey {
+	return []quotaKey{
+		filesystemKey,
+		{pb.QuotaKind_QUOTA_KIND_USER, info.Owner},
+		{pb.QuotaKind_QUOTA_KIND_GROUP, info.Group},
+	}
+}
+
+// chargedKeys returns what a file with info is charged to: nothing for a
+// file that was never stored or is gone for good, the owner keys for an
+// unlinked file still held open, and otherwise everything its path is
+// charged to. The caller must hold the storage lock.
+func (s *MemoryStorage) chargedKeys(data *FileData, info *pb.FileInfo) []quotaKey {
+	switch {
+	case data.path == "", data.Unlinked && data.RefCount == 0:
+		return nil
+	case data.Unlinked:
+		return ownerKeys(info)
+	}
+	return s.quotaKeys(data.path, info)
+}
+
+// checkQuota returns errNoSpace if adding bytes and inodes to keys would
+// exceed a limit. Decreases always pass. The caller must hold the storage
+// lock.
+func (s *MemoryStorage) checkQuota(keys []quotaKey, bytes, inodes int64) error {
+	for _, key := range keys {
+		limit, exists := s.quotas.limits[key]
+		if !exists {
+			continue
+		}
+		used := s.quotas.usage[key]
+		if bytes > 0 && limit.bytes > 0 && used.bytes+bytes > limit.bytes {
+			return fmt.Errorf("%w: %s is limited to %d bytes", errNoSpace, key, limit.bytes)
+		}
+		if inodes > 0 && limit.inodes > 0 && used.inodes+inodes > limit.inodes {
+			return fmt.Errorf("%w: %s is limited to %d inodes", errNoSpace, key, limit.inodes)
+		}
+	}
+	return nil
+}
+
+// charge adds bytes and inodes, which may be negative, to the usage of
+// keys. The caller must hold the storage write lock.
+func (s *MemoryStorage) charge(keys []quotaKey, bytes, inodes int64) {
+	for _, key := range keys {
+		used := s.quotas.usage[key]
+		used.bytes += bytes
+		used.inodes += inodes
+		if used == (quotaUsage{}) && key.kind != pb.QuotaKind_QUOTA_KIND_DIRECTORY {
+			delete(s.quotas.usage, key)
+			continue
+		}
+		s.quotas.usage[key] = used
+	}
+}
+
+// admit checks that the file may grow to length bytes while using usage
+// bytes, before any data is accepted. Unlinked files are still checked
+// against their owner, group and the filesystem. The caller must hold the
+// storage write lock.
+func (s *MemoryStorage) admit(data *FileData, length, usage int64) error {
+	if s.quotas.maxFileSize > 0 && length > s.quotas.maxFileSize {
+		return fmt.Errorf("%w: files are limited to %d bytes", errFileTooLarge, s.quotas.maxFileSize)
+	}
+	return s.checkQuota(s.chargedKeys(data, data.Info), usage-fileUsage(data), 0)
+}
+
+// settle charges the change in a file's usage since it was before. The
+// caller must hold the storage write lock.
+func (s *MemoryStorage) settle(data *FileData, before int64) {
+	if delta := fileUsage(data) - before; delta != 0 {
+		s.charge(s.chargedKeys(data, data.Info), delta, 0)
+	}
+}
+
+// StagingKeys returns what upload data staged for a file is charged to
+// until it is committed: the file's owner and group and the filesystem
+func (s *MemoryStorage) StagingKeys(data *FileData) []quotaKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return ownerKeys(data.Info)
+}
+
+// ChargeStaged charges n more bytes of upload data, staged for a file that
+// would be length bytes long, to keys. Like a write, it fails if that would
+// exceed a limit or the maximum file size.
+func (s *MemoryStorage) ChargeStaged(keys []quotaKey, length, n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.quotas.maxFileSize > 0 && length > s.quotas.maxFileSize {
+		return fmt.Errorf("%w: files are limited to %d bytes", errFileTooLarge, s.quotas.maxFileSize)
+	}
+	if err := s.checkQuota(keys, n, 0); err != nil {
+		return err
+	}
+	s.charge(keys, n, 0)
+	return nil
+}
+
+// ReleaseStaged stops charging n bytes charged to keys by ChargeStaged
+func (s *MemoryStorage) ReleaseStaged(keys []quotaKey, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.charge(keys, -n, 0)
+}
+
+// SetMaxFileSize limits the length of every file; 0 is unlimited
+func (s *MemoryStorage) SetMaxFileSize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.quotas.maxFileSize = size
+}
+
+// MaxFileSize returns the largest allowed file length; 0 is unlimited
+func (s *MemoryStorage) MaxFileSize() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.quotas.maxFileSize
+}
+
+// SetQuota sets the limits of a user, group or directory, or removes them
+// when both are 0. A directory must exist; its usage is counted when it
+// first gets a quota. It returns the resulting quota.
+func (s *MemoryStorage) SetQuota(kind pb.QuotaKind, name string, maxBytes, maxInodes int64) (*pb.Quota, error) {
+	if maxBytes < 0 || maxInodes < 0 {
+		return nil, fmt.Errorf("limits must not be negative")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, err := s.quotaKey(kind, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxBytes == 0 && maxInodes == 0 {
+		delete(s.quotas.limits, key)
+		if key.kind == pb.QuotaKind_QUOTA_KIND_DIRECTORY {
+			delete(s.quotas.usage, key)
+		}
+		return s.quota(key), nil
+	}
+
+	if _, exists := s.quotas.limits[key]; !exists && key.kind == pb.QuotaKind_QUOTA_KIND_DIRECTORY {
+		var used quotaUsage
+		for filePath, data := range s.files {
+			if underDir(filePath, key.name) {
+				used.bytes += fileUsage(data)
+				used.inodes++
+			}
+		}
+		s.quotas.usage[key] = used
+	}
+	s.quotas.limits[key] = quotaUsage{bytes: maxBytes, inodes: maxInodes}
+
+	return s.quota(key), nil
+}
+
+// GetQuota returns the limits and usage of a user, group or directory
+func (s *MemoryStorage) GetQuota(kind pb.QuotaKind, name string) (*pb.Quota, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, err := s.quotaKey(kind, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.quota(key), nil
+}
+
+// quotasFor returns the quotas a file created at filePath with owner and
+// group is charged to: those of the owner and any group, then those of the
+// directories containing filePath, outermost first. The caller must hold
+// the storage lock.
+func (s *MemoryStorage) quotasFor(owner, group, filePath string) []*pb.Quota {
+	quotas := []*pb.Quota{s.quota(quotaKey{pb.QuotaKind_QUOTA_KIND_USER, owner})}
+	if group != "" {
+		quotas = append(quotas, s.quota(quotaKey{pb.QuotaKind_QUOTA_KIND_GROUP, group}))
+	}
+
+	var dirs []*pb.Quota
+	for key := range s.quotas.limits {
+		if key.kind == pb.QuotaKind_QUOTA_KIND_DIRECTORY && (filePath == key.name || underDir(filePath, key.name)) {
+			dirs = append(dirs, s.quota(key))
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i].Name) < len(dirs[j].Name)
+	})
+
+	return append(quotas, dirs...)
+}
+
+// quotaKey validates kind and name. The caller must hold the storage lock.
+func (s *MemoryStorage) quotaKey(kind pb.QuotaKind, name string) (quotaKey, error) {
+	switch kind {
+	case pb.QuotaKind_QUOTA_KIND_USER, pb.QuotaKind_QUOTA_KIND_GROUP:
+		if name == "" {
+			return quotaKey{}, fmt.Errorf("name required")
+		}
+	case pb.QuotaKind_QUOTA_KIND_DIRECTORY:
+		if !path.IsAbs(name) {
+			return quotaKey{}, fmt.Errorf("directory %q must be absolute", name)
+		}
+		name = path.Clean(name)
+		data, exists := s.files[name]
+		if !exists {
+			return quotaKey{}, fmt.Errorf("file not found: %s", name)
+		}
+		if data.Info.Type != pb.FileType_FILE_TYPE_DIRECTORY {
+			return quotaKey{}, fmt.Errorf("not a directory: %s", name)
+		}
+	default:
+		return quotaKey{}, fmt.Errorf("quota kind required")
+	}
+	return quotaKey{kind, name}, nil
+}
+
+// quota reports the limits and usage of key. The caller must hold the
+// storage lock.
+func (s *MemoryStorage) quota(key quotaKey) *pb.Quota {
+	limit := s.quotas.limits[key]
+	used := s.quotas.usage[key]
+	return &pb.Quota{
+		Kind:       key.kind,
+		Name:       key.name,
+		MaxBytes:   limit.bytes,
+		MaxInodes:  limit.inodes,
+		UsedBytes:  used.bytes,
+		UsedInodes: used.inodes,
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path"
+	"slices"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// storageError converts a storage error from a write, truncation or
+// creation to a status error
+func storageError(err error) error {
+	switch {
+	case errors.Is(err, errNoSpace):
+		return fsErrorf(codes.ResourceExhausted, pb.FSErrorCode_FS_ERROR_CODE_NO_SPACE, "%v", err)
+	case errors.Is(err, errFileTooLarge):
+		return fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_FILE_TOO_LARGE, "%v", err)
+	case errors.Is(err, errNameTooLong):
+		return fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_NAME_TOO_LONG, "%v", err)
+	}
+	return status.Errorf(codes.Internal, "%v", err)
+}
+
+// checkQuotaTarget returns NotFound for a directory quota on a missing path
+func (s *Plan92ServiceImpl) checkQuotaTarget(kind pb.QuotaKind, name string) error {
+	if kind == pb.QuotaKind_QUOTA_KIND_DIRECTORY && path.IsAbs(name) && !s.storage.Exists(path.Clean(name)) {
+		return status.Errorf(codes.NotFound, "file not found: %s", name)
+	}
+	return nil
+}
+
+// GetQuota returns the limits and usage of a user, group or directory.
+// Unprivileged sessions may only read their own user and group quotas, and
+// the quotas of directories.
+func (s *Plan92ServiceImpl) GetQuota(
+	ctx context.Context,
+	req *pb.GetQuotaRequest,
+) (*pb.Quota, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	if !s.privileged(session) {
+		owner, group := session.Creator()
+		switch req.Kind {
+		case pb.QuotaKind_QUOTA_KIND_USER:
+			if req.Name != owner {
+				return nil, status.Errorf(codes.PermissionDenied, "permission denied: quota of user %s", req.Name)
+			}
+		case pb.QuotaKind_QUOTA_KIND_GROUP:
+			if req.Name != group && (session.Capability != nil || !slices.Contains(session.Groups, req.Name)) {
+				return nil, status.Errorf(codes.PermissionDenied, "permission denied: quota of group %s", req.Name)
+			}
+		}
+	}
+
+	if err := s.checkQuotaTarget(req.Kind, req.Name); err != nil {
+		return nil, err
+	}
+	quota, err := s.storage.GetQuota(req.Kind, req.Name)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	return quota, nil
+}
+
+// SetQuota sets or removes the limits of a user, group or directory. Only
+// privileged sessions may change quotas. Lowering a limit below the
+// current usage is allowed; further growth then fails until usage drops.
+func (s *Plan92ServiceImpl) SetQuota(
+	ctx context.Context,
+	req *pb.SetQuotaRequest,
+) (*pb.Quota, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	if !s.privileged(session) {
+		err := fsErrorf(codes.PermissionDenied, pb.FSErrorCode_FS_ERROR_CODE_PERMISSION_DENIED,
+			"permission denied: only privileged users may set quotas")
+		s.audit(session, "setquota", req.Name, pb.OpenMode_OPEN_MODE_UNSPECIFIED, req.MaxBytes, err)
+		return nil, err
+	}
+
+	if err := s.checkQuotaTarget(req.Kind, req.Name); err != nil {
+		return nil, err
+	}
+	quota, err := s.storage.SetQuota(req.Kind, req.Name, req.MaxBytes, req.MaxInodes)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	s.audit(session, "setquota", quota.Name, pb.OpenMode_OPEN_MODE_UNSPECIFIED, req.MaxBytes, nil)
+	return quota, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuota_Enforcement(t *testing.T) {
+	server, lis, storage, _ := setupPrivilegedTestServer(t, "root")
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	if err := storage.Create("/proj", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+		Mode:  0777,
+		Owner: "root",
+	}); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	root, _ := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "root"})
+	alice, _ := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice", Groups: []string{"users"}})
+
+	// Only privileged sessions set quotas
+	if _, err := client.SetQuota(ctx, &pb.SetQuotaRequest{
+		SessionId: alice.SessionId, Kind: pb.QuotaKind_QUOTA_KIND_USER, Name: "alice", MaxBytes: 1 << 20,
+	}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied, got: %v", err)
+	}
+	for _, req := range []*pb.SetQuotaRequest{
+		{Kind: pb.QuotaKind_QUOTA_KIND_USER, Name: "alice", MaxBytes: 10},
+		{Kind: pb.QuotaKind_QUOTA_KIND_DIRECTORY, Name: "/proj", MaxInodes: 1},
+	} {
+		req.SessionId = root.SessionId
+		if _, err := client.SetQuota(ctx, req); err != nil {
+			t.Fatalf("Failed to set quota: %v", err)
+		}
+	}
+
+	if err := writeTestFile(ctx, client, alice.SessionId, "/a.txt", "12345678"); err != nil {
+		t.Fatalf("Failed to write within quota: %v", err)
+	}
+
+	// The chunk that would cross the limit is refused; the one before it
+	// stays committed
+	opened, err := client.Open(ctx, &pb.OpenRequest{Path: "/b.txt", Mode: pb.OpenMode_OPEN_MODE_WRITE, SessionId: alice.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	stream, err := client.Write(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create write stream: %v", err)
+	}
+	stream.Send(&pb.WriteRequest{Data: &pb.WriteRequest_Metadata{Metadata: &pb.WriteMetadata{Fd: opened.Fd, SessionId: opened.SessionId}}})
+	stream.Send(&pb.WriteRequest{Data: &pb.WriteRequest_Chunk{Chunk: []byte("ab")}})
+	stream.Send(&pb.WriteRequest{Data: &pb.WriteRequest_Chunk{Chunk: []byte("cde")}})
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("Expected a partial-failure response, got: %v", err)
+	}
+	if resp.BytesWritten != 2 || resp.ErrorCode != pb.FSErrorCode_FS_ERROR_CODE_NO_SPACE {
+		t.Errorf("Expected 2 committed bytes with NO_SPACE, got: %d, %v", resp.BytesWritten, resp.ErrorCode)
+	}
+	if _, err := client.Fallocate(ctx, &pb.FallocateRequest{Fd: opened.Fd, SessionId: opened.SessionId, Length: 100}); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_NO_SPACE {
+		t.Errorf("Expected NO_SPACE reserving past the quota, got: %v", err)
+	}
+
+	// Extending by a hole stores nothing, so the quota allows it
+	if _, err := client.Truncate(ctx, &pb.TruncateRequest{Target: &pb.TruncateRequest_Fd{Fd: opened.Fd}, SessionId: opened.SessionId, Length: 100}); err != nil {
+		t.Errorf("Expected a sparse extension within the quota, got: %v", err)
+	}
+
+	// The directory allows one entry below it
+	if err := writeTestFile(ctx, client, root.SessionId, "/proj/one", ""); err != nil {
+		t.Fatalf("Failed to create the first entry: %v", err)
+	}
+	if _, err := client.Open(ctx, &pb.OpenRequest{Path: "/proj/two", Mode: pb.OpenMode_OPEN_MODE_WRITE, SessionId: root.SessionId}); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_NO_SPACE {
+		t.Errorf("Expected NO_SPACE for a second entry, got: %v", err)
+	}
+	if storage.Exists("/proj/two") {
+		t.Errorf("Expected the refused entry not to exist")
+	}
+
+	// Removing a file releases its usage
+	if _, err := client.Remove(ctx, &pb.RemoveRequest{Path: "/a.txt", SessionId: alice.SessionId}); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	quota, err := client.GetQuota(ctx, &pb.GetQuotaRequest{SessionId: alice.SessionId, Kind: pb.QuotaKind_QUOTA_KIND_USER, Name: "alice"})
+	if err != nil {
+		t.Fatalf("Failed to get quota: %v", err)
+	}
+	if quota.MaxBytes != 10 || quota.UsedBytes != 2 || quota.UsedInodes != 1 {
+		t.Errorf("Expected 2 bytes in 1 inode of 10 bytes, got: %v", quota)
+	}
+	if _, err := client.GetQuota(ctx, &pb.GetQuotaRequest{SessionId: alice.SessionId, Kind: pb.QuotaKind_QUOTA_KIND_USER, Name: "root"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied reading another user's quota, got: %v", err)
+	}
+
+	statfs, err := client.StatFs(ctx, &pb.StatFsRequest{SessionId: alice.SessionId, Path: "/proj/two"})
+	if err != nil {
+		t.Fatalf("StatFs failed: %v", err)
+	}
+	if n := len(statfs.Quotas); n != 3 {
+		t.Fatalf("Expected user, group and directory quotas, got %d", n)
+	}
+	if dir := statfs.Quotas[2]; dir.Name != "/proj" || dir.MaxInodes != 1 || dir.UsedInodes != 1 {
+		t.Errorf("Expected /proj with 1 of 1 inodes used, got: %v", dir)
+	}
+
+	// A file removed while open stays charged to its owner, and writes to
+	// it are still held to the quota, until its last FD is closed
+	held, err := client.Open(ctx, &pb.OpenRequest{Path: "/held.txt", Mode: pb.OpenMode_OPEN_MODE_WRITE, SessionId: alice.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	if _, err := client.Remove(ctx, &pb.RemoveRequest{Path: "/held.txt", SessionId: alice.SessionId}); err != nil {
+		t.Fatalf("Failed to remove open file: %v", err)
+	}
+	stream, err = client.Write(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create write stream: %v", err)
+	}
+	stream.Send(&pb.WriteRequest{Data: &pb.WriteRequest_Metadata{Metadata: &pb.WriteMetadata{Fd: held.Fd, SessionId: held.SessionId}}})
+	stream.Send(&pb.WriteRequest{Data: &pb.WriteRequest_Chunk{Chunk: []byte("12345678")}})
+	stream.Send(&pb.WriteRequest{Data: &pb.WriteRequest_Chunk{Chunk: make([]byte, 1<<20)}})
+	resp, err = stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("Expected a partial-failure response, got: %v", err)
+	}
+	if resp.BytesWritten != 8 || resp.ErrorCode != pb.FSErrorCode_FS_ERROR_CODE_NO_SPACE {
+		t.Errorf("Expected 8 committed bytes with NO_SPACE, got: %d, %v", resp.BytesWritten, resp.ErrorCode)
+	}
+	if _, err := client.Fallocate(ctx, &pb.FallocateRequest{Fd: held.Fd, SessionId: held.SessionId, Length: 1 << 20}); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_NO_SPACE {
+		t.Errorf("Expected NO_SPACE reserving past the quota, got: %v", err)
+	}
+	quota, err = client.GetQuota(ctx, &pb.GetQuotaRequest{SessionId: alice.SessionId, Kind: pb.QuotaKind_QUOTA_KIND_USER, Name: "alice"})
+	if err != nil {
+		t.Fatalf("Failed to get quota: %v", err)
+	}
+	if quota.UsedBytes != 10 || quota.UsedInodes != 2 {
+		t.Errorf("Expected 10 bytes in 2 inodes while the file is open, got: %v", quota)
+	}
+	if _, err := client.Close(ctx, &pb.CloseRequest{Fd: held.Fd, SessionId: held.SessionId}); err != nil {
+		t.Fatalf("Failed to close file: %v", err)
+	}
+	quota, err = client.GetQuota(ctx, &pb.GetQuotaRequest{SessionId: alice.SessionId, Kind: pb.QuotaKind_QUOTA_KIND_USER, Name: "alice"})
+	if err != nil {
+		t.Fatalf("Failed to get quota: %v", err)
+	}
+	if quota.UsedBytes != 2 || quota.UsedInodes != 1 {
+		t.Errorf("Expected 2 bytes in 1 inode after the last close, got: %v", quota)
+	}
+}
+
+func TestQuota_Accounting(t *testing.T) {
+	storage := NewMemoryStorage()
+	create := func(filePath string) *FileData {
+		t.Helper()
+		if err := storage.Create(filePath, &pb.FileInfo{
+			Type:  pb.FileType_FILE_TYPE_REGULAR,
+			Mode:  0644,
+			Owner: "alice",
+			Group: "users",
+		}); err != nil {
+			t.Fatalf("Failed to create %s: %v", filePath, err)
+		}
+		data, _ := storage.Get(filePath)
+		return data
+	}
+	usage := func(kind pb.QuotaKind, name string) (int64, int64) {
+		t.Helper()
+		quota, err := storage.GetQuota(kind, name)
+		if err != nil {
+			t.Fatalf("Failed to get quota: %v", err)
+		}
+		return quota.UsedBytes, quota.UsedInodes
+	}
+
+	// Reservations count like data, and truncation releases them
+	data := create("/a.txt")
+	if _, _, err := storage.Allocate(data, 0, 100, true); err != nil {
+		t.Fatalf("Failed to allocate: %v", err)
+	}
+	if err := storage.WriteAt(data, []byte("hello"), 0); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if bytes, inodes := usage(pb.QuotaKind_QUOTA_KIND_USER, "alice"); bytes != 100 || inodes != 1 {
+		t.Errorf("Expected the reservation to be charged, got %d bytes in %d inodes", bytes, inodes)
+	}
+	if _, err := storage.Truncate(data, 20); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if bytes, _ := usage(pb.QuotaKind_QUOTA_KIND_GROUP, "users"); bytes != 20 {
+		t.Errorf("Expected 20 bytes after truncation, got %d", bytes)
+	}
+
+	// Holes are free: a file is charged for the extents it stores, from
+	// the start of each extent to the last byte written in it
+	sparse := create("/sparse.txt")
+	if err := storage.WriteAt(sparse, []byte("x"), 1<<20); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if _, err := storage.Truncate(sparse, 4<<20); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+	if err := storage.WriteAt(sparse, []byte("y"), 2<<20+9); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if bytes, _ := usage(pb.QuotaKind_QUOTA_KIND_USER, "alice"); bytes != 20+1+10 {
+		t.Errorf("Expected 11 bytes charged for the sparse file, got %d", bytes-20)
+	}
+
+	// Reserving a range counts only the part that holds no data
+	if _, _, err := storage.Allocate(sparse, 2<<20, 100, true); err != nil {
+		t.Fatalf("Failed to allocate: %v", err)
+	}
+	if bytes, _ := usage(pb.QuotaKind_QUOTA_KIND_USER, "alice"); bytes != 20+1+100 {
+		t.Errorf("Expected 101 bytes charged with the reservation, got %d", bytes-20)
+	}
+	if _, err := storage.Unlink("/sparse.txt"); err != nil {
+		t.Fatalf("Failed to unlink: %v", err)
+	}
+
+	// A new owner takes over the usage
+	if _, err := storage.UpdateInfo(data, func(info *pb.FileInfo) error {
+		info.Owner = "bob"
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to update info: %v", err)
+	}
+	if bytes, inodes := usage(pb.QuotaKind_QUOTA_KIND_USER, "alice"); bytes != 0 || inodes != 0 {
+		t.Errorf("Expected alice to be charged nothing, got %d bytes in %d inodes", bytes, inodes)
+	}
+	if bytes, _ := usage(pb.QuotaKind_QUOTA_KIND_USER, "bob"); bytes != 20 {
+		t.Errorf("Expected bob to be charged 20 bytes, got %d", bytes)
+	}
+
+	// An unlinked file nobody holds open is no longer charged, even while
+	// written
+	if _, err := storage.Unlink("/a.txt"); err != nil {
+		t.Fatalf("Failed to unlink: %v", err)
+	}
+	storage.WriteAt(data, make([]byte, 50), 0)
+	if bytes, inodes := usage(pb.QuotaKind_QUOTA_KIND_USER, "bob"); bytes != 0 || inodes != 0 {
+		t.Errorf("Expected nothing charged after unlink, got %d bytes in %d inodes", bytes, inodes)
+	}
+
+	// The maximum file size applies to every way of growing a file
+	storage.SetMaxFileSize(16)
+	big := create("/big.txt")
+	if err := storage.WriteAt(big, []byte("x"), 16); !errors.Is(err, errFileTooLarge) {
+		t.Errorf("Expected a write past the limit to fail, got: %v", err)
+	}
+	if _, err := storage.Truncate(big, 17); !errors.Is(err, errFileTooLarge) {
+		t.Errorf("Expected truncation past the limit to fail, got: %v", err)
+	}
+	if err := storage.WriteAt(big, []byte("x"), 15); err != nil {
+		t.Errorf("Expected a write up to the limit, got: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+)
+
+func TestRead_RangesAndBounds(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	const content = "header|column-a|column-b|footer"
+	if err := writeTestFile(ctx, client, sessionResp.SessionId, "/table.dat", content); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      "/table.dat",
+		Mode:      pb.OpenMode_OPEN_MODE_READ,
+		SessionId: sessionResp.SessionId,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	fd := openResp.Fd
+
+	tests := []struct {
+		name string
+		req  *pb.ReadRequest
+		want []string
+	}{
+		{"offset past EOF", &pb.ReadRequest{Fd: fd, SessionId: openResp.SessionId, Offset: 1000, Count: 10}, []string{""}},
+		{"count past EOF", &pb.ReadRequest{Fd: fd, SessionId: openResp.SessionId, Offset: 25, Count: 100}, []string{"footer"}},
+		{"count beyond int32", &pb.ReadRequest{Fd: fd, SessionId: openResp.SessionId, Offset: 0, Count: math.MaxInt64}, []string{content}},
+		{"multiple ranges", &pb.ReadRequest{Fd: fd, SessionId: openResp.SessionId, Ranges: []*pb.ReadRange{
+			{Offset: -6},
+			{Offset: 7, Count: 8},
+			{Offset: 2000, Count: 1},
+		}}, []string{"footer", "column-a", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readStream, err := client.Read(ctx, tt.req)
+			if err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+
+			var metadata *pb.ReadMetadata
+			got := make([]string, len(tt.want))
+			var streamed int64
+			for {
+				resp, err := readStream.Recv()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Failed to receive: %v", err)
+				}
+				if m := resp.GetMetadata(); m != nil {
+					metadata = m
+					continue
+				}
+
+				r := metadata.Ranges[resp.RangeIndex]
+				if want := r.Offset + int64(len(got[resp.RangeIndex])); resp.ChunkOffset != want {
+					t.Errorf("Chunk offset mismatch. Expected: %d, Got: %d", want, resp.ChunkOffset)
+				}
+				got[resp.RangeIndex] += string(resp.GetChunk())
+				streamed += int64(len(resp.GetChunk()))
+			}
+
+			if metadata.TotalSize != streamed {
+				t.Errorf("total_size mismatch. Expected: %d, Got: %d", streamed, metadata.TotalSize)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("Range %d mismatch. Expected: %q, Got: %q", i, tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRead_ChunkSizes(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	// Written in pieces since a single chunk is limited by the message size
+	content := make([]byte, 3<<20)
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      "/chunks.dat",
+		Mode:      pb.OpenMode_OPEN_MODE_WRITE,
+		SessionId: sessionResp.SessionId,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	writeStream, err := client.Write(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create write stream: %v", err)
+	}
+	if err := writeStream.Send(&pb.WriteRequest{
+		Data: &pb.WriteRequest_Metadata{Metadata: &pb.WriteMetadata{Fd: openResp.Fd, SessionId: openResp.SessionId}},
+	}); err != nil {
+		t.Fatalf("Failed to send metadata: %v", err)
+	}
+	for pos := 0; pos < len(content); pos += 1 << 20 {
+		if err := writeStream.Send(&pb.WriteRequest{
+			Data: &pb.WriteRequest_Chunk{Chunk: content[pos : pos+1<<20]},
+		}); err != nil {
+			t.Fatalf("Failed to send chunk: %v", err)
+		}
+	}
+	if _, err := writeStream.CloseAndRecv(); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	openResp, err = client.Open(ctx, &pb.OpenRequest{
+		Path:      "/chunks.dat",
+		Mode:      pb.OpenMode_OPEN_MODE_READ,
+		SessionId: sessionResp.SessionId,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+
+	cfg := DefaultConfig()
+	tests := []struct {
+		name      string
+		requested int32
+		first     int
+		largest   int
+	}{
+		{"requested", 8 * 1024, 8 * 1024, 8 * 1024},
+		{"clamped to minimum", 1, cfg.MinChunkSize, cfg.MinChunkSize},
+		{"clamped to maximum", 64 << 20, cfg.MaxChunkSize, cfg.MaxChunkSize},
+		{"adaptive", 0, cfg.ChunkSize, cfg.MaxChunkSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readStream, err := client.Read(ctx, &pb.ReadRequest{
+				Fd:        openResp.Fd,
+				Offset:    0,
+				ChunkSize: tt.requested,
+				SessionId: openResp.SessionId,
+			})
+			if err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+
+			var sizes []int
+			var total int
+			for {
+				resp, err := readStream.Recv()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Failed to receive: %v", err)
+				}
+				if m := resp.GetMetadata(); m != nil {
+					if int(m.ChunkSize) != tt.largest {
+						t.Errorf("Metadata chunk size mismatch. Expected: %d, Got: %d", tt.largest, m.ChunkSize)
+					}
+					continue
+				}
+				sizes = append(sizes, len(resp.GetChunk()))
+				total += len(resp.GetChunk())
+			}
+
+			if total != len(content) {
+				t.Fatalf("Size mismatch. Expected: %d, Got: %d", len(content), total)
+			}
+			if sizes[0] != tt.first || slices.Max(sizes) != tt.largest {
+				t.Errorf("Expected chunks from %d up to %d bytes, got first %d and largest %d",
+					tt.first, tt.largest, sizes[0], slices.Max(sizes))
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRemove_UnlinkWhileOpen(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	sessionID := sessionResp.SessionId
+
+	if err := writeTestFile(ctx, client, sessionID, "/scratch.txt", "still here"); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      "/scratch.txt",
+		Mode:      pb.OpenMode_OPEN_MODE_READ,
+		SessionId: sessionID,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+
+	removeResp, err := client.Remove(ctx, &pb.RemoveRequest{
+		Path:      "/scratch.txt",
+		SessionId: sessionID,
+	})
+	if err != nil {
+		t.Fatalf("Failed to remove open file: %v", err)
+	}
+	if !removeResp.StillOpen {
+		t.Errorf("Expected StillOpen for a file with an open FD")
+	}
+	if storage.Exists("/scratch.txt") {
+		t.Errorf("Expected path to be gone after Remove")
+	}
+
+	// The open FD must still see the content
+	readStream, err := client.Read(ctx, &pb.ReadRequest{Fd: openResp.Fd, SessionId: openResp.SessionId, Offset: -1, Count: -1})
+	if err != nil {
+		t.Fatalf("Failed to read unlinked file: %v", err)
+	}
+	var content []byte
+	for {
+		resp, err := readStream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read unlinked file: %v", err)
+		}
+		content = append(content, resp.GetChunk()...)
+	}
+	if string(content) != "still here" {
+		t.Errorf("Content mismatch. Expected: %q, Got: %q", "still here", content)
+	}
+
+	if _, err := client.Close(ctx, &pb.CloseRequest{Fd: openResp.Fd, SessionId: openResp.SessionId}); err != nil {
+		t.Fatalf("Failed to close FD: %v", err)
+	}
+}
+
+func TestRemove_StickyDirectory(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	if err := storage.Create("/tmp", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+		Mode:  01777,
+		Owner: "root",
+		Group: "root",
+	}); err != nil {
+		t.Fatalf("Failed to create /tmp: %v", err)
+	}
+
+	alice, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice", Groups: []string{"users"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	bob, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "bob", Groups: []string{"users"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if err := writeTestFile(ctx, client, alice.SessionId, "/tmp/alice.txt", "mine"); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	_, err = client.Remove(ctx, &pb.RemoveRequest{Path: "/tmp/alice.txt", SessionId: bob.SessionId})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied removing another user's file, got: %v", err)
+	}
+
+	if _, err := client.Remove(ctx, &pb.RemoveRequest{Path: "/tmp/alice.txt", SessionId: alice.SessionId}); err != nil {
+		t.Errorf("Expected owner to remove own file, got: %v", err)
+	}
+}
+
+func TestRemoveAll_Tree(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	sessionID := sessionResp.SessionId
+
+	for _, dir := range []string{"/out", "/out/a"} {
+		if err := storage.Create(dir, &pb.FileInfo{
+			Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+			Mode:  0755,
+			Owner: "testuser",
+			Group: "testgroup",
+		}); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	for _, file := range []string{"/out/one.txt", "/out/a/two.txt"} {
+		if err := writeTestFile(ctx, client, sessionID, file, "x"); err != nil {
+			t.Fatalf("Failed to write %s: %v", file, err)
+		}
+	}
+
+	_, err = client.Remove(ctx, &pb.RemoveRequest{Path: "/out", SessionId: sessionID})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition removing non-empty directory, got: %v", err)
+	}
+
+	// Whether a directory is empty is not revealed to callers who may not
+	// remove it
+	other, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "other"})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	_, err = client.Remove(ctx, &pb.RemoveRequest{Path: "/out/a", SessionId: other.SessionId})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied removing another user's directory, got: %v", err)
+	}
+
+	stream, err := client.RemoveAll(ctx, &pb.RemoveRequest{Path: "/out", SessionId: sessionID})
+	if err != nil {
+		t.Fatalf("Failed to start RemoveAll: %v", err)
+	}
+
+	var last *pb.RemoveProgress
+	for {
+		progress, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("RemoveAll failed: %v", err)
+		}
+		last = progress
+	}
+
+	if last == nil || last.Path != "/out" || last.Removed != 4 || last.Total != 4 {
+		t.Errorf("Unexpected final progress: %v", last)
+	}
+	if len(storage.Tree("/out")) != 0 {
+		t.Errorf("Expected tree to be empty after RemoveAll")
+	}
+}
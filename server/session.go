@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -10,17 +11,46 @@ import (
 
 // Session represents a user session with its own FD table and permissions
 type Session struct {
-	ID        string
-	User      string
-	Groups    []string
-	FDTable   *FDTable
-	CreatedAt time.Time
+	ID          string
+	User        string
+	Groups      []string
+	Capability  *Capability      // Set for sessions created from a capability instead of an identity
+	Permissions *PermissionCache // Directories the session's identity may traverse
+	FDTable     *FDTable
+	CreatedAt   time.Time
+
+	stdio   *sessionStdio // Pipes behind FDs 0-2; nil unless requested
+	inbox   fdInbox       // FDs sent to the session and not yet received
+	sending atomic.Int32  // FDs the session has sent that are not yet received
+	streams atomic.Int32  // Streaming RPCs in progress
+	rate    *rateLimiter  // Byte rate limit; nil if unlimited
+}
+
+// PrimaryGroup returns the group new files are created with, or "" if the
+// session has no groups
+func (s *Session) PrimaryGroup() string {
+	if len(s.Groups) == 0 {
+		return ""
+	}
+	return s.Groups[0]
+}
+
+// Creator returns the owner and group of files the session creates: the
+// session's user and primary group, or the issuer of its capability
+func (s *Session) Creator() (owner, group string) {
+	if s.Capability != nil {
+		return s.Capability.Issuer, s.Capability.IssuerGroup
+	}
+	return s.User, s.PrimaryGroup()
 }
 
 // SessionManager manages active sessions
 type SessionManager struct {
 	mu       sync.RWMutex
 	sessions map[string]*Session
+
+	limits SessionLimits
+	hits   limitCounters
 }
 
 // NewSessionManager creates a new session manager
@@ -30,7 +60,8 @@ func NewSessionManager() *SessionManager {
 	}
 }
 
-// Create creates a new session
+// Create creates a new session. It fails with errTooManySessions when the
+// user already holds as many sessions as the limits allow.
 func (sm *SessionManager) Create(user string, groups []string) (*Session, error) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
@@ -38,18 +69,68 @@ func (sm *SessionManager) Create(user string, groups []string) (*Session, error)
 	sessionID := uuid.New().String()
 
 	session := &Session{
-		ID:        sessionID,
-		User:      user,
-		Groups:    groups,
-		FDTable:   NewFDTable(),
-		CreatedAt: time.Now(),
+		ID:          sessionID,
+		User:        user,
+		Groups:      groups,
+		Permissions: NewPermissionCache(),
+		FDTable:     NewFDTable(),
+		CreatedAt:   time.Now(),
+	}
+
+	if err := sm.add(session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// CreateWithCapability creates a session whose access comes from the
+// capability c rather than from a user and groups
+func (sm *SessionManager) CreateWithCapability(c *Capability) (*Session, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	session := &Session{
+		ID:         uuid.New().String(),
+		Capability: c,
+		FDTable:    NewFDTable(),
+		CreatedAt:  time.Now(),
 	}
 
-	sm.sessions[sessionID] = session
+	if err := sm.add(session); err != nil {
+		return nil, err
+	}
 
 	return session, nil
 }
 
+// add applies the limits to a new session and registers it, unless its
+// user is already at the session limit. The caller must hold sm.mu.
+func (sm *SessionManager) add(session *Session) error {
+	if limit := sm.limits.SessionsPerUser; limit > 0 {
+		user, _ := session.Creator()
+		open := 0
+		for _, other := range sm.sessions {
+			if owner, _ := other.Creator(); owner == user {
+				open++
+			}
+		}
+		if open >= limit {
+			sm.hits.sessions.Add(1)
+			return fmt.Errorf("%w for user %s (limit %d)", errTooManySessions, user, limit)
+		}
+	}
+
+	session.FDTable.limit = sm.limits.FDsPerSession
+	session.FDTable.rejected = &sm.hits.fds
+	if sm.limits.BytesPerSecond > 0 {
+		session.rate = newRateLimiter(sm.limits.BytesPerSecond)
+	}
+
+	sm.sessions[session.ID] = session
+	return nil
+}
+
 // Get retrieves a session by ID
 func (sm *SessionManager) Get(sessionID string) (*Session, error) {
 	sm.mu.RLock()
@@ -73,18 +154,13 @@ func (sm *SessionManager) Close(sessionID string, storage *MemoryStorage) error
 		return fmt.Errorf("invalid or expired session: %s", sessionID)
 	}
 
-	// Close all open file descriptors and decrement refcounts
-	openFDs := session.FDTable.CloseAll()
-	for _, fd := range openFDs {
-		// Note: We ignore errors here during cleanup
-		// Get handle to find path (handle is already removed from table)
-		handles := session.FDTable.List()
-		for _, handle := range handles {
-			if handle.FD == fd {
-				_ = storage.DecRef(handle.Path)
-				break
-			}
-		}
+	// Close all open file descriptors and drop their storage references.
+	// Releasing through the FileData also covers files unlinked while open.
+	for _, handle := range session.FDTable.CloseAll() {
+		handle.release(storage)
+	}
+	for _, handle := range session.inbox.close() {
+		handle.release(storage)
 	}
 
 	// Remove session from map
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"path"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// memoryBackend names the in-memory storage backend
+	memoryBackend = "memory"
+
+	// nameMax is the longest path component, in bytes
+	nameMax = 255
+)
+
+// Backend returns the name of the storage backend
+func (s *MemoryStorage) Backend() string {
+	return memoryBackend
+}
+
+// Features reports which optional features the storage backend supports
+func (s *MemoryStorage) Features() *pb.FsFeatures {
+	return &pb.FsFeatures{
+		Xattrs: true,
+		Acls:   true,
+	}
+}
+
+// SetCapacity limits the bytes and inodes of the whole filesystem; 0 is
+// unlimited. Like a quota, a lower capacity than is in use only stops
+// further growth.
+func (s *MemoryStorage) SetCapacity(bytes, inodes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if bytes == 0 && inodes == 0 {
+		delete(s.quotas.limits, filesystemKey)
+		return
+	}
+	s.quotas.limits[filesystemKey] = quotaUsage{bytes: bytes, inodes: inodes}
+}
+
+// StatFs reports the capacity and usage of the filesystem, and what a
+// file created at filePath by owner and group may still use under the
+// capacity and the quotas it is charged to
+func (s *MemoryStorage) StatFs(owner, group, filePath string) *pb.StatFsResponse {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	capacity := s.quotas.limits[filesystemKey]
+	used := s.quotas.usage[filesystemKey]
+	resp := &pb.StatFsResponse{
+		Quotas:          s.quotasFor(owner, group, filePath),
+		Backend:         s.Backend(),
+		TotalBytes:      capacity.bytes,
+		UsedBytes:       used.bytes,
+		AvailableBytes:  headroom(capacity.bytes, used.bytes),
+		TotalInodes:     capacity.inodes,
+		UsedInodes:      used.inodes,
+		AvailableInodes: headroom(capacity.inodes, used.inodes),
+		MaxFileSize:     s.quotas.maxFileSize,
+		MaxNameLength:   nameMax,
+		Features:        s.Features(),
+	}
+
+	// The tightest limit decides what is available
+	for _, quota := range resp.Quotas {
+		resp.AvailableBytes = minHeadroom(resp.AvailableBytes, headroom(quota.MaxBytes, quota.UsedBytes))
+		resp.AvailableInodes = minHeadroom(resp.AvailableInodes, headroom(quota.MaxInodes, quota.UsedInodes))
+	}
+
+	return resp
+}
+
+// headroom returns what remains of limit after used, or -1 if limit is 0
+// (unlimited)
+func headroom(limit, used int64) int64 {
+	if limit == 0 {
+		return -1
+	}
+	return max(limit-used, 0)
+}
+
+// minHeadroom returns the smaller of two headrooms, where -1 is unlimited
+func minHeadroom(a, b int64) int64 {
+	if a < 0 {
+		return b
+	}
+	if b < 0 {
+		return a
+	}
+	return min(a, b)
+}
+
+// StatFs reports df-style capacity and usage, the quotas that files the
+// session creates at a path are charged to, and what the storage backend
+// supports
+func (s *Plan92ServiceImpl) StatFs(
+	ctx context.Context,
+	req *pb.StatFsRequest,
+) (*pb.StatFsResponse, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	filePath := path.Clean(req.Path)
+	if !path.IsAbs(filePath) {
+		return nil, status.Errorf(codes.InvalidArgument, "path must be absolute: %s", req.Path)
+	}
+
+	owner, group := session.Creator()
+	return s.storage.StatFs(owner, group, filePath), nil
+}
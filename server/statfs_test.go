@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+)
+
+func TestStatFs_CapacityAndUsage(t *testing.T) {
+	server, lis, storage, _ := setupPrivilegedTestServer(t, "root")
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	storage.SetCapacity(100, 3)
+	alice, _ := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice", Groups: []string{"users"}})
+	root, _ := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "root"})
+	if _, err := client.SetQuota(ctx, &pb.SetQuotaRequest{
+		SessionId: root.SessionId, Kind: pb.QuotaKind_QUOTA_KIND_USER, Name: "alice", MaxBytes: 50,
+	}); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+
+	if err := writeTestFile(ctx, client, alice.SessionId, "/a.txt", strings.Repeat("a", 30)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := writeTestFile(ctx, client, root.SessionId, "/b.txt", strings.Repeat("b", 40)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	statfs := func(sessionID string) *pb.StatFsResponse {
+		t.Helper()
+		resp, err := client.StatFs(ctx, &pb.StatFsRequest{SessionId: sessionID, Path: "/"})
+		if err != nil {
+			t.Fatalf("StatFs failed: %v", err)
+		}
+		return resp
+	}
+
+	// Usage is filesystem-wide; what is available depends on the quotas
+	// of the caller
+	resp := statfs(alice.SessionId)
+	if resp.Backend != memoryBackend || resp.TotalBytes != 100 || resp.UsedBytes != 70 || resp.TotalInodes != 3 || resp.UsedInodes != 2 {
+		t.Errorf("Unexpected capacity and usage: %v", resp)
+	}
+	if resp.AvailableBytes != 20 || resp.AvailableInodes != 1 {
+		t.Errorf("Expected alice's quota to leave 20 bytes and 1 inode, got %d and %d", resp.AvailableBytes, resp.AvailableInodes)
+	}
+	if resp = statfs(root.SessionId); resp.AvailableBytes != 30 {
+		t.Errorf("Expected the capacity to leave root 30 bytes, got %d", resp.AvailableBytes)
+	}
+	if resp.MaxFileSize != 0 || resp.MaxNameLength != nameMax || !resp.Features.Xattrs || resp.Features.Symlinks || resp.Features.Locks {
+		t.Errorf("Unexpected limits and features: %v", resp)
+	}
+
+	// The capacity is enforced like a quota
+	if err := writeTestFile(ctx, client, root.SessionId, "/c.txt", ""); err != nil {
+		t.Fatalf("Failed to create the last inode: %v", err)
+	}
+	if _, err := client.Open(ctx, &pb.OpenRequest{Path: "/d.txt", Mode: pb.OpenMode_OPEN_MODE_WRITE, SessionId: root.SessionId}); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_NO_SPACE {
+		t.Errorf("Expected NO_SPACE past the inode capacity, got: %v", err)
+	}
+
+	// Names longer than the maximum are refused
+	storage.SetCapacity(0, 0)
+	long := "/" + strings.Repeat("x", nameMax+1)
+	if _, err := client.Open(ctx, &pb.OpenRequest{Path: long, Mode: pb.OpenMode_OPEN_MODE_WRITE, SessionId: root.SessionId}); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_NAME_TOO_LONG {
+		t.Errorf("Expected NAME_TOO_LONG, got: %v", err)
+	}
+	if resp = statfs(root.SessionId); resp.TotalBytes != 0 || resp.AvailableBytes != -1 || resp.AvailableInodes != -1 {
+		t.Errorf("Expected unlimited capacity, got: %v", resp)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Paths reported for the standard FDs, which are not in the namespace
+var stdioPaths = [3]string{"/dev/stdin", "/dev/stdout", "/dev/stderr"}
+
+// sessionStdio holds the pipes behind a session's standard FDs
+type sessionStdio struct {
+	pipes    [3]*Pipe
+	attached atomic.Bool // An AttachStdio stream is using the pipes
+}
+
+// openStdio opens pipes at FDs 0, 1 and 2 of a new session: standard input
+// for reading and standard output and error for writing. The pipes belong
+// to the session alone and are freed when their last FD is closed.
+func (session *Session) openStdio() error {
+	owner, group := session.Creator()
+	stdio := &sessionStdio{}
+	for fd, mode := range []pb.OpenMode{
+		pb.OpenMode_OPEN_MODE_READ,
+		pb.OpenMode_OPEN_MODE_WRITE,
+		pb.OpenMode_OPEN_MODE_WRITE,
+	} {
+		data := &FileData{
+			Content: &Extents{},
+			Info: &pb.FileInfo{
+				Type:  pb.FileType_FILE_TYPE_PIPE,
+				Mode:  0600,
+				Owner: owner,
+				Group: group,
+			},
+			RefCount: 1,
+			Pipe:     NewPipe(),
+		}
+		if err := session.FDTable.Install(int32(fd), stdioPaths[fd], mode, data); err != nil {
+			return err
+		}
+		if isWritable(mode) {
+			data.Pipe.OpenWriter()
+		}
+		stdio.pipes[fd] = data.Pipe
+	}
+
+	session.stdio = stdio
+	return nil
+}
+
+// AttachStdio connects a client to the standard FDs of a session: data it
+// sends is written to standard input, and what the session writes to
+// standard output and error is sent back. The stream ends once both
+// output pipes are closed and the client has closed its send side.
+func (s *Plan92ServiceImpl) AttachStdio(stream pb.Plan92_AttachStdioServer) error {
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to receive request: %v", err)
+	}
+
+	attach := first.GetAttach()
+	if attach == nil {
+		return status.Errorf(codes.InvalidArgument, "first request must be an attach")
+	}
+
+	session, err := s.sessions.Get(attach.SessionId)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	stdio := session.stdio
+	if stdio == nil {
+		return status.Errorf(codes.FailedPrecondition, "session %s was created without stdio", session.ID)
+	}
+	if !stdio.attached.CompareAndSwap(false, true) {
+		return status.Errorf(codes.FailedPrecondition, "stdio of session %s is already attached", session.ID)
+	}
+	defer stdio.attached.Store(false)
+
+	// The stream is the writer of standard input until the client closes
+	// its send side or the stream is cancelled. The handler waits for the
+	// receiving goroutine, so Recv is never called after it returns. Once
+	// the output is done, a write waiting for room in a full stdin is
+	// given up rather than holding the stream open.
+	stdin := stdio.pipes[0]
+	stdin.OpenWriter()
+	stdinCtx, stopStdin := context.WithCancel(stream.Context())
+	defer stopStdin()
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		defer stdin.CloseWriter()
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			if _, err := stdin.Write(stdinCtx, req.GetStdin()); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	var (
+		sendMu  sync.Mutex
+		wg      sync.WaitGroup
+		sendErr error
+	)
+	forward := func(p *Pipe, wrap func([]byte) *pb.StdioResponse) {
+		defer wg.Done()
+		buf := make([]byte, s.config.ChunkSize)
+		for {
+			n, err := p.Read(ctx, buf)
+			if err != nil {
+				return
+			}
+
+			sendMu.Lock()
+			err = stream.Send(wrap(buf[:n]))
+			if err != nil && sendErr == nil {
+				sendErr = err
+				cancel()
+			}
+			sendMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	wg.Add(2)
+	go forward(stdio.pipes[1], func(b []byte) *pb.StdioResponse {
+		return &pb.StdioResponse{Msg: &pb.StdioResponse_Stdout{Stdout: b}}
+	})
+	go forward(stdio.pipes[2], func(b []byte) *pb.StdioResponse {
+		return &pb.StdioResponse{Msg: &pb.StdioResponse_Stderr{Stderr: b}}
+	})
+	wg.Wait()
+	stopStdin()
+	<-received
+
+	if sendErr != nil {
+		return sendErr
+	}
+	return status.FromContextError(stream.Context().Err()).Err()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStdio_AttachFeedsStdinAndForwardsOutput(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	session, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice", Stdio: true})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	attach := func() pb.Plan92_AttachStdioClient {
+		t.Helper()
+		stream, err := client.AttachStdio(ctx)
+		if err != nil {
+			t.Fatalf("Failed to start AttachStdio: %v", err)
+		}
+		if err := stream.Send(&pb.StdioRequest{Msg: &pb.StdioRequest_Attach{Attach: &pb.StdioAttach{SessionId: session.SessionId}}}); err != nil {
+			t.Fatalf("Failed to attach: %v", err)
+		}
+		return stream
+	}
+	stdio := attach()
+	if err := stdio.Send(&pb.StdioRequest{Msg: &pb.StdioRequest_Stdin{Stdin: []byte("hello\n")}}); err != nil {
+		t.Fatalf("Failed to send stdin: %v", err)
+	}
+	stdio.CloseSend()
+
+	// Closing the send side lets the session read stdin to EOF
+	read, err := client.Read(ctx, &pb.ReadRequest{Fd: 0, Count: -1, SessionId: session.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to read stdin: %v", err)
+	}
+	var stdin []byte
+	for {
+		resp, err := read.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read stdin: %v", err)
+		}
+		stdin = append(stdin, resp.GetChunk()...)
+	}
+	if string(stdin) != "hello\n" {
+		t.Errorf("Expected stdin %q, got %q", "hello\n", stdin)
+	}
+
+	// Only one stream may be attached at a time
+	if _, err := attach().Recv(); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition for a second attach, got: %v", err)
+	}
+
+	for fd, data := range map[int32]string{1: "out", 2: "err"} {
+		write, err := client.Write(ctx)
+		if err != nil {
+			t.Fatalf("Failed to start write: %v", err)
+		}
+		write.Send(&pb.WriteRequest{Data: &pb.WriteRequest_Metadata{Metadata: &pb.WriteMetadata{Fd: fd, Offset: -1, SessionId: session.SessionId}}})
+		write.Send(&pb.WriteRequest{Data: &pb.WriteRequest_Chunk{Chunk: []byte(data)}})
+		if _, err := write.CloseAndRecv(); err != nil {
+			t.Fatalf("Failed to write to FD %d: %v", fd, err)
+		}
+		if _, err := client.Close(ctx, &pb.CloseRequest{Fd: fd, SessionId: session.SessionId}); err != nil {
+			t.Fatalf("Failed to close FD %d: %v", fd, err)
+		}
+	}
+
+	// Output arrives per pipe, and the stream ends once both are closed
+	var stdout, stderr []byte
+	for {
+		resp, err := stdio.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to receive output: %v", err)
+		}
+		stdout = append(stdout, resp.GetStdout()...)
+		stderr = append(stderr, resp.GetStderr()...)
+	}
+	if string(stdout) != "out" || string(stderr) != "err" {
+		t.Errorf("Expected stdout %q and stderr %q, got %q and %q", "out", "err", stdout, stderr)
+	}
+
+	// Sessions have no standard FDs unless they ask for them
+	plain, _ := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "bob"})
+	stream, err := client.AttachStdio(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start AttachStdio: %v", err)
+	}
+	stream.Send(&pb.StdioRequest{Msg: &pb.StdioRequest_Attach{Attach: &pb.StdioAttach{SessionId: plain.SessionId}}})
+	if _, err := stream.Recv(); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition without stdio, got: %v", err)
+	}
+}
+
+func TestStdio_StreamEndsAfterClientCloses(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	session, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice", Stdio: true})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	stdio, err := client.AttachStdio(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start AttachStdio: %v", err)
+	}
+	if err := stdio.Send(&pb.StdioRequest{Msg: &pb.StdioRequest_Attach{Attach: &pb.StdioAttach{SessionId: session.SessionId}}}); err != nil {
+		t.Fatalf("Failed to attach: %v", err)
+	}
+	for _, fd := range []int32{1, 2} {
+		if _, err := client.Close(ctx, &pb.CloseRequest{Fd: fd, SessionId: session.SessionId}); err != nil {
+			t.Fatalf("Failed to close FD %d: %v", fd, err)
+		}
+	}
+
+	// With the outputs closed the stream still waits for the send side
+	ended := make(chan error, 1)
+	go func() {
+		_, err := stdio.Recv()
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		t.Fatalf("Expected the stream to stay open while the client sends, got: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	stdio.CloseSend()
+	if err := <-ended; err != io.EOF {
+		t.Fatalf("Expected EOF after closing the send side, got: %v", err)
+	}
+
+	// By then the stream no longer writes to stdin or holds the session
+	read, err := client.Read(ctx, &pb.ReadRequest{Fd: 0, Count: -1, SessionId: session.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to read stdin: %v", err)
+	}
+	for {
+		_, err := read.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read stdin: %v", err)
+		}
+	}
+	again, err := client.AttachStdio(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start AttachStdio: %v", err)
+	}
+	again.Send(&pb.StdioRequest{Msg: &pb.StdioRequest_Attach{Attach: &pb.StdioAttach{SessionId: session.SessionId}}})
+	again.CloseSend()
+	if _, err := again.Recv(); err != io.EOF {
+		t.Errorf("Expected a new attach to succeed, got: %v", err)
+	}
+}
@@ -1,31 +1,72 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"maps"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-// FileData represents the content and metadata of a file in storage
+var errNotEmpty = errors.New("directory not empty")
+
+// FileData represents the content and metadata of a file in storage.
+//
+// Content and Info are copy-on-write: a FileInfo is never modified once
+// stored, and a content version handed out by Snapshot is never modified
+// again. Writers publish replacements under the storage lock, so readers
+// should fetch both through Stat or Snapshot rather than the fields.
 type FileData struct {
-	Content  []byte
+	Content  *Extents
 	Info     *pb.FileInfo
-	RefCount int32 // Number of open file descriptors
+	RefCount int32             // Number of open file descriptors
+	Unlinked bool              // Removed from the namespace but still held open
+	Reserved byteRanges        // Ranges reserved by Fallocate, possibly past EOF
+	Pipe     *Pipe             // Buffer for FILE_TYPE_PIPE inodes, nil otherwise
+	Xattrs   map[string][]byte // Extended attributes; replaced, never modified
+	Version  uint64            // Metadata version; changes when ownership or permissions may have
+
+	path string // Where the file was stored, for quota accounting
+}
+
+// touch publishes new metadata after the content changed. The caller
+// must hold the storage write lock.
+func (d *FileData) touch() *pb.FileInfo {
+	info := proto.Clone(d.Info).(*pb.FileInfo)
+	info.Mtime = timestamppb.New(time.Now())
+	info.Length = d.Content.Size()
+	d.Info = info
+	return info
 }
 
 // MemoryStorage provides an in-memory storage backend for files
 type MemoryStorage struct {
-	mu    sync.RWMutex
-	files map[string]*FileData
+	mu       sync.RWMutex
+	files    map[string]*FileData
+	versions uint64 // Last metadata version handed out
+
+	// generation changes whenever the metadata of a stored entry is
+	// replaced or an entry leaves the namespace, so caches can tell that
+	// nothing relevant changed without taking the lock
+	generation atomic.Uint64
+
+	quotas quotaTable
 }
 
 // NewMemoryStorage creates a new in-memory storage backend
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		files: make(map[string]*FileData),
+		files:  make(map[string]*FileData),
+		quotas: newQuotaTable(),
 	}
 }
 
@@ -42,7 +83,99 @@ func (s *MemoryStorage) Get(path string) (*FileData, error) {
 	return data, nil
 }
 
-// Set stores file data at the given path
+// GetInfo retrieves the current metadata for the given path
+func (s *MemoryStorage) GetInfo(path string) (*pb.FileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, exists := s.files[path]
+	if !exists {
+		return nil, fmt.Errorf("file not found: %s", path)
+	}
+
+	return data.Info, nil
+}
+
+// Lookup retrieves the current metadata for the given path together with
+// its metadata version
+func (s *MemoryStorage) Lookup(path string) (*pb.FileInfo, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, exists := s.files[path]
+	if !exists {
+		return nil, 0, fmt.Errorf("file not found: %s", path)
+	}
+
+	return data.Info, data.Version, nil
+}
+
+// Versions returns the metadata versions of the given paths under a single
+// lock, with 0 for paths that do not exist
+func (s *MemoryStorage) Versions(paths []string) []uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := make([]uint64, len(paths))
+	for i, p := range paths {
+		if data, exists := s.files[p]; exists {
+			versions[i] = data.Version
+		}
+	}
+
+	return versions
+}
+
+// Generation returns the current storage generation
+func (s *MemoryStorage) Generation() uint64 {
+	return s.generation.Load()
+}
+
+// nextVersion returns a metadata version never handed out before. The
+// caller must hold the storage write lock.
+func (s *MemoryStorage) nextVersion() uint64 {
+	s.versions++
+	return s.versions
+}
+
+// Stat returns the current metadata of an open or stored file
+func (s *MemoryStorage) Stat(data *FileData) *pb.FileInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return data.Info
+}
+
+// Snapshot returns the current content version of the file together with
+// the matching metadata. Neither changes when the file is written
+// afterwards, so a reader can stream from them without holding the lock.
+func (s *MemoryStorage) Snapshot(data *FileData) (*Extents, *pb.FileInfo) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return data.Content.Freeze(), data.Info
+}
+
+// StatChecksummed returns the current metadata of the file with the
+// checksums of the matching content version filled in
+func (s *MemoryStorage) StatChecksummed(data *FileData) *pb.FileInfo {
+	return withChecksums(s.Snapshot(data))
+}
+
+// withChecksums returns a copy of info carrying the checksums of content.
+// Pipes have no stored content, so their info is returned unchanged.
+func withChecksums(content *Extents, info *pb.FileInfo) *pb.FileInfo {
+	if info.Type == pb.FileType_FILE_TYPE_PIPE {
+		return info
+	}
+
+	info = proto.Clone(info).(*pb.FileInfo)
+	info.Sha256, info.Crc32C = content.Checksums()
+	return info
+}
+
+// Set stores file data at the given path. Quotas are charged but not
+// enforced.
 func (s *MemoryStorage) Set(path string, content []byte, info *pb.FileInfo) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -54,21 +187,30 @@ func (s *MemoryStorage) Set(path string, content []byte, info *pb.FileInfo) erro
 	data, exists := s.files[path]
 	if exists {
 		// Update existing file
-		data.Content = content
+		s.charge(s.quotaKeys(path, data.Info), -fileUsage(data), -1)
+		data.Content = NewExtents(content)
 		data.Info = info
+		data.Version = s.nextVersion()
+		s.generation.Add(1)
 	} else {
 		// Create new file
-		s.files[path] = &FileData{
-			Content:  content,
+		data = &FileData{
+			Content:  NewExtents(content),
 			Info:     info,
 			RefCount: 0,
+			Version:  s.nextVersion(),
+			path:     path,
 		}
+		s.files[path] = data
 	}
+	s.charge(s.quotaKeys(path, info), fileUsage(data), 1)
 
 	return nil
 }
 
-// Create creates a new empty file with the given metadata
+// Create creates a new empty file with the given metadata. It fails with
+// errNoSpace if the new inode would exceed a quota, and with
+// errNameTooLong if its name is longer than nameMax bytes.
 func (s *MemoryStorage) Create(path string, info *pb.FileInfo) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -76,15 +218,37 @@ func (s *MemoryStorage) Create(path string, info *pb.FileInfo) error {
 	if _, exists := s.files[path]; exists {
 		return fmt.Errorf("file already exists: %s", path)
 	}
+	if name := path[strings.LastIndex(path, "/")+1:]; len(name) > nameMax {
+		return fmt.Errorf("%w: %s", errNameTooLong, name)
+	}
 
 	info.Mtime = timestamppb.New(time.Now())
 	info.Length = 0
 
-	s.files[path] = &FileData{
-		Content:  []byte{},
+	// New entries inherit the default ACL of their directory, and the
+	// group of a setgid directory
+	if parent, exists := s.files[parentDir(path)]; exists {
+		inheritAcl(parent.Info, info)
+		inheritGroup(parent.Info, info)
+	}
+
+	keys := s.quotaKeys(path, info)
+	if err := s.checkQuota(keys, 0, 1); err != nil {
+		return err
+	}
+
+	data := &FileData{
+		Content:  &Extents{},
 		Info:     info,
 		RefCount: 0,
+		Version:  s.nextVersion(),
+		path:     path,
+	}
+	if info.Type == pb.FileType_FILE_TYPE_PIPE {
+		data.Pipe = NewPipe()
 	}
+	s.files[path] = data
+	s.charge(keys, 0, 1)
 
 	return nil
 }
@@ -103,10 +267,352 @@ func (s *MemoryStorage) Delete(path string) error {
 		return fmt.Errorf("file is still open (refcount: %d)", data.RefCount)
 	}
 
+	s.release(data)
 	delete(s.files, path)
+	s.generation.Add(1)
+	return nil
+}
+
+// WriteAt writes p into the file at offset. Writing past end of file
+// leaves a hole instead of padding with zeros. Nothing is written if the
+// file would exceed a quota or the maximum file size.
+func (s *MemoryStorage) WriteAt(data *FileData, p []byte, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := offset + int64(len(p))
+	before := fileUsage(data)
+	if err := s.admit(data, max(data.Content.Size(), end), writeUsage(data, offset, end)); err != nil {
+		return err
+	}
+
+	data.Content = data.Content.Mutable()
+	data.Content.WriteAt(p, offset)
+	data.touch()
+	s.settle(data, before)
+	return nil
+}
+
+// ReadAt fills p from the file at offset, with zeros for holes, and
+// returns the number of bytes read
+func (s *MemoryStorage) ReadAt(data *FileData, p []byte, offset int64) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return data.Content.ReadAt(p, offset)
+}
+
+// SeekData returns the first offset at or after offset that holds data
+func (s *MemoryStorage) SeekData(data *FileData, offset int64) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return data.Content.SeekData(offset)
+}
+
+// SeekHole returns the first offset at or after offset inside a hole
+func (s *MemoryStorage) SeekHole(data *FileData, offset int64) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return data.Content.SeekHole(offset)
+}
+
+// Truncate shrinks or extends the file to exactly length bytes. Extending
+// adds a hole. Reservations past the new end of file are released, as on
+// Unix. It returns the updated metadata.
+func (s *MemoryStorage) Truncate(data *FileData, length int64) (*pb.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Shrinking releases space and growing adds a hole, so only the
+	// maximum file size can refuse a truncate
+	before := fileUsage(data)
+	if err := s.admit(data, length, before); err != nil {
+		return nil, err
+	}
+
+	data.Content = data.Content.Mutable()
+	data.Content.Truncate(length)
+	data.Reserved = data.Reserved.clip(length)
+
+	info := data.touch()
+	s.settle(data, before)
+	return info, nil
+}
+
+// Replace publishes content as the file's new content in one step, so
+// readers see either the old version or the new one. It returns the
+// updated metadata.
+func (s *MemoryStorage) Replace(data *FileData, content *Extents) (*pb.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.replace(data, content)
+}
+
+// ReplaceStaged is Replace for upload data whose staged bytes were charged
+// to keys by ChargeStaged: the file takes over the charge in the same step,
+// so the data is never counted twice. If the content is refused, the
+// staged bytes stay charged.
+func (s *MemoryStorage) ReplaceStaged(data *FileData, content *Extents, keys []quotaKey, staged int64) (*pb.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.charge(keys, -staged, 0)
+	info, err := s.replace(data, content)
+	if err != nil {
+		s.charge(keys, staged, 0)
+	}
+	return info, err
+}
+
+// replace implements Replace. The caller must hold the storage write lock.
+func (s *MemoryStorage) replace(data *FileData, content *Extents) (*pb.FileInfo, error) {
+	before := fileUsage(data)
+	reserved := data.Reserved.clip(content.Size())
+	if err := s.admit(data, content.Size(), contentUsage(content, reserved)); err != nil {
+		return nil, err
+	}
+
+	data.Content = content
+	data.Reserved = reserved
+
+	info := data.touch()
+	s.settle(data, before)
+	return info, nil
+}
+
+// CopyRange copies n bytes of the frozen content src, starting at srcOff,
+// into the file at dstOff, sharing whole extents where offsets allow. It
+// returns the updated metadata and the number of bytes shared.
+func (s *MemoryStorage) CopyRange(data *FileData, src *Extents, srcOff, dstOff, n int64) (*pb.FileInfo, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Sharing an extent stores no more than writing it would
+	length := max(data.Content.Size(), dstOff+n)
+	before := fileUsage(data)
+	if err := s.admit(data, length, writeUsage(data, dstOff, dstOff+n)); err != nil {
+		return nil, 0, err
+	}
+
+	data.Content = data.Content.Mutable()
+	shared := data.Content.CopyFrom(src, srcOff, dstOff, n)
+
+	info := data.touch()
+	s.settle(data, before)
+	return info, shared, nil
+}
+
+// UpdateInfo publishes metadata changed by update, which is given a copy
+// of the current metadata and may reject the change. Content and mtime are
+// left alone, but the metadata version changes. A new owner or group takes
+// over the file's usage without a quota check, as chown by an
+// administrator may have to. It returns the updated metadata.
+func (s *MemoryStorage) UpdateInfo(data *FileData, update func(info *pb.FileInfo) error) (*pb.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := proto.Clone(data.Info).(*pb.FileInfo)
+	if err := update(info); err != nil {
+		return nil, err
+	}
+	if info.Owner != data.Info.Owner || info.Group != data.Info.Group {
+		s.charge(s.chargedKeys(data, data.Info), -fileUsage(data), -1)
+		s.charge(s.chargedKeys(data, info), fileUsage(data), 1)
+	}
+	data.Info = info
+	data.Version = s.nextVersion()
+	s.generation.Add(1)
+
+	return info, nil
+}
+
+// Xattrs returns the extended attributes of the file. The map is never
+// modified after it is stored and must not be modified by the caller.
+func (s *MemoryStorage) Xattrs(data *FileData) map[string][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return data.Xattrs
+}
+
+// SetXattr stores a copy of value as the named extended attribute. mode
+// decides whether an existing attribute may, or must, be replaced, and the
+// attributes of one file together may not exceed xattrSpaceMax bytes.
+func (s *MemoryStorage) SetXattr(data *FileData, name string, value []byte, mode pb.XattrSetMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, exists := data.Xattrs[name]
+	switch {
+	case exists && mode == pb.XattrSetMode_XATTR_SET_MODE_CREATE:
+		return errXattrExists
+	case !exists && mode == pb.XattrSetMode_XATTR_SET_MODE_REPLACE:
+		return errNoXattr
+	}
+
+	used := xattrSpace(data.Xattrs)
+	if exists {
+		used -= len(name) + len(old)
+	}
+	if used+len(name)+len(value) > xattrSpaceMax {
+		return errXattrSpace
+	}
+
+	xattrs := maps.Clone(data.Xattrs)
+	if xattrs == nil {
+		xattrs = make(map[string][]byte)
+	}
+	xattrs[name] = bytes.Clone(value)
+	data.Xattrs = xattrs
+
 	return nil
 }
 
+// RemoveXattr removes the named extended attribute
+func (s *MemoryStorage) RemoveXattr(data *FileData, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := data.Xattrs[name]; !exists {
+		return errNoXattr
+	}
+
+	xattrs := maps.Clone(data.Xattrs)
+	delete(xattrs, name)
+	data.Xattrs = xattrs
+
+	return nil
+}
+
+// Allocate reserves space for [offset, offset+length) without writing data.
+// Unless keepSize is set, a range past end of file also extends the file;
+// the new range is a hole until written. It returns the updated metadata
+// and the bytes the file is now charged for, stored and reserved. Nothing
+// is reserved if that would exceed a quota or the maximum file size.
+func (s *MemoryStorage) Allocate(data *FileData, offset, length int64, keepSize bool) (*pb.FileInfo, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := offset + length
+	before := fileUsage(data)
+	reserved := data.Reserved.add(offset, end)
+	if err := s.admit(data, max(data.Content.Size(), end), contentUsage(data.Content, reserved)); err != nil {
+		return nil, 0, err
+	}
+
+	data.Reserved = reserved
+
+	if !keepSize && end > data.Content.Size() {
+		data.Content = data.Content.Mutable()
+		data.Content.Truncate(end)
+	}
+
+	info := data.touch()
+	s.settle(data, before)
+	return info, fileUsage(data), nil
+}
+
+// Unlink removes the path from the namespace even if the file is open.
+// Open file descriptors keep the FileData alive until they are released,
+// and it stays charged to its owner and group until then.
+func (s *MemoryStorage) Unlink(path string) (*FileData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, exists := s.files[path]
+	if !exists {
+		return nil, fmt.Errorf("file not found: %s", path)
+	}
+
+	s.unlink(path, data)
+	return data, nil
+}
+
+// unlink removes data, stored at path, from the namespace. The caller must
+// hold the storage write lock.
+func (s *MemoryStorage) unlink(path string, data *FileData) {
+	s.release(data)
+	delete(s.files, path)
+	data.Unlinked = true
+	s.generation.Add(1)
+}
+
+// release stops charging directory quotas for a file leaving the
+// namespace and drops the quota of a directory being removed. A file that
+// is still open stays charged to its owner keys until its last Release;
+// anything else is no longer charged at all. The caller must hold the
+// storage write lock.
+func (s *MemoryStorage) release(data *FileData) {
+	usage := fileUsage(data)
+	s.charge(s.quotaKeys(data.path, data.Info), -usage, -1)
+	if data.RefCount > 0 {
+		s.charge(ownerKeys(data.Info), usage, 1)
+	}
+
+	key := quotaKey{pb.QuotaKind_QUOTA_KIND_DIRECTORY, data.path}
+	delete(s.quotas.limits, key)
+	delete(s.quotas.usage, key)
+}
+
+// UnlinkIfEmpty is Unlink for entries that may be directories: it fails
+// with errNotEmpty, under the same lock, if anything lives below path
+func (s *MemoryStorage) UnlinkIfEmpty(path string) (*FileData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, exists := s.files[path]
+	if !exists {
+		return nil, fmt.Errorf("file not found: %s", path)
+	}
+	if data.Info.Type == pb.FileType_FILE_TYPE_DIRECTORY && s.hasChildren(path) {
+		return nil, fmt.Errorf("%w: %s", errNotEmpty, path)
+	}
+
+	s.unlink(path, data)
+	return data, nil
+}
+
+// hasChildren reports whether any entry lives below the given directory.
+// The caller must hold the storage lock.
+func (s *MemoryStorage) hasChildren(dir string) bool {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for path := range s.files {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tree returns the root and every entry below it, deepest entries first,
+// which is the order they must be removed in
+func (s *MemoryStorage) Tree(root string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	paths := make([]string, 0)
+	for path := range s.files {
+		if path == root || strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		di, dj := strings.Count(paths[i], "/"), strings.Count(paths[j], "/")
+		if di != dj {
+			return di > dj
+		}
+		return paths[i] < paths[j]
+	})
+
+	return paths
+}
+
 // Exists checks if a file exists at the given path
 func (s *MemoryStorage) Exists(path string) bool {
 	s.mu.RLock()
@@ -129,35 +635,45 @@ func (s *MemoryStorage) List() []string {
 	return paths
 }
 
-// IncRef increments the reference count for a file
-func (s *MemoryStorage) IncRef(path string) error {
+// Retain adds a reference for a file descriptor on the file data. It works
+// on the object itself, so it is unaffected by the file's path being
+// unlinked or reused.
+func (s *MemoryStorage) Retain(data *FileData) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	data, exists := s.files[path]
-	if !exists {
-		return fmt.Errorf("file not found: %s", path)
-	}
-
 	data.RefCount++
-	return nil
 }
 
-// DecRef decrements the reference count for a file
-func (s *MemoryStorage) DecRef(path string) error {
+// Release drops a reference held by an open file descriptor, including
+// on files that have already been unlinked.
+func (s *MemoryStorage) Release(data *FileData) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	data, exists := s.files[path]
-	if !exists {
-		return fmt.Errorf("file not found: %s", path)
+	if data.RefCount == 0 {
+		return
 	}
-
-	if data.RefCount > 0 {
-		data.RefCount--
+	data.RefCount--
+
+	// Last reference to an unlinked file: stop charging for it and drop
+	// the content now rather than waiting for the handles referencing it
+	// to be collected
+	if data.Unlinked && data.RefCount == 0 {
+		if data.path != "" {
+			s.charge(ownerKeys(data.Info), -fileUsage(data), -1)
+		}
+		data.Content = &Extents{}
+		data.Reserved = nil
 	}
+}
 
-	return nil
+// IsOpen reports whether any file descriptor still references the file
+func (s *MemoryStorage) IsOpen(data *FileData) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return data.RefCount > 0
 }
 
 // GetRefCount returns the current reference count for a file
@@ -172,3 +688,8 @@ func (s *MemoryStorage) GetRefCount(path string) (int32, error) {
 
 	return data.RefCount, nil
 }
+
+// parentDir returns the directory containing the entry at p
+func parentDir(p string) string {
+	return path.Dir(p)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+)
+
+// readWithMetadata reads a whole file and returns its content together
+// with the total_size announced in the read metadata
+func readWithMetadata(ctx context.Context, client pb.Plan92Client, sessionID, path string) ([]byte, int64, error) {
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      path,
+		Mode:      pb.OpenMode_OPEN_MODE_READ,
+		SessionId: sessionID,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_, _ = client.Close(ctx, &pb.CloseRequest{Fd: openResp.Fd, SessionId: openResp.SessionId})
+	}()
+
+	readStream, err := client.Read(ctx, &pb.ReadRequest{Fd: openResp.Fd, SessionId: openResp.SessionId, Offset: 0, Count: -1})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var content []byte
+	totalSize := int64(-1)
+	for {
+		resp, err := readStream.Recv()
+		if err == io.EOF {
+			return content, totalSize, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if metadata := resp.GetMetadata(); metadata != nil {
+			totalSize = metadata.TotalSize
+		}
+		content = append(content, resp.GetChunk()...)
+	}
+}
+
+// Every write replaces the whole file with a single repeated byte, so a
+// reader that sees mixed bytes, or a length other than the one announced
+// in its metadata, observed a torn read.
+func TestStress_ConcurrentReadersAndWriters(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	sessionID := sessionResp.SessionId
+
+	const (
+		path       = "/stress.txt"
+		fileSize   = 3 * extentSize / 2
+		writers    = 4
+		readers    = 4
+		iterations = 25
+	)
+
+	if err := writeTestFile(ctx, client, sessionID, path, string(bytes.Repeat([]byte("a"), fileSize))); err != nil {
+		t.Fatalf("Failed to write initial file: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers+readers+1)
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				content := bytes.Repeat([]byte{byte('b' + (w*iterations+i)%24)}, fileSize)
+				if err := writeTestFile(ctx, client, sessionID, path, string(content)); err != nil {
+					errs <- fmt.Errorf("write failed: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				content, totalSize, err := readWithMetadata(ctx, client, sessionID, path)
+				if err != nil {
+					errs <- fmt.Errorf("read failed: %v", err)
+					return
+				}
+				if int64(len(content)) != totalSize {
+					errs <- fmt.Errorf("metadata announced %d bytes but %d were streamed", totalSize, len(content))
+					return
+				}
+				if len(content) > 0 && bytes.Count(content, content[:1]) != len(content) {
+					errs <- fmt.Errorf("torn read of %d bytes", len(content))
+					return
+				}
+			}
+		}()
+	}
+
+	// Stat and Io exercise the metadata paths alongside the streams
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			if _, err := client.Stat(ctx, &pb.StatRequest{Path: path, SessionId: sessionID}); err != nil {
+				errs <- fmt.Errorf("stat failed: %v", err)
+				return
+			}
+			if err := ioReadOnce(ctx, client, sessionID, path); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// ioReadOnce attaches an Io stream to path and reads from its start
+func ioReadOnce(ctx context.Context, client pb.Plan92Client, sessionID, path string) error {
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      path,
+		Mode:      pb.OpenMode_OPEN_MODE_READ,
+		SessionId: sessionID,
+	})
+	if err != nil {
+		return fmt.Errorf("open failed: %v", err)
+	}
+	defer func() {
+		_, _ = client.Close(ctx, &pb.CloseRequest{Fd: openResp.Fd, SessionId: openResp.SessionId})
+	}()
+
+	stream, err := client.Io(ctx)
+	if err != nil {
+		return fmt.Errorf("io failed: %v", err)
+	}
+	defer stream.CloseSend()
+
+	requests := []*pb.IoRequest{
+		{Tag: 1, Op: &pb.IoRequest_Attach{Attach: &pb.IoAttach{Fd: openResp.Fd, SessionId: openResp.SessionId}}},
+		{Tag: 2, Op: &pb.IoRequest_Read{Read: &pb.IoRead{Offset: 0, Count: 4096}}},
+	}
+	for _, req := range requests {
+		if err := stream.Send(req); err != nil {
+			return fmt.Errorf("io send failed: %v", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return fmt.Errorf("io recv failed: %v", err)
+		}
+		if ioErr := resp.GetError(); ioErr != nil {
+			return fmt.Errorf("io tag %d failed: %s", req.Tag, ioErr.Message)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// setupTruncateTest returns a service with alice's /file.txt holding
+// "hello world" and her session's write and read FDs for it
+func setupTruncateTest(t *testing.T) (*Plan92ServiceImpl, *MemoryStorage, *pb.FileStatus, *pb.FileStatus) {
+	t.Helper()
+	storage := NewMemoryStorage()
+	sessions := NewSessionManager()
+	service := NewPlan92Service(storage, sessions, NewInodeService(storage, sessions))
+	ctx := context.Background()
+
+	if err := storage.Set("/file.txt", []byte("hello world"), &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_REGULAR,
+		Mode:  0644,
+		Owner: "alice",
+		Group: "users",
+	}); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	alice, _ := sessions.Create("alice", []string{"users"})
+	writer, err := service.Open(ctx, &pb.OpenRequest{Path: "/file.txt", Mode: pb.OpenMode_OPEN_MODE_RDWR, SessionId: alice.ID})
+	if err != nil {
+		t.Fatalf("Failed to open for writing: %v", err)
+	}
+	reader, err := service.Open(ctx, &pb.OpenRequest{Path: "/file.txt", Mode: pb.OpenMode_OPEN_MODE_READ, SessionId: alice.ID})
+	if err != nil {
+		t.Fatalf("Failed to open for reading: %v", err)
+	}
+	return service, storage, writer, reader
+}
+
+// fileContent returns the content of the file at filePath
+func fileContent(t *testing.T, storage *MemoryStorage, filePath string) string {
+	t.Helper()
+	data, err := storage.Get(filePath)
+	if err != nil {
+		t.Fatalf("Failed to get %s: %v", filePath, err)
+	}
+	buf := make([]byte, storage.Stat(data).Length)
+	return string(buf[:storage.ReadAt(data, buf, 0)])
+}
+
+func TestTruncate_ShrinkAndGrow(t *testing.T) {
+	service, storage, writer, _ := setupTruncateTest(t)
+	ctx := context.Background()
+
+	truncate := func(length int64) *pb.FileInfo {
+		t.Helper()
+		resp, err := service.Truncate(ctx, &pb.TruncateRequest{
+			Target:    &pb.TruncateRequest_Fd{Fd: writer.Fd},
+			Length:    length,
+			SessionId: writer.SessionId,
+		})
+		if err != nil {
+			t.Fatalf("Truncate to %d failed: %v", length, err)
+		}
+		return resp.Info
+	}
+
+	if info := truncate(5); info.Length != 5 {
+		t.Errorf("Expected length 5 after shrinking, got %d", info.Length)
+	}
+	if got := fileContent(t, storage, "/file.txt"); got != "hello" {
+		t.Errorf("Expected %q after shrinking, got %q", "hello", got)
+	}
+
+	// Growing zero-fills through a hole rather than allocating data, so a
+	// quota smaller than the new length allows it
+	if _, err := storage.SetQuota(pb.QuotaKind_QUOTA_KIND_USER, "alice", 100, 0); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+	if info := truncate(1 << 20); info.Length != 1<<20 {
+		t.Errorf("Expected length %d after growing, got %d", 1<<20, info.Length)
+	}
+	data, _ := storage.Get("/file.txt")
+	if hole, ok := storage.SeekHole(data, 0); !ok || hole != 5 {
+		t.Errorf("Expected a hole from offset 5, got %d (%v)", hole, ok)
+	}
+	if next, ok := storage.SeekData(data, 5); ok {
+		t.Errorf("Expected no data past offset 5, got data at %d", next)
+	}
+	tail := make([]byte, 4)
+	if n := storage.ReadAt(data, tail, 1<<19); n != 4 || string(tail) != "\x00\x00\x00\x00" {
+		t.Errorf("Expected the grown range to read as zeros, got %q", tail[:n])
+	}
+
+	// Truncating by path works the same way
+	if _, err := service.Truncate(ctx, &pb.TruncateRequest{
+		Target:    &pb.TruncateRequest_Path{Path: "/file.txt"},
+		Length:    2,
+		SessionId: writer.SessionId,
+	}); err != nil {
+		t.Fatalf("Truncate by path failed: %v", err)
+	}
+	if got := fileContent(t, storage, "/file.txt"); got != "he" {
+		t.Errorf("Expected %q after truncating by path, got %q", "he", got)
+	}
+}
+
+func TestTruncate_Errors(t *testing.T) {
+	service, storage, writer, reader := setupTruncateTest(t)
+	ctx := context.Background()
+
+	storage.SetMaxFileSize(100)
+
+	tests := []struct {
+		name string
+		req  *pb.TruncateRequest
+		code codes.Code
+	}{
+		{"bad fd", &pb.TruncateRequest{Target: &pb.TruncateRequest_Fd{Fd: 99}, Length: 1, SessionId: writer.SessionId}, codes.InvalidArgument},
+		{"read-only fd", &pb.TruncateRequest{Target: &pb.TruncateRequest_Fd{Fd: reader.Fd}, Length: 1, SessionId: reader.SessionId}, codes.PermissionDenied},
+		{"negative length", &pb.TruncateRequest{Target: &pb.TruncateRequest_Fd{Fd: writer.Fd}, Length: -1, SessionId: writer.SessionId}, codes.InvalidArgument},
+		{"past the maximum file size", &pb.TruncateRequest{Target: &pb.TruncateRequest_Fd{Fd: writer.Fd}, Length: 1000, SessionId: writer.SessionId}, codes.InvalidArgument},
+		{"no target", &pb.TruncateRequest{Length: 1, SessionId: writer.SessionId}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := service.Truncate(ctx, tt.req); status.Code(err) != tt.code {
+				t.Errorf("Expected %v, got: %v", tt.code, err)
+			}
+		})
+	}
+
+	// Failed truncates leave the file alone
+	if got := fileContent(t, storage, "/file.txt"); got != "hello world" {
+		t.Errorf("Expected the content to be unchanged, got %q", got)
+	}
+}
+
+func TestFallocate_ReservesAndExtends(t *testing.T) {
+	service, storage, writer, _ := setupTruncateTest(t)
+	ctx := context.Background()
+
+	// Reserving within the file keeps its length
+	resp, err := service.Fallocate(ctx, &pb.FallocateRequest{Fd: writer.Fd, Offset: 0, Length: 5, SessionId: writer.SessionId})
+	if err != nil {
+		t.Fatalf("Fallocate failed: %v", err)
+	}
+	if resp.Info.Length != 11 {
+		t.Errorf("Expected length 11, got %d", resp.Info.Length)
+	}
+
+	// With keep_size a reservation past the end does not extend the file
+	resp, err = service.Fallocate(ctx, &pb.FallocateRequest{Fd: writer.Fd, Offset: 11, Length: 89, KeepSize: true, SessionId: writer.SessionId})
+	if err != nil {
+		t.Fatalf("Fallocate failed: %v", err)
+	}
+	if resp.Info.Length != 11 || resp.Reserved != 100 {
+		t.Errorf("Expected length 11 with 100 bytes reserved, got %d and %d", resp.Info.Length, resp.Reserved)
+	}
+
+	// Without it the file grows by a hole
+	resp, err = service.Fallocate(ctx, &pb.FallocateRequest{Fd: writer.Fd, Offset: 100, Length: 28, SessionId: writer.SessionId})
+	if err != nil {
+		t.Fatalf("Fallocate failed: %v", err)
+	}
+	if resp.Info.Length != 128 {
+		t.Errorf("Expected length 128, got %d", resp.Info.Length)
+	}
+	if got := fileContent(t, storage, "/file.txt"); got != "hello world"+string(make([]byte, 117)) {
+		t.Errorf("Expected the content followed by zeros, got %q", got)
+	}
+}
+
+func TestFallocate_Errors(t *testing.T) {
+	service, storage, writer, reader := setupTruncateTest(t)
+	ctx := context.Background()
+
+	if _, err := storage.SetQuota(pb.QuotaKind_QUOTA_KIND_USER, "alice", 100, 0); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		req  *pb.FallocateRequest
+		code codes.Code
+	}{
+		{"bad fd", &pb.FallocateRequest{Fd: 99, Length: 1, SessionId: writer.SessionId}, codes.InvalidArgument},
+		{"read-only fd", &pb.FallocateRequest{Fd: reader.Fd, Length: 1, SessionId: reader.SessionId}, codes.PermissionDenied},
+		{"negative offset", &pb.FallocateRequest{Fd: writer.Fd, Offset: -1, Length: 1, SessionId: writer.SessionId}, codes.InvalidArgument},
+		{"empty range", &pb.FallocateRequest{Fd: writer.Fd, Length: 0, SessionId: writer.SessionId}, codes.InvalidArgument},
+		{"range overflows", &pb.FallocateRequest{Fd: writer.Fd, Offset: 1, Length: math.MaxInt64, SessionId: writer.SessionId}, codes.InvalidArgument},
+		{"past quota", &pb.FallocateRequest{Fd: writer.Fd, Length: 1000, SessionId: writer.SessionId}, codes.ResourceExhausted},
+		{"past quota keeping size", &pb.FallocateRequest{Fd: writer.Fd, Length: 1000, KeepSize: true, SessionId: writer.SessionId}, codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := service.Fallocate(ctx, tt.req); status.Code(err) != tt.code {
+				t.Errorf("Expected %v, got: %v", tt.code, err)
+			}
+		})
+	}
+
+	data, _ := storage.Get("/file.txt")
+	if info := storage.Stat(data); info.Length != 11 || len(data.Reserved) != 0 {
+		t.Errorf("Expected failed reservations to change nothing, got length %d with %v reserved", info.Length, data.Reserved)
+	}
+}
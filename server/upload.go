@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"github.com/google/uuid"
+)
+
+// Upload is a resumable upload. Its data is staged outside the target
+// file, which only changes when the upload is committed. Staged data is
+// charged to the file's owner and group and to the filesystem, so it is
+// bounded by the same quotas and capacity as data written directly.
+type Upload struct {
+	ID             string
+	SessionID      string // Session owning FD
+	FD             int32
+	Data           *FileData // Target file, bound when the upload began
+	TotalSize      int64
+	ExpectedSHA256 []byte
+
+	storage   *MemoryStorage
+	keys      []quotaKey // What staged data is charged to
+	mu        sync.Mutex
+	content   *Extents
+	committed int64 // Length of the data received without gaps; all of it is charged
+	expiresAt time.Time
+	finished  bool // Being committed or committed; no more data is accepted
+}
+
+// Write stages p at offset, which must not leave a gap after the data
+// already received, and extends the upload's lifetime. Like a write to the
+// file, it fails with errNoSpace or errFileTooLarge if the data would
+// exceed a limit.
+func (u *Upload) Write(p []byte, offset int64, expiresAt time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.finished {
+		return fmt.Errorf("upload already committed")
+	}
+	if offset > u.committed {
+		return fmt.Errorf("offset %d is past the committed length %d", offset, u.committed)
+	}
+	end := offset + int64(len(p))
+	if u.TotalSize > 0 && end > u.TotalSize {
+		return fmt.Errorf("data extends past total_size (%d bytes)", u.TotalSize)
+	}
+	if end > u.committed {
+		if err := u.storage.ChargeStaged(u.keys, end, end-u.committed); err != nil {
+			return err
+		}
+	}
+
+	u.content.WriteAt(p, offset)
+	u.committed = max(u.committed, end)
+	u.expiresAt = expiresAt
+	return nil
+}
+
+// Status returns the committed length and expiry of the upload
+func (u *Upload) Status() (int64, time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.committed, u.expiresAt
+}
+
+// Finish stops the upload from accepting data and returns the staged
+// content, frozen so it can be published as is. It fails if a total size
+// was declared and has not been received.
+func (u *Upload) Finish() (*Extents, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.finished {
+		return nil, fmt.Errorf("upload already committed")
+	}
+	if u.TotalSize > 0 && u.committed != u.TotalSize {
+		return nil, fmt.Errorf("upload has %d of %d bytes", u.committed, u.TotalSize)
+	}
+
+	u.finished = true
+	return u.content.Freeze(), nil
+}
+
+// Commit publishes content returned by Finish as the file's content, which
+// takes over the charge for the staged data. If the file refuses it, the
+// upload accepts data again so the client can retry.
+func (u *Upload) Commit(content *Extents) (*pb.FileInfo, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	info, err := u.storage.ReplaceStaged(u.Data, content, u.keys, u.committed)
+	if err != nil {
+		u.finished = false
+		return nil, err
+	}
+	u.committed = 0
+	return info, nil
+}
+
+// release stops charging for the staged data of an upload being dropped
+func (u *Upload) release() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.storage.ReleaseStaged(u.keys, u.committed)
+	u.committed = 0
+	u.finished = true
+}
+
+// UploadManager tracks resumable uploads and expires abandoned ones
+type UploadManager struct {
+	mu      sync.Mutex
+	uploads map[string]*Upload
+	storage *MemoryStorage // Charged for staged data
+}
+
+// NewUploadManager creates a new upload manager for files in storage
+func NewUploadManager(storage *MemoryStorage) *UploadManager {
+	return &UploadManager{
+		uploads: make(map[string]*Upload),
+		storage: storage,
+	}
+}
+
+// Begin registers a new upload for the file open on fd
+func (m *UploadManager) Begin(sessionID string, fd int32, data *FileData, totalSize int64, expectedSHA256 []byte, expiresAt time.Time) *Upload {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload := &Upload{
+		ID:             uuid.New().String(),
+		SessionID:      sessionID,
+		FD:             fd,
+		Data:           data,
+		TotalSize:      totalSize,
+		ExpectedSHA256: expectedSHA256,
+		storage:        m.storage,
+		keys:           m.storage.StagingKeys(data),
+		content:        &Extents{},
+		expiresAt:      expiresAt,
+	}
+	m.uploads[upload.ID] = upload
+
+	return upload
+}
+
+// Get retrieves an upload by ID. Expired uploads are treated as gone even
+// before they are collected.
+func (m *UploadManager) Get(id string) (*Upload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, exists := m.uploads[id]
+	if !exists {
+		return nil, fmt.Errorf("no such upload: %s", id)
+	}
+	if _, expiresAt := upload.Status(); !time.Now().Before(expiresAt) {
+		delete(m.uploads, id)
+		upload.release()
+		return nil, fmt.Errorf("upload expired: %s", id)
+	}
+
+	return upload, nil
+}
+
+// Remove forgets an upload, dropping its staged data
+func (m *UploadManager) Remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if upload, exists := m.uploads[id]; exists {
+		delete(m.uploads, id)
+		upload.release()
+	}
+}
+
+// Collect removes uploads that expired before now and returns how many
+// were removed
+func (m *UploadManager) Collect(now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := 0
+	for id, upload := range m.uploads {
+		if _, expiresAt := upload.Status(); !now.Before(expiresAt) {
+			delete(m.uploads, id)
+			upload.release()
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// CollectEvery runs Collect periodically until stop is closed
+func (m *UploadManager) CollectEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			m.Collect(now)
+		}
+	}
+}
+
+// Count returns the number of uploads in progress
+func (m *UploadManager) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.uploads)
+}
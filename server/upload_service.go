@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// BeginUpload starts a resumable upload for a file open for writing
+func (s *Plan92ServiceImpl) BeginUpload(
+	ctx context.Context,
+	req *pb.BeginUploadRequest,
+) (*pb.BeginUploadResponse, error) {
+	session, handle, err := s.getAndValidateFD(req.SessionId, req.Fd)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isWritable(handle.Mode) {
+		return nil, status.Errorf(codes.PermissionDenied, "file not opened for writing")
+	}
+	if handle.Data.Pipe != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot upload to a pipe")
+	}
+	if len(req.ExpectedSha256) > 0 && len(req.ExpectedSha256) != sha256.Size {
+		return nil, status.Errorf(codes.InvalidArgument, "expected_sha256 must be %d bytes", sha256.Size)
+	}
+	if req.TotalSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "total_size must not be negative")
+	}
+
+	expiresAt := time.Now().Add(s.config.UploadTTL)
+	upload := s.uploads.Begin(session.ID, req.Fd, handle.Data, req.TotalSize, req.ExpectedSha256, expiresAt)
+
+	return &pb.BeginUploadResponse{
+		UploadId:  upload.ID,
+		ExpiresAt: timestamppb.New(expiresAt),
+	}, nil
+}
+
+// Upload stages data for an upload (client streaming). Each chunk is
+// committed to the upload as it arrives, so after a broken stream the
+// client can query the committed length and resume from there.
+func (s *Plan92ServiceImpl) Upload(stream pb.Plan92_UploadServer) error {
+	var upload *Upload
+	var offset int64
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to receive chunk: %v", err)
+		}
+
+		switch data := req.Data.(type) {
+		case *pb.UploadRequest_Metadata:
+			if upload != nil {
+				return status.Errorf(codes.InvalidArgument, "duplicate metadata")
+			}
+			if upload, _, err = s.getUpload(data.Metadata.SessionId, data.Metadata.UploadId); err != nil {
+				return err
+			}
+			offset = data.Metadata.Offset
+			if offset < 0 {
+				return status.Errorf(codes.InvalidArgument, "offset must not be negative")
+			}
+
+		case *pb.UploadRequest_Chunk:
+			if upload == nil {
+				return status.Errorf(codes.InvalidArgument, "metadata must be sent before data")
+			}
+
+			expiresAt := time.Now().Add(s.config.UploadTTL)
+			if err := upload.Write(data.Chunk, offset, expiresAt); err != nil {
+				if errors.Is(err, errNoSpace) || errors.Is(err, errFileTooLarge) {
+					return storageError(err)
+				}
+				return status.Errorf(codes.FailedPrecondition, "%v", err)
+			}
+			offset += int64(len(data.Chunk))
+		}
+	}
+
+	if upload == nil {
+		return status.Errorf(codes.InvalidArgument, "no metadata received")
+	}
+
+	committed, _ := upload.Status()
+	return stream.SendAndClose(&pb.UploadResponse{
+		UploadId:        upload.ID,
+		CommittedLength: committed,
+	})
+}
+
+// QueryUpload reports how much of an upload has been received
+func (s *Plan92ServiceImpl) QueryUpload(
+	ctx context.Context,
+	req *pb.QueryUploadRequest,
+) (*pb.UploadStatus, error) {
+	upload, _, err := s.getUpload(req.SessionId, req.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	committed, expiresAt := upload.Status()
+	return &pb.UploadStatus{
+		UploadId:        upload.ID,
+		Fd:              upload.FD,
+		CommittedLength: committed,
+		TotalSize:       upload.TotalSize,
+		ExpiresAt:       timestamppb.New(expiresAt),
+	}, nil
+}
+
+// CommitUpload publishes an upload as the new content of its file. The
+// upload is only committed by its session through the FD it began on,
+// which must still be open for writing, so it carries exactly that FD's
+// permission.
+func (s *Plan92ServiceImpl) CommitUpload(
+	ctx context.Context,
+	req *pb.CommitUploadRequest,
+) (*pb.CommitUploadResponse, error) {
+	upload, session, err := s.getUpload(req.SessionId, req.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	// The FD must still refer to the file the upload began on
+	handle, _ := session.FDTable.Get(upload.FD)
+	if handle == nil || handle.Data != upload.Data {
+		return nil, status.Errorf(codes.FailedPrecondition, "file descriptor %d is no longer open", upload.FD)
+	}
+	if !isWritable(handle.Mode) {
+		return nil, status.Errorf(codes.PermissionDenied, "file not opened for writing")
+	}
+
+	content, err := upload.Finish()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+
+	// A corrupt upload cannot be repaired by resuming it, so it is dropped
+	if len(upload.ExpectedSHA256) > 0 {
+		if sum, _ := content.Checksums(); !bytes.Equal(sum, upload.ExpectedSHA256) {
+			s.uploads.Remove(upload.ID)
+			return nil, fsErrorf(codes.DataLoss, pb.FSErrorCode_FS_ERROR_CODE_IO_ERROR,
+				"checksum mismatch: expected sha256 %x, got %x", upload.ExpectedSHA256, sum)
+		}
+	}
+
+	// A commit the file refuses, such as one over quota, keeps the upload
+	// so the client can retry once there is room
+	info, err := upload.Commit(content)
+	if err != nil {
+		err = storageError(err)
+		s.audit(session, "upload", handle.Path, handle.Mode, 0, err)
+		return nil, err
+	}
+	s.uploads.Remove(upload.ID)
+	s.audit(session, "upload", handle.Path, handle.Mode, content.Size(), nil)
+
+	// The checksums are already known for a verified upload
+	if len(upload.ExpectedSHA256) > 0 {
+		info = withChecksums(content, info)
+	}
+	return &pb.CommitUploadResponse{
+		Info: info,
+	}, nil
+}
+
+// getUpload returns an upload begun by the session sessionID. Uploads of
+// other sessions are reported as missing, so their IDs cannot be probed.
+func (s *Plan92ServiceImpl) getUpload(sessionID, uploadID string) (*Upload, *Session, error) {
+	session, err := s.sessions.Get(sessionID)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	upload, err := s.uploads.Get(uploadID)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.NotFound, "%v", err)
+	}
+	if upload.SessionID != session.ID {
+		return nil, nil, status.Errorf(codes.NotFound, "no such upload: %s", uploadID)
+	}
+
+	return upload, session, nil
+}
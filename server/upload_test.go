@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sendUpload streams chunks to an upload starting at offset
+func sendUpload(ctx context.Context, client pb.Plan92Client, sessionID, uploadID string, offset int64, chunks ...string) (*pb.UploadResponse, error) {
+	stream, err := client.Upload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&pb.UploadRequest{
+		Data: &pb.UploadRequest_Metadata{Metadata: &pb.UploadMetadata{UploadId: uploadID, Offset: offset, SessionId: sessionID}},
+	}); err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		if err := stream.Send(&pb.UploadRequest{
+			Data: &pb.UploadRequest_Chunk{Chunk: []byte(chunk)},
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+func TestUpload_ResumeAndCommit(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	sessionID := sessionResp.SessionId
+
+	if err := writeTestFile(ctx, client, sessionID, "/upload.txt", "old content"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      "/upload.txt",
+		Mode:      pb.OpenMode_OPEN_MODE_WRITE,
+		SessionId: sessionID,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+
+	const content = "resumable upload content"
+	sum := sha256.Sum256([]byte(content))
+	beginResp, err := client.BeginUpload(ctx, &pb.BeginUploadRequest{
+		Fd:             openResp.Fd,
+		TotalSize:      int64(len(content)),
+		ExpectedSha256: sum[:],
+		SessionId:      openResp.SessionId,
+	})
+	if err != nil {
+		t.Fatalf("Failed to begin upload: %v", err)
+	}
+	uploadID := beginResp.UploadId
+
+	// First stream sends part of the data
+	if _, err := sendUpload(ctx, client, sessionID, uploadID, 0, content[:6], content[6:10]); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+
+	// Nothing is visible until the upload is committed
+	if got, err := catFile(ctx, client, sessionID, "/upload.txt"); err != nil || got != "old content" {
+		t.Errorf("Expected old content before commit, got: %q (%v)", got, err)
+	}
+
+	// Committing early fails and leaves the upload resumable
+	if _, err := client.CommitUpload(ctx, &pb.CommitUploadRequest{UploadId: uploadID, SessionId: sessionID}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition committing a partial upload, got: %v", err)
+	}
+
+	// Resume from the committed length reported by the server
+	queryResp, err := client.QueryUpload(ctx, &pb.QueryUploadRequest{UploadId: uploadID, SessionId: sessionID})
+	if err != nil {
+		t.Fatalf("Failed to query upload: %v", err)
+	}
+	if queryResp.CommittedLength != 10 {
+		t.Fatalf("Expected 10 committed bytes, got: %d", queryResp.CommittedLength)
+	}
+	if _, err := sendUpload(ctx, client, sessionID, uploadID, 20, content[20:]); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition for a gap, got: %v", err)
+	}
+	uploadResp, err := sendUpload(ctx, client, sessionID, uploadID, queryResp.CommittedLength, content[10:])
+	if err != nil {
+		t.Fatalf("Failed to resume upload: %v", err)
+	}
+	if uploadResp.CommittedLength != int64(len(content)) {
+		t.Errorf("Expected %d committed bytes, got: %d", len(content), uploadResp.CommittedLength)
+	}
+
+	commitResp, err := client.CommitUpload(ctx, &pb.CommitUploadRequest{UploadId: uploadID, SessionId: sessionID})
+	if err != nil {
+		t.Fatalf("Failed to commit upload: %v", err)
+	}
+	if commitResp.Info.Length != int64(len(content)) {
+		t.Errorf("Expected length %d, got: %d", len(content), commitResp.Info.Length)
+	}
+	if got, err := catFile(ctx, client, sessionID, "/upload.txt"); err != nil || got != content {
+		t.Errorf("Expected uploaded content after commit, got: %q (%v)", got, err)
+	}
+
+	// A committed upload is gone
+	if _, err := client.QueryUpload(ctx, &pb.QueryUploadRequest{UploadId: uploadID, SessionId: sessionID}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound after commit, got: %v", err)
+	}
+}
+
+func TestUpload_ExpiresAndNeedsOpenFD(t *testing.T) {
+	storage := NewMemoryStorage()
+	sessions := NewSessionManager()
+	service := NewPlan92Service(storage, sessions, NewInodeService(storage, sessions))
+	ctx := context.Background()
+
+	sessionResp, err := service.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	openResp, err := service.Open(ctx, &pb.OpenRequest{
+		Path:      "/ttl.txt",
+		Mode:      pb.OpenMode_OPEN_MODE_WRITE,
+		SessionId: sessionResp.SessionId,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+
+	abandoned, err := service.BeginUpload(ctx, &pb.BeginUploadRequest{Fd: openResp.Fd, SessionId: openResp.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to begin upload: %v", err)
+	}
+	orphaned, err := service.BeginUpload(ctx, &pb.BeginUploadRequest{Fd: openResp.Fd, SessionId: openResp.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to begin upload: %v", err)
+	}
+
+	// Uploads past their TTL are collected
+	if removed := service.uploads.Collect(time.Now().Add(2 * service.config.UploadTTL)); removed != 2 {
+		t.Errorf("Expected 2 expired uploads to be collected, got: %d", removed)
+	}
+	if _, err := service.QueryUpload(ctx, &pb.QueryUploadRequest{UploadId: abandoned.UploadId, SessionId: sessionResp.SessionId}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for a collected upload, got: %v", err)
+	}
+
+	// An upload cannot be committed once its FD is closed
+	orphaned, err = service.BeginUpload(ctx, &pb.BeginUploadRequest{Fd: openResp.Fd, SessionId: openResp.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to begin upload: %v", err)
+	}
+	if _, err := service.Close(ctx, &pb.CloseRequest{Fd: openResp.Fd, SessionId: openResp.SessionId}); err != nil {
+		t.Fatalf("Failed to close file: %v", err)
+	}
+	if _, err := service.CommitUpload(ctx, &pb.CommitUploadRequest{UploadId: orphaned.UploadId, SessionId: sessionResp.SessionId}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition after close, got: %v", err)
+	}
+}
+
+func TestUpload_QuotaAndRetry(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	if err := storage.Create("/up", &pb.FileInfo{
+		Type:  pb.FileType_FILE_TYPE_DIRECTORY,
+		Mode:  0777,
+		Owner: "testuser",
+	}); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	sessionID := sessionResp.SessionId
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      "/up/quota.txt",
+		Mode:      pb.OpenMode_OPEN_MODE_WRITE,
+		SessionId: sessionID,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	if _, err := storage.SetQuota(pb.QuotaKind_QUOTA_KIND_USER, "testuser", 10, 0); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+	used := func() int64 {
+		t.Helper()
+		quota, err := storage.GetQuota(pb.QuotaKind_QUOTA_KIND_USER, "testuser")
+		if err != nil {
+			t.Fatalf("Failed to get quota: %v", err)
+		}
+		return quota.UsedBytes
+	}
+
+	// Staged data counts against the owner's quota
+	beginResp, err := client.BeginUpload(ctx, &pb.BeginUploadRequest{Fd: openResp.Fd, SessionId: openResp.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to begin upload: %v", err)
+	}
+	uploadID := beginResp.UploadId
+	if _, err := sendUpload(ctx, client, sessionID, uploadID, 0, "12345678", "90abcdef"); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_NO_SPACE {
+		t.Fatalf("Expected NO_SPACE staging past the quota, got: %v", err)
+	}
+	if n := used(); n != 8 {
+		t.Errorf("Expected 8 staged bytes charged, got: %d", n)
+	}
+
+	// A commit the file refuses leaves the upload to be retried
+	if _, err := storage.SetQuota(pb.QuotaKind_QUOTA_KIND_DIRECTORY, "/up", 4, 0); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+	if _, err := client.CommitUpload(ctx, &pb.CommitUploadRequest{UploadId: uploadID, SessionId: sessionID}); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_NO_SPACE {
+		t.Fatalf("Expected NO_SPACE committing past the directory quota, got: %v", err)
+	}
+	queryResp, err := client.QueryUpload(ctx, &pb.QueryUploadRequest{UploadId: uploadID, SessionId: sessionID})
+	if err != nil {
+		t.Fatalf("Expected the upload to survive a failed commit, got: %v", err)
+	}
+	if queryResp.CommittedLength != 8 {
+		t.Errorf("Expected 8 committed bytes, got: %d", queryResp.CommittedLength)
+	}
+	if n := used(); n != 8 {
+		t.Errorf("Expected 8 staged bytes charged after the failed commit, got: %d", n)
+	}
+
+	if _, err := storage.SetQuota(pb.QuotaKind_QUOTA_KIND_DIRECTORY, "/up", 0, 0); err != nil {
+		t.Fatalf("Failed to remove quota: %v", err)
+	}
+	if _, err := sendUpload(ctx, client, sessionID, uploadID, 8, "90"); err != nil {
+		t.Fatalf("Failed to resume upload: %v", err)
+	}
+	if _, err := client.CommitUpload(ctx, &pb.CommitUploadRequest{UploadId: uploadID, SessionId: sessionID}); err != nil {
+		t.Fatalf("Failed to retry commit: %v", err)
+	}
+	if got := fileContent(t, storage, "/up/quota.txt"); got != "1234567890" {
+		t.Errorf("Expected uploaded content, got: %q", got)
+	}
+
+	// The file took over the charge for the staged data
+	if n := used(); n != 10 {
+		t.Errorf("Expected 10 bytes charged after commit, got: %d", n)
+	}
+
+	// Dropping an upload releases its staged data
+	uploads := NewUploadManager(storage)
+	data, _ := storage.Get("/up/quota.txt")
+	dropped := uploads.Begin(sessionID, openResp.Fd, data, 0, nil, time.Now().Add(time.Hour))
+	if _, err := storage.SetQuota(pb.QuotaKind_QUOTA_KIND_USER, "testuser", 20, 0); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+	if err := dropped.Write([]byte("abc"), 0, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to stage data: %v", err)
+	}
+	if n := used(); n != 13 {
+		t.Errorf("Expected 13 bytes charged while staging, got: %d", n)
+	}
+	uploads.Remove(dropped.ID)
+	if n := used(); n != 10 {
+		t.Errorf("Expected 10 bytes charged after dropping the upload, got: %d", n)
+	}
+}
+
+func TestUpload_OtherSessionsCannotUseIt(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	alice, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	bob, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "bob"})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if err := writeTestFile(ctx, client, alice.SessionId, "/alice.txt", "alice's data"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	openResp, err := client.Open(ctx, &pb.OpenRequest{Path: "/alice.txt", Mode: pb.OpenMode_OPEN_MODE_WRITE, SessionId: alice.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	beginResp, err := client.BeginUpload(ctx, &pb.BeginUploadRequest{Fd: openResp.Fd, SessionId: alice.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to begin upload: %v", err)
+	}
+	uploadID := beginResp.UploadId
+	if _, err := sendUpload(ctx, client, alice.SessionId, uploadID, 0, "new"); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+
+	// Knowing the upload ID is not enough to use it from another session
+	if _, err := sendUpload(ctx, client, bob.SessionId, uploadID, 3, "bob's data"); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound uploading to another session's upload, got: %v", err)
+	}
+	if _, err := client.QueryUpload(ctx, &pb.QueryUploadRequest{UploadId: uploadID, SessionId: bob.SessionId}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound querying another session's upload, got: %v", err)
+	}
+	if _, err := client.CommitUpload(ctx, &pb.CommitUploadRequest{UploadId: uploadID, SessionId: bob.SessionId}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound committing another session's upload, got: %v", err)
+	}
+	if got, err := catFile(ctx, client, alice.SessionId, "/alice.txt"); err != nil || got != "alice's data" {
+		t.Errorf("Expected the file unchanged, got: %q (%v)", got, err)
+	}
+
+	// The owning session still can
+	queryResp, err := client.QueryUpload(ctx, &pb.QueryUploadRequest{UploadId: uploadID, SessionId: alice.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to query upload: %v", err)
+	}
+	if queryResp.CommittedLength != 3 {
+		t.Errorf("Expected 3 committed bytes, got: %d", queryResp.CommittedLength)
+	}
+	if _, err := client.CommitUpload(ctx, &pb.CommitUploadRequest{UploadId: uploadID, SessionId: alice.SessionId}); err != nil {
+		t.Fatalf("Failed to commit upload: %v", err)
+	}
+	if got, err := catFile(ctx, client, alice.SessionId, "/alice.txt"); err != nil || got != "new" {
+		t.Errorf("Expected uploaded content, got: %q (%v)", got, err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+)
+
+func TestWrite_ShortWriteReportsCommittedBytes(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	openResp, err := client.Open(ctx, &pb.OpenRequest{
+		Path:      "/partial.txt",
+		Mode:      pb.OpenMode_OPEN_MODE_WRITE,
+		SessionId: sessionResp.SessionId,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+
+	writeStream, err := client.Write(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create write stream: %v", err)
+	}
+	if err := writeStream.Send(&pb.WriteRequest{
+		Data: &pb.WriteRequest_Metadata{
+			Metadata: &pb.WriteMetadata{Fd: openResp.Fd, SessionId: openResp.SessionId, Offset: 0, TotalSize: 10},
+		},
+	}); err != nil {
+		t.Fatalf("Failed to send metadata: %v", err)
+	}
+	if err := writeStream.Send(&pb.WriteRequest{
+		Data: &pb.WriteRequest_Chunk{Chunk: []byte("abcd")},
+	}); err != nil {
+		t.Fatalf("Failed to send chunk: %v", err)
+	}
+
+	resp, err := writeStream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("Expected partial-failure response, got error: %v", err)
+	}
+	if resp.BytesWritten != 4 || resp.ErrorCode != pb.FSErrorCode_FS_ERROR_CODE_IO_ERROR {
+		t.Errorf("Expected 4 committed bytes with IO_ERROR, got: %d, %v", resp.BytesWritten, resp.ErrorCode)
+	}
+
+	data, err := storage.Get("/partial.txt")
+	if err != nil {
+		t.Fatalf("Failed to get file: %v", err)
+	}
+	if got := string(data.Content.Bytes()); got != "abcd" {
+		t.Errorf("Expected committed bytes in storage, got: %q", got)
+	}
+}
+
+func TestWrite_CurrentPositionAndExplicitOffset(t *testing.T) {
+	server, lis, storage, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	session, _ := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice"})
+	opened, err := client.Open(ctx, &pb.OpenRequest{Path: "/shared.txt", Mode: pb.OpenMode_OPEN_MODE_WRITE, SessionId: session.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	dup, err := client.Dup(ctx, &pb.DupRequest{Fd: opened.Fd, SessionId: session.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to dup: %v", err)
+	}
+	write := func(fd int32, offset int64, data string) {
+		t.Helper()
+		stream, err := client.Write(ctx)
+		if err != nil {
+			t.Fatalf("Failed to create write stream: %v", err)
+		}
+		stream.Send(&pb.WriteRequest{Data: &pb.WriteRequest_Metadata{Metadata: &pb.WriteMetadata{Fd: fd, SessionId: session.SessionId, Offset: offset}}})
+		stream.Send(&pb.WriteRequest{Data: &pb.WriteRequest_Chunk{Chunk: []byte(data)}})
+		if resp, err := stream.CloseAndRecv(); err != nil || resp.Error != "" {
+			t.Fatalf("Failed to write: %v %v", err, resp.GetError())
+		}
+	}
+	offset := func() int64 {
+		t.Helper()
+		resp, err := client.Seek(ctx, &pb.SeekRequest{Fd: opened.Fd, SessionId: session.SessionId, Whence: pb.SeekWhence_SEEK_WHENCE_CUR})
+		if err != nil {
+			t.Fatalf("Failed to seek: %v", err)
+		}
+		return resp.Offset
+	}
+
+	// Writes at the current position continue each other through the
+	// shared offset instead of replacing the file
+	write(opened.Fd, -1, "hello ")
+	write(dup.Fd, -1, "world")
+	if got := fileContent(t, storage, "/shared.txt"); got != "hello world" {
+		t.Errorf("Expected %q, got %q", "hello world", got)
+	}
+	if got := offset(); got != 11 {
+		t.Errorf("Expected offset 11, got %d", got)
+	}
+
+	// A write at an explicit offset leaves the offset alone
+	write(dup.Fd, 0, "J")
+	if got := fileContent(t, storage, "/shared.txt"); got != "Jello world" {
+		t.Errorf("Expected %q, got %q", "Jello world", got)
+	}
+	if got := offset(); got != 11 {
+		t.Errorf("Expected offset 11 after a write at an explicit offset, got %d", got)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const (
+	// xattrNameMax is the longest attribute name, namespace included
+	xattrNameMax = 255
+
+	// xattrValueMax is the largest single attribute value
+	xattrValueMax = 64 * 1024
+
+	// xattrSpaceMax bounds the names and values of one file together
+	xattrSpaceMax = 256 * 1024
+
+	// Attribute namespaces
+	xattrUser    = "user."
+	xattrTrusted = "trusted."
+)
+
+var (
+	errNoXattr     = errors.New("no such attribute")
+	errXattrExists = errors.New("attribute already exists")
+	errXattrSpace  = errors.New("no space left for attributes")
+)
+
+// xattrSpace returns the bytes used by the names and values of xattrs
+func xattrSpace(xattrs map[string][]byte) int {
+	n := 0
+	for name, value := range xattrs {
+		n += len(name) + len(value)
+	}
+	return n
+}
+
+// checkXattrName validates an attribute name and its namespace
+func checkXattrName(name string) error {
+	if len(name) > xattrNameMax {
+		return fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_INVALID_ARGUMENT,
+			"attribute name longer than %d bytes", xattrNameMax)
+	}
+	for _, ns := range []string{xattrUser, xattrTrusted} {
+		if strings.HasPrefix(name, ns) && len(name) > len(ns) {
+			return nil
+		}
+	}
+	return fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_INVALID_ARGUMENT,
+		"attribute %q is not in the user. or trusted. namespace", name)
+}
+
+// xattrError converts a storage attribute error to a status error
+func xattrError(err error, name string) error {
+	switch {
+	case errors.Is(err, errNoXattr):
+		return fsErrorf(codes.NotFound, pb.FSErrorCode_FS_ERROR_CODE_NO_ATTRIBUTE, "no attribute %s", name)
+	case errors.Is(err, errXattrExists):
+		return fsErrorf(codes.AlreadyExists, pb.FSErrorCode_FS_ERROR_CODE_FILE_EXISTS, "attribute %s already exists", name)
+	case errors.Is(err, errXattrSpace):
+		return fsErrorf(codes.ResourceExhausted, pb.FSErrorCode_FS_ERROR_CODE_NO_SPACE,
+			"attributes may not exceed %d bytes per file", xattrSpaceMax)
+	}
+	return status.Errorf(codes.Internal, "%v", err)
+}
+
+// xattrTarget checks that the session may access the attribute name of the
+// file at filePath with mode and returns the file. user.* attributes follow
+// the file's permissions and exist only on regular files and directories;
+// trusted.* attributes need a privileged user.
+func (s *Plan92ServiceImpl) xattrTarget(
+	ctx context.Context,
+	session *Session,
+	filePath string,
+	name string,
+	mode pb.OpenMode,
+) (*FileData, error) {
+	if err := checkXattrName(name); err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(name, xattrTrusted) {
+		if !s.privileged(session) {
+			return nil, fsErrorf(codes.PermissionDenied, pb.FSErrorCode_FS_ERROR_CODE_PERMISSION_DENIED,
+				"trusted attributes need a privileged user")
+		}
+	} else {
+		// Changes record their own outcome; reads are recorded as checks
+		var err error
+		if mode == pb.OpenMode_OPEN_MODE_WRITE {
+			err = s.authorize(session, filePath, mode)
+		} else {
+			err = s.checkAccess(ctx, session, filePath, mode)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := s.storage.Get(filePath)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "file not found: %v", err)
+	}
+
+	if strings.HasPrefix(name, xattrUser) {
+		switch s.storage.Stat(data).Type {
+		case pb.FileType_FILE_TYPE_REGULAR, pb.FileType_FILE_TYPE_DIRECTORY:
+		default:
+			return nil, fsErrorf(codes.PermissionDenied, pb.FSErrorCode_FS_ERROR_CODE_PERMISSION_DENIED,
+				"user attributes are only supported on regular files and directories")
+		}
+	}
+
+	return data, nil
+}
+
+// visibleXattrs returns the attributes of the file at filePath that the
+// session may read: user.* if it can read the file, trusted.* if it is
+// privileged
+func (s *Plan92ServiceImpl) visibleXattrs(
+	ctx context.Context,
+	session *Session,
+	filePath string,
+	data *FileData,
+) map[string][]byte {
+	readable := s.authorize(session, filePath, pb.OpenMode_OPEN_MODE_READ) == nil
+	trusted := s.privileged(session)
+
+	visible := make(map[string][]byte)
+	for name, value := range s.storage.Xattrs(data) {
+		if (readable && strings.HasPrefix(name, xattrUser)) ||
+			(trusted && strings.HasPrefix(name, xattrTrusted)) {
+			visible[name] = value
+		}
+	}
+	return visible
+}
+
+// GetXattr returns the value of one extended attribute
+func (s *Plan92ServiceImpl) GetXattr(
+	ctx context.Context,
+	req *pb.GetXattrRequest,
+) (*pb.GetXattrResponse, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	data, err := s.xattrTarget(ctx, session, req.Path, req.Name, pb.OpenMode_OPEN_MODE_READ)
+	if err != nil {
+		return nil, err
+	}
+
+	value, exists := s.storage.Xattrs(data)[req.Name]
+	if !exists {
+		return nil, xattrError(errNoXattr, req.Name)
+	}
+
+	return &pb.GetXattrResponse{Value: value}, nil
+}
+
+// SetXattr creates or replaces one extended attribute
+func (s *Plan92ServiceImpl) SetXattr(
+	ctx context.Context,
+	req *pb.SetXattrRequest,
+) (*emptypb.Empty, error) {
+	if len(req.Value) > xattrValueMax {
+		return nil, fsErrorf(codes.InvalidArgument, pb.FSErrorCode_FS_ERROR_CODE_FILE_TOO_LARGE,
+			"attribute value larger than %d bytes", xattrValueMax)
+	}
+
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	data, err := s.xattrTarget(ctx, session, req.Path, req.Name, pb.OpenMode_OPEN_MODE_WRITE)
+	if err == nil {
+		if err = s.storage.SetXattr(data, req.Name, req.Value, req.Mode); err != nil {
+			err = xattrError(err, req.Name)
+		}
+	}
+	s.audit(session, "setxattr", req.Path, pb.OpenMode_OPEN_MODE_WRITE, int64(len(req.Value)), err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// ListXattr returns the names of the extended attributes the session may
+// read, sorted
+func (s *Plan92ServiceImpl) ListXattr(
+	ctx context.Context,
+	req *pb.ListXattrRequest,
+) (*pb.ListXattrResponse, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	// Privileged users may list attributes of files they cannot read
+	if !s.privileged(session) {
+		if err := s.checkAccess(ctx, session, req.Path, pb.OpenMode_OPEN_MODE_READ); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := s.storage.Get(req.Path)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "file not found: %v", err)
+	}
+
+	names := make([]string, 0)
+	for name := range s.visibleXattrs(ctx, session, req.Path, data) {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return &pb.ListXattrResponse{Names: names}, nil
+}
+
+// RemoveXattr removes one extended attribute
+func (s *Plan92ServiceImpl) RemoveXattr(
+	ctx context.Context,
+	req *pb.RemoveXattrRequest,
+) (*emptypb.Empty, error) {
+	session, err := s.sessions.Get(req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid session: %v", err)
+	}
+
+	data, err := s.xattrTarget(ctx, session, req.Path, req.Name, pb.OpenMode_OPEN_MODE_WRITE)
+	if err == nil {
+		if err = s.storage.RemoveXattr(data, req.Name); err != nil {
+			err = xattrError(err, req.Name)
+		}
+	}
+	s.audit(session, "removexattr", req.Path, pb.OpenMode_OPEN_MODE_WRITE, 0, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// withXattrs returns a copy of info carrying the attributes the session may
+// read
+func (s *Plan92ServiceImpl) withXattrs(
+	ctx context.Context,
+	session *Session,
+	filePath string,
+	data *FileData,
+	info *pb.FileInfo,
+) *pb.FileInfo {
+	info = proto.Clone(info).(*pb.FileInfo)
+	info.Xattrs = s.visibleXattrs(ctx, session, filePath, data)
+	return info
+}
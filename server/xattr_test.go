@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	pb "github.com/accretional/plan92/gen/plan92/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fsErrorCode returns the FSError code carried by a status error
+func fsErrorCode(err error) pb.FSErrorCode {
+	for _, detail := range status.Convert(err).Details() {
+		if fsErr, ok := detail.(*pb.FSError); ok {
+			return fsErr.Code
+		}
+	}
+	return pb.FSErrorCode_FS_ERROR_CODE_UNSPECIFIED
+}
+
+func TestXattr_SetGetListRemove(t *testing.T) {
+	server, lis, _, _ := setupTestServer(t)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	sessionResp, err := client.CreateSession(ctx, &pb.CreateSessionRequest{
+		User:   "testuser",
+		Groups: []string{"testgroup"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	sessionID := sessionResp.SessionId
+
+	if err := writeTestFile(ctx, client, sessionID, "/data.parquet", "rows"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	set := func(name, value string, mode pb.XattrSetMode) error {
+		_, err := client.SetXattr(ctx, &pb.SetXattrRequest{
+			Path:      "/data.parquet",
+			SessionId: sessionID,
+			Name:      name,
+			Value:     []byte(value),
+			Mode:      mode,
+		})
+		return err
+	}
+
+	if err := set("user.producer", "ingest", pb.XattrSetMode_XATTR_SET_MODE_CREATE); err != nil {
+		t.Fatalf("Failed to set xattr: %v", err)
+	}
+	if err := set("user.schema", "v1", pb.XattrSetMode_XATTR_SET_MODE_UNSPECIFIED); err != nil {
+		t.Fatalf("Failed to set xattr: %v", err)
+	}
+
+	// CREATE and REPLACE enforce existence
+	if err := set("user.producer", "other", pb.XattrSetMode_XATTR_SET_MODE_CREATE); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected AlreadyExists creating an existing xattr, got: %v", err)
+	}
+	if err := set("user.lineage", "x", pb.XattrSetMode_XATTR_SET_MODE_REPLACE); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_NO_ATTRIBUTE {
+		t.Errorf("Expected NO_ATTRIBUTE replacing a missing xattr, got: %v", err)
+	}
+	if err := set("user.schema", "v2", pb.XattrSetMode_XATTR_SET_MODE_REPLACE); err != nil {
+		t.Fatalf("Failed to replace xattr: %v", err)
+	}
+
+	getResp, err := client.GetXattr(ctx, &pb.GetXattrRequest{Path: "/data.parquet", SessionId: sessionID, Name: "user.schema"})
+	if err != nil {
+		t.Fatalf("Failed to get xattr: %v", err)
+	}
+	if string(getResp.Value) != "v2" {
+		t.Errorf("Expected %q, got: %q", "v2", getResp.Value)
+	}
+
+	// Attributes survive content changes
+	if err := writeTestFile(ctx, client, sessionID, "/data.parquet", "more rows"); err != nil {
+		t.Fatalf("Failed to rewrite file: %v", err)
+	}
+	listResp, err := client.ListXattr(ctx, &pb.ListXattrRequest{Path: "/data.parquet", SessionId: sessionID})
+	if err != nil {
+		t.Fatalf("Failed to list xattrs: %v", err)
+	}
+	if want := []string{"user.producer", "user.schema"}; !slices.Equal(listResp.Names, want) {
+		t.Errorf("Expected %v, got: %v", want, listResp.Names)
+	}
+
+	statResp, err := client.Stat(ctx, &pb.StatRequest{Path: "/data.parquet", SessionId: sessionID, IncludeXattrs: true})
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+	if string(statResp.Info.Xattrs["user.producer"]) != "ingest" {
+		t.Errorf("Expected xattrs in Stat, got: %v", statResp.Info.Xattrs)
+	}
+	statResp, err = client.Stat(ctx, &pb.StatRequest{Path: "/data.parquet", SessionId: sessionID})
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+	if len(statResp.Info.Xattrs) != 0 {
+		t.Errorf("Expected no xattrs without include_xattrs, got: %v", statResp.Info.Xattrs)
+	}
+
+	if _, err := client.RemoveXattr(ctx, &pb.RemoveXattrRequest{Path: "/data.parquet", SessionId: sessionID, Name: "user.producer"}); err != nil {
+		t.Fatalf("Failed to remove xattr: %v", err)
+	}
+	if _, err := client.GetXattr(ctx, &pb.GetXattrRequest{Path: "/data.parquet", SessionId: sessionID, Name: "user.producer"}); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_NO_ATTRIBUTE {
+		t.Errorf("Expected NO_ATTRIBUTE after remove, got: %v", err)
+	}
+
+	// Names and sizes are validated
+	if err := set("security.selinux", "x", pb.XattrSetMode_XATTR_SET_MODE_UNSPECIFIED); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an unsupported namespace, got: %v", err)
+	}
+	if err := set("user.big", string(make([]byte, xattrValueMax+1)), pb.XattrSetMode_XATTR_SET_MODE_UNSPECIFIED); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an oversized value, got: %v", err)
+	}
+	value := string(bytes.Repeat([]byte("x"), xattrValueMax))
+	for _, name := range []string{"user.fill1", "user.fill2", "user.fill3"} {
+		if err := set(name, value, pb.XattrSetMode_XATTR_SET_MODE_UNSPECIFIED); err != nil {
+			t.Fatalf("Failed to set %s: %v", name, err)
+		}
+	}
+	if err := set("user.overflow", value, pb.XattrSetMode_XATTR_SET_MODE_UNSPECIFIED); fsErrorCode(err) != pb.FSErrorCode_FS_ERROR_CODE_NO_SPACE {
+		t.Errorf("Expected NO_SPACE past the per-file limit, got: %v", err)
+	}
+}
+
+func TestXattr_Permissions(t *testing.T) {
+	server, lis, _, _ := setupPrivilegedTestServer(t, "root")
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, conn, err := createTestClient(ctx, lis)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	alice, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "alice", Groups: []string{"users"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	bob, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "bob", Groups: []string{"others"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	root, err := client.CreateSession(ctx, &pb.CreateSessionRequest{User: "root", Groups: []string{"root"}})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if err := writeTestFile(ctx, client, alice.SessionId, "/report.csv", "a,b"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := client.SetXattr(ctx, &pb.SetXattrRequest{Path: "/report.csv", SessionId: alice.SessionId, Name: "user.owner", Value: []byte("alice")}); err != nil {
+		t.Fatalf("Failed to set xattr: %v", err)
+	}
+
+	// user.* follows the file's permissions: bob may read but not write
+	if _, err := client.GetXattr(ctx, &pb.GetXattrRequest{Path: "/report.csv", SessionId: bob.SessionId, Name: "user.owner"}); err != nil {
+		t.Errorf("Expected bob to read a user xattr, got: %v", err)
+	}
+	if _, err := client.SetXattr(ctx, &pb.SetXattrRequest{Path: "/report.csv", SessionId: bob.SessionId, Name: "user.owner", Value: []byte("bob")}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied setting a user xattr without write permission, got: %v", err)
+	}
+
+	// trusted.* needs the superuser and is hidden from everyone else
+	if _, err := client.SetXattr(ctx, &pb.SetXattrRequest{Path: "/report.csv", SessionId: alice.SessionId, Name: "trusted.lineage", Value: []byte("job-7")}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied setting a trusted xattr as owner, got: %v", err)
+	}
+	if _, err := client.SetXattr(ctx, &pb.SetXattrRequest{Path: "/report.csv", SessionId: root.SessionId, Name: "trusted.lineage", Value: []byte("job-7")}); err != nil {
+		t.Fatalf("Failed to set trusted xattr as superuser: %v", err)
+	}
+
+	listResp, err := client.ListXattr(ctx, &pb.ListXattrRequest{Path: "/report.csv", SessionId: alice.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to list xattrs: %v", err)
+	}
+	if want := []string{"user.owner"}; !slices.Equal(listResp.Names, want) {
+		t.Errorf("Expected %v for the owner, got: %v", want, listResp.Names)
+	}
+	listResp, err = client.ListXattr(ctx, &pb.ListXattrRequest{Path: "/report.csv", SessionId: root.SessionId})
+	if err != nil {
+		t.Fatalf("Failed to list xattrs: %v", err)
+	}
+	if want := []string{"trusted.lineage", "user.owner"}; !slices.Equal(listResp.Names, want) {
+		t.Errorf("Expected %v for the superuser, got: %v", want, listResp.Names)
+	}
+}